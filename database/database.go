@@ -2,9 +2,13 @@ package database
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
 type Table struct {
@@ -12,11 +16,19 @@ type Table struct {
 	Client *dynamodb.Client
 }
 
+// the storage backend used by the server
 type Database struct {
-	Items        ItemTable
-	Users        UserTable
-	UserScores   UserScoreTable
-	GlobalScores GlobalScoreTable
+	Polls          PollStore
+	PollMembers    PollMemberStore
+	Items          ItemStore
+	Users          UserStore
+	UserScores     UserScoreStore
+	GlobalScores   GlobalScoreStore
+	Sessions       SessionStore
+	Votes          VoteStore
+	VoteEvents     VoteEventStore
+	ScoreRebuilds  ScoreRebuildStore
+	FittedRankings FittedRankingStore
 }
 
 func GetClient(region string) (*dynamodb.Client, error) {
@@ -43,19 +55,83 @@ func DeleteTable(client *dynamodb.Client, tableName string) error {
 	return err
 }
 
+// creates a table and waits for it to be ready, so that it can be written to straight away
+func createTable(client *dynamodb.Client, input *dynamodb.CreateTableInput) error {
+	_, err := client.CreateTable(context.TODO(), input)
+	if err != nil {
+		return err
+	}
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	return waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{TableName: input.TableName}, 5*time.Minute)
+}
+
+// copies every record of a table from before there were polls into the table that replaced it,
+// after convert has added whatever the new table needs
+// the old table is left in place, and can be deleted once the copy has been checked
+func copyLegacyTable(client *dynamodb.Client, from string, to string, convert func(map[string]types.AttributeValue)) error {
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{TableName: aws.String(from)})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			convert(item)
+			_, err := client.PutItem(context.TODO(), &dynamodb.PutItemInput{TableName: aws.String(to), Item: item})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// the items and scores of a deployment from before there were polls all belong to the default poll
+func intoDefaultPoll(item map[string]types.AttributeValue) {
+	item["Poll"] = &types.AttributeValueMemberS{Value: DEFAULT_POLL}
+}
+
 func GetDatabase(client *dynamodb.Client) (Database, error) {
 	currentTables, err := ListTables(client)
 	if err != nil {
 		return Database{}, err
 	}
+	var polls PollTable
+	if !contains(currentTables, "Polls") {
+		polls, err = CreatePollTable(client)
+		if err != nil {
+			return Database{}, err
+		}
+	} else {
+		polls = PollTable{Name: "Polls", Client: client}
+	}
+	err = createDefaultPoll(polls)
+	if err != nil {
+		return Database{}, err
+	}
+	var pollMembers PollMemberTable
+	if !contains(currentTables, "PollMembers") {
+		pollMembers, err = CreatePollMemberTable(client)
+		if err != nil {
+			return Database{}, err
+		}
+	} else {
+		pollMembers = PollMemberTable{Name: "PollMembers", Client: client}
+	}
 	var items ItemTable
-	if !contains(currentTables, "Items") {
+	if !contains(currentTables, "PollItems") {
 		items, err = CreateItemTable(client)
 		if err != nil {
 			return Database{}, err
 		}
+		if contains(currentTables, "Items") {
+			err = copyLegacyTable(client, "Items", items.Name, intoDefaultPoll)
+			if err != nil {
+				return Database{}, fmt.Errorf("error copying items into the default poll: %v", err)
+			}
+		}
 	} else {
-		items = ItemTable{Name: "Items", Client: client}
+		items = ItemTable{Name: "PollItems", Client: client}
 	}
 	var users UserTable
 	if !contains(currentTables, "Users") {
@@ -67,28 +143,84 @@ func GetDatabase(client *dynamodb.Client) (Database, error) {
 		users = UserTable{Name: "Users", Client: client}
 	}
 	var userScores UserScoreTable
-	if !contains(currentTables, "UserScores") {
+	if !contains(currentTables, "PollUserScores") {
 		userScores, err = CreateUserScoreTable(client)
 		if err != nil {
 			return Database{}, err
 		}
+		if contains(currentTables, "UserScores") {
+			err = copyLegacyTable(client, "UserScores", userScores.Name, func(item map[string]types.AttributeValue) {
+				intoDefaultPoll(item)
+				itemName := item["ItemName"].(*types.AttributeValueMemberS).Value
+				item["PollItem"] = &types.AttributeValueMemberS{Value: pollItem(DEFAULT_POLL, itemName)}
+			})
+			if err != nil {
+				return Database{}, fmt.Errorf("error copying user scores into the default poll: %v", err)
+			}
+		}
 	} else {
-		userScores = UserScoreTable{Name: "UserScores", Client: client}
+		userScores = UserScoreTable{Name: "PollUserScores", Client: client}
 	}
 	var globalScores GlobalScoreTable
-	if !contains(currentTables, "GlobalScores") {
+	if !contains(currentTables, "PollGlobalScores") {
 		globalScores, err = CreateGlobalScoreTable(client)
 		if err != nil {
 			return Database{}, err
 		}
+		if contains(currentTables, "GlobalScores") {
+			err = copyLegacyTable(client, "GlobalScores", globalScores.Name, func(item map[string]types.AttributeValue) {
+				intoDefaultPoll(item)
+				// the single leaderboard used to be partitioned on Board; now it's partitioned on Poll
+				delete(item, "Board")
+			})
+			if err != nil {
+				return Database{}, fmt.Errorf("error copying global scores into the default poll: %v", err)
+			}
+		}
+	} else {
+		globalScores = GlobalScoreTable{Name: "PollGlobalScores", Client: client}
+	}
+	var sessions SessionTable
+	if !contains(currentTables, "Sessions") {
+		sessions, err = CreateSessionTable(client)
+		if err != nil {
+			return Database{}, err
+		}
 	} else {
-		globalScores = GlobalScoreTable{Name: "GlobalScores", Client: client}
+		sessions = SessionTable{Name: "Sessions", Client: client}
 	}
+	var voteEvents VoteEventTable
+	if !contains(currentTables, "VoteEvents") {
+		voteEvents, err = CreateVoteEventTable(client)
+		if err != nil {
+			return Database{}, err
+		}
+	} else {
+		voteEvents = VoteEventTable{Name: "VoteEvents", Client: client}
+	}
+	var fittedRankings FittedRankingTable
+	if !contains(currentTables, "FittedRankings") {
+		fittedRankings, err = CreateFittedRankingTable(client)
+		if err != nil {
+			return Database{}, err
+		}
+	} else {
+		fittedRankings = FittedRankingTable{Name: "FittedRankings", Client: client}
+	}
+	scores := DynamoScoreStore{Polls: polls, UserScores: userScores, GlobalScores: globalScores}
+	votes := DynamoVoteStore{Polls: polls, Items: items, UserScores: userScores, GlobalScores: globalScores, VoteEvents: voteEvents}
 	return Database{
-		Items:        items,
-		Users:        users,
-		UserScores:   userScores,
-		GlobalScores: globalScores,
+		Polls:          polls,
+		PollMembers:    pollMembers,
+		Items:          items,
+		Users:          users,
+		UserScores:     scores,
+		GlobalScores:   scores,
+		Sessions:       sessions,
+		Votes:          votes,
+		VoteEvents:     voteEvents,
+		ScoreRebuilds:  votes,
+		FittedRankings: fittedRankings,
 	}, nil
 }
 
@@ -104,3 +236,42 @@ func (e NotFoundError) Error() string {
 func MakeNotFoundError(message string) error {
 	return NotFoundError{Message: message}
 }
+
+// error type for trying to create something that already exists
+type AlreadyExistsError struct {
+	Message string
+}
+
+func (e AlreadyExistsError) Error() string {
+	return e.Message
+}
+
+func MakeAlreadyExistsError(message string) error {
+	return AlreadyExistsError{Message: message}
+}
+
+// error type for edits to something that has changed since the version they were based on
+type VersionMismatchError struct {
+	Message string
+}
+
+func (e VersionMismatchError) Error() string {
+	return e.Message
+}
+
+func MakeVersionMismatchError(message string) error {
+	return VersionMismatchError{Message: message}
+}
+
+// error type for things the storage backend in use can't do
+type NotSupportedError struct {
+	Message string
+}
+
+func (e NotSupportedError) Error() string {
+	return e.Message
+}
+
+func MakeNotSupportedError(message string) error {
+	return NotSupportedError{Message: message}
+}
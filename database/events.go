@@ -0,0 +1,166 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type VoteEventTable Table
+
+// a single vote as it was cast, kept forever so that votes can be audited and ratings rebuilt from them
+// items are identified by ID; Winner is the ID of whichever of Item1 and Item2 was preferred
+// IDs sort in the order the votes were recorded in their poll (see nextVoteEventID)
+// Metadata holds details of the request the vote came in, like the client's address
+type VoteEvent struct {
+	ID        string            `json:"id"`
+	Poll      string            `json:"poll"`
+	UserName  string            `json:"userName"`
+	Item1     string            `json:"item1"`
+	Item2     string            `json:"item2"`
+	Winner    string            `json:"winner"`
+	Timestamp time.Time         `json:"timestamp"`
+	Metadata  map[string]string `json:"metadata"`
+}
+
+// the number of digits of the time at the start of a vote event ID
+const voteEventTimeDigits = 19
+
+// vote event IDs start with the time the vote was cast in nanoseconds, padded so that they sort in time order,
+// with a random suffix in case two votes are cast at the same time
+func NewVoteEventID(at time.Time) (string, error) {
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d-%s", voteEventTimeDigits, at.UnixNano(), base64.RawURLEncoding.EncodeToString(suffix)), nil
+}
+
+// a poll's votes are recorded one at a time, each with an ID later than the last, so that anything that has read
+// a poll's events up to some ID has seen every vote recorded before then, even one that was cast earlier but took
+// longer to be recorded; this returns the ID to record an event with, given the ID of the poll's latest event
+// an ID that isn't later is moved to just after the latest, keeping its random suffix
+func nextVoteEventID(latest, id string) (string, error) {
+	if id > latest {
+		return id, nil
+	}
+	if len(latest) < voteEventTimeDigits || len(id) < voteEventTimeDigits {
+		return "", fmt.Errorf("can't order vote event %s after %s", id, latest)
+	}
+	nanos, err := strconv.ParseInt(latest[:voteEventTimeDigits], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("can't order vote event %s after %s: %v", id, latest, err)
+	}
+	return fmt.Sprintf("%0*d%s", voteEventTimeDigits, nanos+1, id[voteEventTimeDigits:]), nil
+}
+
+func CreateVoteEventTable(client *dynamodb.Client) (VoteEventTable, error) {
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("Poll"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("ID"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("Poll"),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String("ID"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		TableName:   aws.String("VoteEvents"),
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	err := createTable(client, input)
+	if err != nil {
+		return VoteEventTable{}, err
+	}
+	return VoteEventTable{Name: "VoteEvents", Client: client}, nil
+}
+
+func voteEventToAttributes(event VoteEvent) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Poll":      &types.AttributeValueMemberS{Value: event.Poll},
+		"ID":        &types.AttributeValueMemberS{Value: event.ID},
+		"UserName":  &types.AttributeValueMemberS{Value: event.UserName},
+		"Item1":     &types.AttributeValueMemberS{Value: event.Item1},
+		"Item2":     &types.AttributeValueMemberS{Value: event.Item2},
+		"Winner":    &types.AttributeValueMemberS{Value: event.Winner},
+		"Timestamp": &types.AttributeValueMemberN{Value: strconv.FormatInt(event.Timestamp.Unix(), 10)},
+		"Metadata":  metadataToAttribute(event.Metadata),
+	}
+}
+
+func voteEventFromAttributes(item map[string]types.AttributeValue) (VoteEvent, error) {
+	timestamp, err := strconv.ParseInt(item["Timestamp"].(*types.AttributeValueMemberN).Value, 10, 64)
+	if err != nil {
+		return VoteEvent{}, err
+	}
+	event := VoteEvent{
+		ID:        item["ID"].(*types.AttributeValueMemberS).Value,
+		Poll:      item["Poll"].(*types.AttributeValueMemberS).Value,
+		UserName:  item["UserName"].(*types.AttributeValueMemberS).Value,
+		Item1:     item["Item1"].(*types.AttributeValueMemberS).Value,
+		Item2:     item["Item2"].(*types.AttributeValueMemberS).Value,
+		Winner:    item["Winner"].(*types.AttributeValueMemberS).Value,
+		Timestamp: time.Unix(timestamp, 0),
+		Metadata:  map[string]string{},
+	}
+	if metadata, ok := item["Metadata"].(*types.AttributeValueMemberM); ok {
+		for key, value := range metadata.Value {
+			event.Metadata[key] = value.(*types.AttributeValueMemberS).Value
+		}
+	}
+	return event, nil
+}
+
+// the write that adds a vote event, as part of the transaction that records the vote
+// the condition keeps a retried transaction from ever overwriting an event
+func (t VoteEventTable) putVoteEvent(event VoteEvent) types.TransactWriteItem {
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			Item:                voteEventToAttributes(event),
+			TableName:           aws.String(t.Name),
+			ConditionExpression: aws.String("attribute_not_exists(ID)"),
+		},
+	}
+}
+
+// returns a page of a poll's vote events in the order they were cast, and the cursor for the next page
+func (t VoteEventTable) VoteEventsPage(poll string, options PageOptions) ([]VoteEvent, string, error) {
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":poll": &types.AttributeValueMemberS{Value: poll},
+		},
+		KeyConditionExpression: aws.String("Poll = :poll"),
+		TableName:              aws.String(t.Name),
+		// so that a rebuild reading up to some event sees every event before it
+		ConsistentRead: aws.Bool(true),
+	}
+	records, next, err := queryPage(Table(t), input, options)
+	if err != nil {
+		return nil, "", err
+	}
+	events := make([]VoteEvent, len(records))
+	for i, item := range records {
+		events[i], err = voteEventFromAttributes(item)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return events, next, nil
+}
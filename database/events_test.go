@@ -0,0 +1,71 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextVoteEventID(t *testing.T) {
+	latest := "0000000000000000200-latest"
+	if id, _ := nextVoteEventID(latest, "0000000000000000300-later"); id != "0000000000000000300-later" {
+		t.Errorf("a later ID was changed to %s", id)
+	}
+	id, err := nextVoteEventID(latest, "0000000000000000100-early")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "0000000000000000201-early" {
+		t.Errorf("an earlier ID was changed to %s, want 0000000000000000201-early", id)
+	}
+	if _, err := nextVoteEventID("no-time", "0000000000000000100-early"); err == nil {
+		t.Error("an ID was ordered after one without a time")
+	}
+}
+
+// a vote that was cast before the latest one but is recorded after it must still come after it in the log,
+// or a rebuild that has read up to the latest one would never see it
+func testVotesRecordedInOrder(t *testing.T, db Database) {
+	noChange := func(userScore1, userScore2 *UserScore, globalScore1, globalScore2 *GlobalScore) {}
+	now := time.Now()
+	later, err := NewVoteEventID(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	earlier, err := NewVoteEventID(now.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := createTestItems(t, db, DEFAULT_POLL, "a", "b")
+	for _, id := range []string{later, earlier} {
+		event := VoteEvent{ID: id, Poll: DEFAULT_POLL, UserName: "user1", Item1: items[0].ID, Item2: items[1].ID, Winner: items[0].ID, Timestamp: now}
+		err = db.Votes.RecordVote(event, items[0], items[1], noChange)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, _, err := db.VoteEvents.VoteEventsPage(DEFAULT_POLL, PageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ID != later || events[1].ID <= later {
+		t.Fatalf("events are %+v, want %s followed by a later ID", events, later)
+	}
+
+	err = db.ScoreRebuilds.SwapScores(DEFAULT_POLL, "rebuild1", later)
+	if _, ok := err.(VersionMismatchError); !ok {
+		t.Errorf("swapping in scores rebuilt up to %s gave %v, want a VersionMismatchError", later, err)
+	}
+	err = db.ScoreRebuilds.SwapScores(DEFAULT_POLL, "rebuild1", events[1].ID)
+	if err != nil {
+		t.Errorf("swapping in scores rebuilt up to the latest event gave %v", err)
+	}
+}
+
+func TestMemoryVotesRecordedInOrder(t *testing.T) {
+	testVotesRecordedInOrder(t, NewMemoryDatabase())
+}
+
+func TestSQLiteVotesRecordedInOrder(t *testing.T) {
+	testVotesRecordedInOrder(t, openTestSQLite(t))
+}
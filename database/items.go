@@ -2,7 +2,10 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -12,14 +15,32 @@ import (
 type ItemTable Table
 
 // an item that will be voted on
+// scores refer to items by ID, which never changes, so items can be renamed without losing their votes
+// the version goes up by one with every edit, so that edits based on an old copy of the item can be refused
+// items in the trash have the time they were put there in DeletedAt, and are left out of everything but the trash
+// MergedFrom has the IDs of the items that were merged into this one, so that votes logged for them can be counted for it
 type Item struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	Poll        string            `json:"poll"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
+	Version     int               `json:"version"`
+	DeletedAt   *time.Time        `json:"deletedAt,omitempty"`
+	MergedFrom  []string          `json:"mergedFrom,omitempty"`
 }
 
+// the version of items from before there were versions
+const legacyItemVersion = 1
+
+// items are partitioned by poll, so that a poll's items can be listed with a Query
 func CreateItemTable(client *dynamodb.Client) (ItemTable, error) {
 	input := &dynamodb.CreateTableInput{
 		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("Poll"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
 			{
 				AttributeName: aws.String("Name"),
 				AttributeType: types.ScalarAttributeTypeS,
@@ -27,37 +48,162 @@ func CreateItemTable(client *dynamodb.Client) (ItemTable, error) {
 		},
 		KeySchema: []types.KeySchemaElement{
 			{
-				AttributeName: aws.String("Name"),
+				AttributeName: aws.String("Poll"),
 				KeyType:       types.KeyTypeHash,
 			},
+			{
+				AttributeName: aws.String("Name"),
+				KeyType:       types.KeyTypeRange,
+			},
 		},
-		TableName:   aws.String("Items"),
+		TableName:   aws.String("PollItems"),
 		BillingMode: types.BillingModePayPerRequest,
 	}
-	_, err := client.CreateTable(context.TODO(), input)
+	err := createTable(client, input)
 	if err != nil {
 		return ItemTable{}, err
 	}
-	return ItemTable{Name: "Items", Client: client}, nil
+	return ItemTable{Name: "PollItems", Client: client}, nil
+}
+
+func itemKey(poll, name string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Poll": &types.AttributeValueMemberS{Value: poll},
+		"Name": &types.AttributeValueMemberS{Value: name},
+	}
+}
+
+func metadataToAttribute(metadata map[string]string) types.AttributeValue {
+	values := map[string]types.AttributeValue{}
+	for key, value := range metadata {
+		values[key] = &types.AttributeValueMemberS{Value: value}
+	}
+	return &types.AttributeValueMemberM{Value: values}
 }
 
-func (t ItemTable) PutItem(item Item) error {
+// DeletedAt is stored in Unix seconds, and only for items in the trash
+// MergedFrom is a string set, which can't be empty, so it's only stored for items that have had others merged into them
+func itemToAttributes(item Item) map[string]types.AttributeValue {
+	attributes := map[string]types.AttributeValue{
+		"Poll":        &types.AttributeValueMemberS{Value: item.Poll},
+		"ID":          &types.AttributeValueMemberS{Value: item.ID},
+		"Name":        &types.AttributeValueMemberS{Value: item.Name},
+		"Description": &types.AttributeValueMemberS{Value: item.Description},
+		"Metadata":    metadataToAttribute(item.Metadata),
+		"Version":     &types.AttributeValueMemberN{Value: strconv.Itoa(item.Version)},
+	}
+	if item.DeletedAt != nil {
+		attributes["DeletedAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(item.DeletedAt.Unix(), 10)}
+	}
+	if len(item.MergedFrom) > 0 {
+		attributes["MergedFrom"] = &types.AttributeValueMemberSS{Value: item.MergedFrom}
+	}
+	return attributes
+}
+
+// the condition for editing an item that is still at the given version
+func itemVersionCondition(version int) string {
+	if version == legacyItemVersion {
+		return "attribute_exists(#name) AND (Version = :version OR attribute_not_exists(Version))"
+	}
+	return "attribute_exists(#name) AND Version = :version"
+}
+
+func (t ItemTable) CreateItem(item Item) error {
+	item.DeletedAt = nil
+	item.MergedFrom = nil
 	input := &dynamodb.PutItemInput{
-		Item: map[string]types.AttributeValue{
-			"Name":        &types.AttributeValueMemberS{Value: item.Name},
-			"Description": &types.AttributeValueMemberS{Value: item.Description},
-		},
-		TableName: aws.String(t.Name),
+		Item:                     itemToAttributes(item),
+		TableName:                aws.String(t.Name),
+		ConditionExpression:      aws.String("attribute_not_exists(#name)"),
+		ExpressionAttributeNames: map[string]string{"#name": "Name"},
 	}
 	_, err := t.Client.PutItem(context.TODO(), input)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return MakeAlreadyExistsError(fmt.Sprintf("an item named %s already exists in poll %s", item.Name, item.Poll))
+	}
 	return err
 }
 
-func (t ItemTable) GetItem(name string) (Item, error) {
-	input := &dynamodb.GetItemInput{
-		Key: map[string]types.AttributeValue{
-			"Name": &types.AttributeValueMemberS{Value: name},
+func (t ItemTable) UpdateItem(name string, item Item) error {
+	if name != item.Name {
+		return t.renameItem(name, item)
+	}
+	values := map[string]types.AttributeValue{
+		":description": &types.AttributeValueMemberS{Value: item.Description},
+		":metadata":    metadataToAttribute(item.Metadata),
+		":version":     &types.AttributeValueMemberN{Value: strconv.Itoa(item.Version)},
+		":newVersion":  &types.AttributeValueMemberN{Value: strconv.Itoa(item.Version + 1)},
+	}
+	input := &dynamodb.UpdateItemInput{
+		Key:                       itemKey(item.Poll, item.Name),
+		TableName:                 aws.String(t.Name),
+		UpdateExpression:          aws.String("SET Description = :description, Metadata = :metadata, Version = :newVersion"),
+		ConditionExpression:       aws.String(itemVersionCondition(item.Version)),
+		ExpressionAttributeNames:  map[string]string{"#name": "Name"},
+		ExpressionAttributeValues: values,
+	}
+	_, err := t.Client.UpdateItem(context.TODO(), input)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return t.versionMismatch(item.Poll, name, item.Version)
+	}
+	return err
+}
+
+// items are keyed by name, so renaming one replaces it with a copy under the new name in a single transaction
+func (t ItemTable) renameItem(name string, item Item) error {
+	renamed := item
+	renamed.Version++
+	writes := []types.TransactWriteItem{
+		{
+			Delete: &types.Delete{
+				Key:                      itemKey(item.Poll, name),
+				TableName:                aws.String(t.Name),
+				ConditionExpression:      aws.String(itemVersionCondition(item.Version)),
+				ExpressionAttributeNames: map[string]string{"#name": "Name"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":version": &types.AttributeValueMemberN{Value: strconv.Itoa(item.Version)},
+				},
+			},
 		},
+		{
+			Put: &types.Put{
+				Item:                     itemToAttributes(renamed),
+				TableName:                aws.String(t.Name),
+				ConditionExpression:      aws.String("attribute_not_exists(#name)"),
+				ExpressionAttributeNames: map[string]string{"#name": "Name"},
+			},
+		},
+	}
+	_, err := t.Client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) || len(canceled.CancellationReasons) < 2 {
+		return err
+	}
+	if reason := canceled.CancellationReasons[1].Code; reason != nil && *reason == "ConditionalCheckFailed" {
+		return MakeAlreadyExistsError(fmt.Sprintf("an item named %s already exists in poll %s", item.Name, item.Poll))
+	}
+	if reason := canceled.CancellationReasons[0].Code; reason != nil && *reason == "ConditionalCheckFailed" {
+		return t.versionMismatch(item.Poll, name, item.Version)
+	}
+	return err
+}
+
+// works out why a conditional edit of an item failed: either the item is gone or someone else changed it first
+func (t ItemTable) versionMismatch(poll, name string, version int) error {
+	_, err := t.GetItem(poll, name)
+	if err != nil {
+		return err
+	}
+	return MakeVersionMismatchError(fmt.Sprintf("item %s has changed since version %d", name, version))
+}
+
+// reads an item whether or not it's in the trash
+func (t ItemTable) getItem(poll, name string) (Item, error) {
+	input := &dynamodb.GetItemInput{
+		Key:       itemKey(poll, name),
 		TableName: aws.String(t.Name),
 	}
 	output, err := t.Client.GetItem(context.TODO(), input)
@@ -65,39 +211,221 @@ func (t ItemTable) GetItem(name string) (Item, error) {
 		return Item{}, err
 	}
 	if output.Item == nil {
-		return Item{}, fmt.Errorf("no item found with name %s", name)
+		return Item{}, MakeNotFoundError(fmt.Sprintf("no item found with name %s in poll %s", name, poll))
 	}
-	return Item{
-		Name:        output.Item["Name"].(*types.AttributeValueMemberS).Value,
-		Description: output.Item["Description"].(*types.AttributeValueMemberS).Value,
-	}, nil
+	return itemFromAttributes(output.Item), nil
 }
 
-func (t ItemTable) DeleteItem(name string) error {
-	input := &dynamodb.DeleteItemInput{
-		Key: map[string]types.AttributeValue{
-			"Name": &types.AttributeValueMemberS{Value: name},
+func (t ItemTable) GetItem(poll, name string) (Item, error) {
+	item, err := t.getItem(poll, name)
+	if err == nil && item.DeletedAt != nil {
+		return Item{}, MakeNotFoundError(fmt.Sprintf("no item found with name %s in poll %s", name, poll))
+	}
+	return item, err
+}
+
+func (t ItemTable) GetTrashedItem(poll, name string) (Item, error) {
+	item, err := t.getItem(poll, name)
+	if err == nil && item.DeletedAt == nil {
+		return Item{}, MakeNotFoundError(fmt.Sprintf("no item found with name %s in the trash of poll %s", name, poll))
+	}
+	return item, err
+}
+
+// a transaction write that only goes through if the item is still there under its ID and out of the trash
+// items from before IDs were kept have their name as their ID
+func (t ItemTable) checkVotable(item Item) types.TransactWriteItem {
+	return types.TransactWriteItem{ConditionCheck: &types.ConditionCheck{
+		Key:                      itemKey(item.Poll, item.Name),
+		TableName:                aws.String(t.Name),
+		ConditionExpression:      aws.String("attribute_exists(#name) AND attribute_not_exists(DeletedAt) AND (ID = :id OR (attribute_not_exists(ID) AND #name = :id))"),
+		ExpressionAttributeNames: map[string]string{"#name": "Name"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: item.ID},
 		},
+	}}
+}
+
+func (t ItemTable) DeleteItem(poll, name string) error {
+	input := &dynamodb.DeleteItemInput{
+		Key:       itemKey(poll, name),
 		TableName: aws.String(t.Name),
 	}
 	_, err := t.Client.DeleteItem(context.TODO(), input)
 	return err
 }
 
-func (t ItemTable) AllItems() ([]Item, error) {
-	input := &dynamodb.ScanInput{
-		TableName: aws.String(t.Name),
+func (t ItemTable) AllItems(poll string) ([]Item, error) {
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":poll": &types.AttributeValueMemberS{Value: poll},
+		},
+		KeyConditionExpression: aws.String("Poll = :poll"),
+		FilterExpression:       aws.String("attribute_not_exists(DeletedAt)"),
+		TableName:              aws.String(t.Name),
 	}
-	output, err := t.Client.Scan(context.TODO(), input)
+	items := []Item{}
+	paginator := dynamodb.NewQueryPaginator(t.Client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range output.Items {
+			items = append(items, itemFromAttributes(item))
+		}
+	}
+	return items, nil
+}
+
+// returns a page of a poll's items ordered by name, and the cursor for the next page
+func (t ItemTable) ItemsPage(poll string, options PageOptions) ([]Item, string, error) {
+	return t.itemsPage(poll, "attribute_not_exists(DeletedAt)", options)
+}
+
+// returns a page of the items in a poll's trash ordered by name, and the cursor for the next page
+func (t ItemTable) TrashedItemsPage(poll string, options PageOptions) ([]Item, string, error) {
+	return t.itemsPage(poll, "attribute_exists(DeletedAt)", options)
+}
+
+// pages through a poll's items that match filter
+func (t ItemTable) itemsPage(poll string, filter string, options PageOptions) ([]Item, string, error) {
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":poll": &types.AttributeValueMemberS{Value: poll},
+		},
+		KeyConditionExpression: aws.String("Poll = :poll"),
+		FilterExpression:       aws.String(filter),
+		TableName:              aws.String(t.Name),
+	}
+	if options.Prefix != "" {
+		input.KeyConditionExpression = aws.String("Poll = :poll AND begins_with(#name, :prefix)")
+		input.ExpressionAttributeNames = map[string]string{"#name": "Name"}
+		input.ExpressionAttributeValues[":prefix"] = &types.AttributeValueMemberS{Value: options.Prefix}
+	}
+	records, next, err := queryPage(Table(t), input, options)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	items := make([]Item, len(records))
+	for i, item := range records {
+		items[i] = itemFromAttributes(item)
 	}
-	items := make([]Item, len(output.Items))
-	for i, item := range output.Items {
-		items[i] = Item{
-			Name:        item["Name"].(*types.AttributeValueMemberS).Value,
-			Description: item["Description"].(*types.AttributeValueMemberS).Value,
+	return items, next, nil
+}
+
+// the IDs of the items in a poll's trash, read consistently so that none that were put there before the read are missed
+func (t ItemTable) trashedIDs(poll string) (map[string]bool, error) {
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":poll": &types.AttributeValueMemberS{Value: poll},
+		},
+		KeyConditionExpression: aws.String("Poll = :poll"),
+		FilterExpression:       aws.String("attribute_exists(DeletedAt)"),
+		TableName:              aws.String(t.Name),
+		ConsistentRead:         aws.Bool(true),
+	}
+	ids := map[string]bool{}
+	paginator := dynamodb.NewQueryPaginator(t.Client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range output.Items {
+			ids[itemFromAttributes(item).ID] = true
+		}
+	}
+	return ids, nil
+}
+
+// returns the items in the trash of every poll that were put there before the given time
+func (t ItemTable) TrashedBefore(before time.Time) ([]Item, error) {
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(t.Name),
+		FilterExpression: aws.String("DeletedAt < :before"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":before": &types.AttributeValueMemberN{Value: strconv.FormatInt(before.Unix(), 10)},
+		},
+	}
+	items := []Item{}
+	paginator := dynamodb.NewScanPaginator(t.Client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range output.Items {
+			items = append(items, itemFromAttributes(item))
 		}
 	}
 	return items, nil
 }
+
+// items from before there were IDs use their name as their ID, which is what their scores are keyed by
+// items from before there was metadata or versioning get an empty map and the legacy version
+func itemFromAttributes(item map[string]types.AttributeValue) Item {
+	name := item["Name"].(*types.AttributeValueMemberS).Value
+	result := Item{
+		Poll:        item["Poll"].(*types.AttributeValueMemberS).Value,
+		ID:          name,
+		Name:        name,
+		Description: item["Description"].(*types.AttributeValueMemberS).Value,
+		Metadata:    map[string]string{},
+		Version:     legacyItemVersion,
+	}
+	if id, ok := item["ID"].(*types.AttributeValueMemberS); ok {
+		result.ID = id.Value
+	}
+	if metadata, ok := item["Metadata"].(*types.AttributeValueMemberM); ok {
+		for key, value := range metadata.Value {
+			result.Metadata[key] = value.(*types.AttributeValueMemberS).Value
+		}
+	}
+	if version, ok := item["Version"].(*types.AttributeValueMemberN); ok {
+		result.Version, _ = strconv.Atoi(version.Value)
+	}
+	if deletedAt, ok := item["DeletedAt"].(*types.AttributeValueMemberN); ok {
+		seconds, _ := strconv.ParseInt(deletedAt.Value, 10, 64)
+		at := time.Unix(seconds, 0)
+		result.DeletedAt = &at
+	}
+	if mergedFrom, ok := item["MergedFrom"].(*types.AttributeValueMemberSS); ok {
+		result.MergedFrom = mergedFrom.Value
+	}
+	return result
+}
+
+// the IDs that an item merged into another one adds to that item's MergedFrom: its own, and those of the items merged into it
+func mergedIDs(from Item) []string {
+	return append([]string{from.ID}, from.MergedFrom...)
+}
+
+// deletes an item that has been merged into another, and adds it to the other item's MergedFrom, in one transaction
+// the version of the item merged into goes up, so that edits to an old copy of it can't overwrite MergedFrom
+func (t ItemTable) recordMerge(from, into Item) error {
+	writes := []types.TransactWriteItem{
+		{
+			Delete: &types.Delete{
+				Key:       itemKey(from.Poll, from.Name),
+				TableName: aws.String(t.Name),
+			},
+		},
+		{
+			Update: &types.Update{
+				Key:                      itemKey(into.Poll, into.Name),
+				TableName:                aws.String(t.Name),
+				UpdateExpression:         aws.String("SET Version = if_not_exists(Version, :legacy) + :one ADD MergedFrom :ids"),
+				ConditionExpression:      aws.String("attribute_exists(#name)"),
+				ExpressionAttributeNames: map[string]string{"#name": "Name"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":legacy": &types.AttributeValueMemberN{Value: strconv.Itoa(legacyItemVersion)},
+					":one":    &types.AttributeValueMemberN{Value: "1"},
+					":ids":    &types.AttributeValueMemberSS{Value: mergedIDs(from)},
+				},
+			},
+		},
+	}
+	_, err := t.Client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	return err
+}
@@ -0,0 +1,772 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// an in-memory implementation of all the stores, for local development and tests
+// safe for concurrent use; nothing is persisted when the process exits
+type MemoryStore struct {
+	mu           sync.RWMutex
+	polls        map[string]Poll
+	pollMembers  map[inPoll]bool // keyed by poll and user name
+	items        map[inPoll]Item // keyed by poll and item name
+	users        map[string]User
+	userScores   map[string]map[inPoll]UserScore // keyed by user name, then poll and item ID
+	globalScores map[inPoll]GlobalScore          // keyed by poll and item ID
+	sessions     map[string]Session
+	voteEvents   map[string][]VoteEvent // keyed by poll
+	rebuilds     map[string]*scoreRebuild
+	rankings     map[inPoll]FittedRanking // keyed by poll and user name, which is empty for the global ranking
+}
+
+// the shadow set of scores of a rebuild
+type scoreRebuild struct {
+	poll         string
+	userScores   map[string]map[inPoll]UserScore // keyed like MemoryStore.userScores
+	globalScores map[inPoll]GlobalScore
+}
+
+// the key of something that belongs to a poll
+type inPoll struct {
+	poll string
+	name string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		polls:        map[string]Poll{DEFAULT_POLL: {Name: DEFAULT_POLL, Visibility: legacyVisibility}},
+		pollMembers:  map[inPoll]bool{},
+		items:        map[inPoll]Item{},
+		users:        map[string]User{},
+		userScores:   map[string]map[inPoll]UserScore{},
+		globalScores: map[inPoll]GlobalScore{},
+		sessions:     map[string]Session{},
+		voteEvents:   map[string][]VoteEvent{},
+		rebuilds:     map[string]*scoreRebuild{},
+		rankings:     map[inPoll]FittedRanking{},
+	}
+}
+
+// NewMemoryDatabase returns a Database where every table is held in memory
+func NewMemoryDatabase() Database {
+	s := NewMemoryStore()
+	return Database{
+		Polls:          s,
+		PollMembers:    s,
+		Items:          s,
+		Users:          s,
+		UserScores:     s,
+		GlobalScores:   s,
+		Sessions:       s,
+		Votes:          s,
+		VoteEvents:     s,
+		ScoreRebuilds:  s,
+		FittedRankings: s,
+	}
+}
+
+func (s *MemoryStore) CreatePoll(poll Poll) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.polls[poll.Name]; ok {
+		return MakeAlreadyExistsError(fmt.Sprintf("a poll named %s already exists", poll.Name))
+	}
+	s.polls[poll.Name] = poll
+	return nil
+}
+
+func (s *MemoryStore) PutPoll(poll Poll) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	poll.InviteGeneration = s.polls[poll.Name].InviteGeneration
+	s.polls[poll.Name] = poll
+	return nil
+}
+
+func (s *MemoryStore) RevokeInvites(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	poll, ok := s.polls[name]
+	if !ok {
+		return MakeNotFoundError(fmt.Sprintf("no poll found with name %s", name))
+	}
+	poll.InviteGeneration++
+	s.polls[name] = poll
+	return nil
+}
+
+func (s *MemoryStore) GetPoll(name string) (Poll, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	poll, ok := s.polls[name]
+	if !ok {
+		return Poll{}, MakeNotFoundError(fmt.Sprintf("no poll found with name %s", name))
+	}
+	return poll, nil
+}
+
+// returns a page of the polls with the given visibility ordered by name, and the cursor for the next page
+func (s *MemoryStore) PollsPage(visibility string, options PageOptions) ([]Poll, string, error) {
+	s.mu.RLock()
+	polls := []Poll{}
+	for _, poll := range s.polls {
+		if poll.Visibility == visibility {
+			polls = append(polls, poll)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(polls, func(i, j int) bool { return polls[i].Name < polls[j].Name })
+	return memoryPage(polls, options, func(poll Poll) string { return poll.Name })
+}
+
+func (s *MemoryStore) AddPollMember(poll, userName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pollMembers[inPoll{poll, userName}] = true
+	return nil
+}
+
+func (s *MemoryStore) RemovePollMember(poll, userName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pollMembers, inPoll{poll, userName})
+	return nil
+}
+
+func (s *MemoryStore) IsPollMember(poll, userName string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pollMembers[inPoll{poll, userName}], nil
+}
+
+// returns a page of the names of a poll's members in order, and the cursor for the next page
+func (s *MemoryStore) PollMembers(poll string, options PageOptions) ([]string, string, error) {
+	s.mu.RLock()
+	members := []string{}
+	for key := range s.pollMembers {
+		if key.poll == poll {
+			members = append(members, key.name)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(members)
+	return memoryPage(members, options, func(name string) string { return name })
+}
+
+// copies an item's metadata, deletion time and merged IDs so that callers can't change them behind our back
+func copyItem(item Item) Item {
+	metadata := map[string]string{}
+	for key, value := range item.Metadata {
+		metadata[key] = value
+	}
+	item.Metadata = metadata
+	if item.DeletedAt != nil {
+		at := *item.DeletedAt
+		item.DeletedAt = &at
+	}
+	item.MergedFrom = append([]string(nil), item.MergedFrom...)
+	return item
+}
+
+func (s *MemoryStore) CreateItem(item Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := inPoll{item.Poll, item.Name}
+	if _, ok := s.items[key]; ok {
+		return MakeAlreadyExistsError(fmt.Sprintf("an item named %s already exists in poll %s", item.Name, item.Poll))
+	}
+	item.DeletedAt = nil
+	item.MergedFrom = nil
+	s.items[key] = copyItem(item)
+	return nil
+}
+
+func (s *MemoryStore) UpdateItem(name string, item Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := inPoll{item.Poll, name}
+	stored, ok := s.items[key]
+	if !ok {
+		return MakeNotFoundError(fmt.Sprintf("no item found with name %s in poll %s", name, item.Poll))
+	}
+	if stored.Version != item.Version {
+		return MakeVersionMismatchError(fmt.Sprintf("item %s has changed since version %d", name, item.Version))
+	}
+	newKey := inPoll{item.Poll, item.Name}
+	if _, ok := s.items[newKey]; ok && newKey != key {
+		return MakeAlreadyExistsError(fmt.Sprintf("an item named %s already exists in poll %s", item.Name, item.Poll))
+	}
+	item = copyItem(item)
+	item.Version++
+	delete(s.items, key)
+	s.items[newKey] = item
+	return nil
+}
+
+func (s *MemoryStore) GetItem(poll, name string) (Item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	item, ok := s.items[inPoll{poll, name}]
+	if !ok || item.DeletedAt != nil {
+		return Item{}, MakeNotFoundError(fmt.Sprintf("no item found with name %s in poll %s", name, poll))
+	}
+	return copyItem(item), nil
+}
+
+func (s *MemoryStore) GetTrashedItem(poll, name string) (Item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	item, ok := s.items[inPoll{poll, name}]
+	if !ok || item.DeletedAt == nil {
+		return Item{}, MakeNotFoundError(fmt.Sprintf("no item found with name %s in the trash of poll %s", name, poll))
+	}
+	return copyItem(item), nil
+}
+
+func (s *MemoryStore) DeleteItem(poll, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, inPoll{poll, name})
+	return nil
+}
+
+// returns a poll's items that are in the trash or not, ordered by name
+func (s *MemoryStore) pollItems(poll string, trashed bool) []Item {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []Item{}
+	for key, item := range s.items {
+		if key.poll == poll && (item.DeletedAt != nil) == trashed {
+			items = append(items, copyItem(item))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items
+}
+
+func (s *MemoryStore) AllItems(poll string) ([]Item, error) {
+	return s.pollItems(poll, false), nil
+}
+
+// returns a page of a poll's items ordered by name, and the cursor for the next page
+func (s *MemoryStore) ItemsPage(poll string, options PageOptions) ([]Item, string, error) {
+	return memoryPage(s.pollItems(poll, false), options, func(item Item) string { return item.Name })
+}
+
+// returns a page of the items in a poll's trash ordered by name, and the cursor for the next page
+func (s *MemoryStore) TrashedItemsPage(poll string, options PageOptions) ([]Item, string, error) {
+	return memoryPage(s.pollItems(poll, true), options, func(item Item) string { return item.Name })
+}
+
+func (s *MemoryStore) TrashedBefore(before time.Time) ([]Item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := []Item{}
+	for _, item := range s.items {
+		if item.DeletedAt != nil && item.DeletedAt.Before(before) {
+			items = append(items, copyItem(item))
+		}
+	}
+	return items, nil
+}
+
+func (s *MemoryStore) CreateUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[user.Name]; ok {
+		return MakeAlreadyExistsError(fmt.Sprintf("a user named %s already exists", user.Name))
+	}
+	user.Roles = append([]string{}, user.Roles...)
+	s.users[user.Name] = user
+	return nil
+}
+
+func (s *MemoryStore) PutUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// copy the roles so that callers can't change them behind our back
+	user.Roles = append([]string{}, user.Roles...)
+	s.users[user.Name] = user
+	return nil
+}
+
+func (s *MemoryStore) SetUserRoles(name string, roles []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[name]
+	if !ok {
+		return MakeNotFoundError(fmt.Sprintf("No user found with name %s", name))
+	}
+	user.Roles = append([]string{}, roles...)
+	s.users[name] = user
+	return nil
+}
+
+func (s *MemoryStore) SetUserPassword(name string, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[name]
+	if !ok {
+		return MakeNotFoundError(fmt.Sprintf("No user found with name %s", name))
+	}
+	user.PasswordHash = passwordHash
+	s.users[name] = user
+	return nil
+}
+
+func (s *MemoryStore) GetUser(name string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[name]
+	if !ok {
+		return User{}, MakeNotFoundError(fmt.Sprintf("No user found with name %s", name))
+	}
+	user.Roles = append([]string{}, user.Roles...)
+	return user, nil
+}
+
+func (s *MemoryStore) DeleteUser(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, name)
+	return nil
+}
+
+func (s *MemoryStore) AllUsers() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		user.Roles = append([]string{}, user.Roles...)
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+// returns a page of users ordered by name, and the cursor for the next page
+func (s *MemoryStore) UsersPage(options PageOptions) ([]User, string, error) {
+	users, _ := s.AllUsers()
+	return memoryPage(users, options, func(user User) string { return user.Name })
+}
+
+// picks the page after the cursor out of results that are sorted by key, keeping only keys with the prefix
+func memoryPage[T any](results []T, options PageOptions, key func(T) string) ([]T, string, error) {
+	after, err := decodeNameCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	start := sort.Search(len(results), func(i int) bool { return key(results[i]) > after })
+	matching := []T{}
+	for _, result := range results[start:] {
+		if strings.HasPrefix(key(result), options.Prefix) {
+			matching = append(matching, result)
+		}
+	}
+	return trimPage(matching, options, key)
+}
+
+func (s *MemoryStore) PutUserScore(u UserScore) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scores, ok := s.userScores[u.UserName]
+	if !ok {
+		scores = map[inPoll]UserScore{}
+		s.userScores[u.UserName] = scores
+	}
+	scores[inPoll{u.Poll, u.ItemID}] = u
+	return nil
+}
+
+// like the DynamoDB UpdateItem call, this creates the score if it doesn't exist yet
+func (s *MemoryStore) UpdateUserScore(u UserScore) error {
+	return s.PutUserScore(u)
+}
+
+func (s *MemoryStore) GetUserScore(poll, itemID, userName string) (UserScore, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	userScore, ok := s.userScores[userName][inPoll{poll, itemID}]
+	if !ok {
+		return UserScore{}, MakeNotFoundError(fmt.Sprintf("no user score found for item %s and user %s in poll %s", itemID, userName, poll))
+	}
+	return userScore, nil
+}
+
+func (s *MemoryStore) GetUserScores(poll, userName string) ([]UserScore, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ratings []UserScore
+	for key, userScore := range s.userScores[userName] {
+		if key.poll == poll {
+			ratings = append(ratings, userScore)
+		}
+	}
+	sort.Slice(ratings, func(i, j int) bool { return ratings[i].ItemID < ratings[j].ItemID })
+	return ratings, nil
+}
+
+func (s *MemoryStore) PutGlobalScore(g GlobalScore) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.globalScores[inPoll{g.Poll, g.ItemID}] = g
+	return nil
+}
+
+// like the DynamoDB UpdateItem call, this creates the score if it doesn't exist yet
+func (s *MemoryStore) UpdateGlobalScore(g GlobalScore) error {
+	return s.PutGlobalScore(g)
+}
+
+func (s *MemoryStore) GetGlobalScore(poll, itemID string) (GlobalScore, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	globalScore, ok := s.globalScores[inPoll{poll, itemID}]
+	if !ok {
+		return GlobalScore{}, MakeNotFoundError(fmt.Sprintf("no global score found for item %s in poll %s", itemID, poll))
+	}
+	return globalScore, nil
+}
+
+// returns a poll's global scores from highest to lowest rating, and the cursor for the next page
+func (s *MemoryStore) Leaderboard(poll string, options LeaderboardOptions) ([]RankedScore, string, error) {
+	after, err := decodeRankCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	s.mu.RLock()
+	// only items that are still around and not in the trash are ranked
+	current := map[string]bool{}
+	for key, item := range s.items {
+		if key.poll == poll && item.DeletedAt == nil {
+			current[item.ID] = true
+		}
+	}
+	scores := []GlobalScore{}
+	for key, g := range s.globalScores {
+		if key.poll != poll || g.NumVotes < options.MinVotes || !current[g.ItemID] {
+			continue
+		}
+		if after != nil && !rankedBefore(GlobalScore{ItemID: after.ItemID, Standing: Standing{Rating: after.Rating}}, g) {
+			continue
+		}
+		scores = append(scores, g)
+	}
+	s.mu.RUnlock()
+	sort.Slice(scores, func(i, j int) bool { return rankedBefore(scores[i], scores[j]) })
+	return rankPage(scores, options, after)
+}
+
+func (s *MemoryStore) PutSession(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *MemoryStore) GetSession(id string) (Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return Session{}, MakeNotFoundError(fmt.Sprintf("no session found with id %s", id))
+	}
+	return session, nil
+}
+
+func (s *MemoryStore) DeleteSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *MemoryStore) DeleteUserSessions(userName string, except string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.UserName == userName && id != except {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// RecordVote holds the store's lock for the whole update, so votes are applied one at a time
+func (s *MemoryStore) RecordVote(event VoteEvent, votedItem1, votedItem2 Item, update VoteUpdate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, voted := range []Item{votedItem1, votedItem2} {
+		item, ok := s.items[inPoll{event.Poll, voted.Name}]
+		if !ok || item.ID != voted.ID || item.DeletedAt != nil {
+			return MakeNotFoundError(fmt.Sprintf("no item found with name %s in poll %s", voted.Name, event.Poll))
+		}
+	}
+	var err error
+	event.ID, err = nextVoteEventID(s.latestVoteEvent(event.Poll), event.ID)
+	if err != nil {
+		return err
+	}
+	poll, user, item1, item2 := event.Poll, event.UserName, event.Item1, event.Item2
+	scores, ok := s.userScores[user]
+	if !ok {
+		scores = map[inPoll]UserScore{}
+		s.userScores[user] = scores
+	}
+	key1, key2 := inPoll{poll, item1}, inPoll{poll, item2}
+	userScore1, ok := scores[key1]
+	if !ok {
+		userScore1 = UserScore{Poll: poll, ItemID: item1, UserName: user}
+	}
+	userScore2, ok := scores[key2]
+	if !ok {
+		userScore2 = UserScore{Poll: poll, ItemID: item2, UserName: user}
+	}
+	globalScore1, ok := s.globalScores[key1]
+	if !ok {
+		globalScore1 = GlobalScore{Poll: poll, ItemID: item1}
+	}
+	globalScore2, ok := s.globalScores[key2]
+	if !ok {
+		globalScore2 = GlobalScore{Poll: poll, ItemID: item2}
+	}
+
+	update(&userScore1, &userScore2, &globalScore1, &globalScore2)
+
+	scores[key1] = userScore1
+	scores[key2] = userScore2
+	s.globalScores[key1] = globalScore1
+	s.globalScores[key2] = globalScore2
+	s.voteEvents[poll] = append(s.voteEvents[poll], copyVoteEvent(event))
+	return nil
+}
+
+// a poll's events are kept in the order they were recorded, which is the order of their IDs
+func (s *MemoryStore) latestVoteEvent(poll string) string {
+	events := s.voteEvents[poll]
+	if len(events) == 0 {
+		return ""
+	}
+	return events[len(events)-1].ID
+}
+
+func copyVoteEvent(event VoteEvent) VoteEvent {
+	metadata := map[string]string{}
+	for key, value := range event.Metadata {
+		metadata[key] = value
+	}
+	event.Metadata = metadata
+	return event
+}
+
+// returns a page of a poll's vote events in the order they were cast, and the cursor for the next page
+func (s *MemoryStore) VoteEventsPage(poll string, options PageOptions) ([]VoteEvent, string, error) {
+	s.mu.RLock()
+	events := make([]VoteEvent, len(s.voteEvents[poll]))
+	for i, event := range s.voteEvents[poll] {
+		events[i] = copyVoteEvent(event)
+	}
+	s.mu.RUnlock()
+	// concurrent votes can be appended in a different order from their IDs, which are what pages go by
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return memoryPage(events, PageOptions{Limit: options.Limit, Cursor: options.Cursor}, func(event VoteEvent) string { return event.ID })
+}
+
+// MergeItems holds the store's lock for the whole merge, so no votes on either item can happen in the middle of it
+func (s *MemoryStore) MergeItems(from, into Item, merge ScoreMerge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fromKey, intoKey := inPoll{from.Poll, from.ID}, inPoll{into.Poll, into.ID}
+	for user, scores := range s.userScores {
+		fromScore, ok := scores[fromKey]
+		if !ok {
+			continue
+		}
+		intoScore, ok := scores[intoKey]
+		if !ok {
+			intoScore = UserScore{Poll: into.Poll, ItemID: into.ID, UserName: user}
+		}
+		intoScore.Standing = merge(fromScore.Standing, intoScore.Standing)
+		scores[intoKey] = intoScore
+		delete(scores, fromKey)
+	}
+	if fromScore, ok := s.globalScores[fromKey]; ok {
+		intoScore, ok := s.globalScores[intoKey]
+		if !ok {
+			intoScore = GlobalScore{Poll: into.Poll, ItemID: into.ID}
+		}
+		intoScore.Standing = merge(fromScore.Standing, intoScore.Standing)
+		s.globalScores[intoKey] = intoScore
+		delete(s.globalScores, fromKey)
+	}
+	fromItem := s.items[inPoll{from.Poll, from.Name}]
+	if intoItem, ok := s.items[inPoll{into.Poll, into.Name}]; ok {
+		intoItem.MergedFrom = append(append([]string{}, intoItem.MergedFrom...), mergedIDs(fromItem)...)
+		intoItem.Version++
+		s.items[inPoll{into.Poll, into.Name}] = intoItem
+	}
+	delete(s.items, inPoll{from.Poll, from.Name})
+	return nil
+}
+
+func (s *MemoryStore) DeleteItemScores(poll, itemID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := inPoll{poll, itemID}
+	for _, scores := range s.userScores {
+		delete(scores, key)
+	}
+	delete(s.globalScores, key)
+	return nil
+}
+
+func (s *MemoryStore) DeleteUserScores(userName string, backOut ScoreBackOut) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if backOut != nil {
+		for key, userScore := range s.userScores[userName] {
+			globalScore, ok := s.globalScores[key]
+			if !ok {
+				continue
+			}
+			backOut(userScore, &globalScore)
+			if globalScore.NumVotes <= 0 {
+				delete(s.globalScores, key)
+			} else {
+				s.globalScores[key] = globalScore
+			}
+		}
+	}
+	delete(s.userScores, userName)
+	return nil
+}
+
+// the leaderboard looks items up as it goes, so trashing an item only has to mark the item itself
+func (s *MemoryStore) TrashItem(item Item, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := inPoll{item.Poll, item.Name}
+	stored, ok := s.items[key]
+	if !ok || stored.DeletedAt != nil {
+		return MakeNotFoundError(fmt.Sprintf("no item found with name %s in poll %s", item.Name, item.Poll))
+	}
+	stored.DeletedAt = &at
+	s.items[key] = stored
+	return nil
+}
+
+func (s *MemoryStore) RestoreItem(item Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := inPoll{item.Poll, item.Name}
+	stored, ok := s.items[key]
+	if !ok || stored.DeletedAt == nil {
+		return MakeNotFoundError(fmt.Sprintf("no item found with name %s in the trash of poll %s", item.Name, item.Poll))
+	}
+	stored.DeletedAt = nil
+	s.items[key] = stored
+	return nil
+}
+
+func (s *MemoryStore) StageScores(poll, rebuild string, userScores []UserScore, globalScores []GlobalScore) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rebuilds[rebuild]
+	if !ok {
+		r = &scoreRebuild{poll: poll, userScores: map[string]map[inPoll]UserScore{}, globalScores: map[inPoll]GlobalScore{}}
+		s.rebuilds[rebuild] = r
+	}
+	for _, u := range userScores {
+		scores, ok := r.userScores[u.UserName]
+		if !ok {
+			scores = map[inPoll]UserScore{}
+			r.userScores[u.UserName] = scores
+		}
+		scores[inPoll{u.Poll, u.ItemID}] = u
+	}
+	for _, g := range globalScores {
+		r.globalScores[inPoll{g.Poll, g.ItemID}] = g
+	}
+	return nil
+}
+
+// SwapScores holds the store's lock while it checks the vote log and replaces the scores, so no vote can come in between
+func (s *MemoryStore) SwapScores(poll, rebuild, lastEvent string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latestVoteEvent(poll) != lastEvent {
+		return MakeVersionMismatchError(fmt.Sprintf("votes have been cast in poll %s since its scores were rebuilt", poll))
+	}
+	r, ok := s.rebuilds[rebuild]
+	if !ok {
+		r = &scoreRebuild{}
+	}
+	for user, scores := range s.userScores {
+		for key := range scores {
+			if key.poll == poll {
+				delete(scores, key)
+			}
+		}
+		for key, u := range r.userScores[user] {
+			scores[key] = u
+		}
+	}
+	for user, scores := range r.userScores {
+		if _, ok := s.userScores[user]; !ok {
+			s.userScores[user] = scores
+		}
+	}
+	for key := range s.globalScores {
+		if key.poll == poll {
+			delete(s.globalScores, key)
+		}
+	}
+	for key, g := range r.globalScores {
+		s.globalScores[key] = g
+	}
+	delete(s.rebuilds, rebuild)
+	return nil
+}
+
+func (s *MemoryStore) DiscardScores(rebuild string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rebuilds, rebuild)
+	return nil
+}
+
+// the scores are copied on the way in and out, so that callers can't change the stored ranking
+func (s *MemoryStore) PutFittedRanking(ranking FittedRanking) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ranking.Scores = append([]FittedScore{}, ranking.Scores...)
+	s.rankings[inPoll{ranking.Poll, ranking.UserName}] = ranking
+	return nil
+}
+
+func (s *MemoryStore) GetFittedRanking(poll, userName string) (FittedRanking, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ranking, ok := s.rankings[inPoll{poll, userName}]
+	if !ok {
+		return FittedRanking{}, fittedRankingNotFound(poll, userName)
+	}
+	ranking.Scores = append([]FittedScore{}, ranking.Scores...)
+	return ranking, nil
+}
+
+func (s *MemoryStore) DeleteUserFittedRankings(userName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.rankings {
+		if key.name == userName {
+			delete(s.rankings, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// a versioned change to the schema of a SQL backend
+// migrations are applied in order, each in its own transaction, and never edited once released
+type migration struct {
+	version    int
+	statements []string
+}
+
+// applies any migrations that haven't been applied yet, recording each in the schema_migrations table
+func migrate(db *sql.DB, migrations []migration) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %v", err)
+	}
+	current := 0
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err = applyMigration(db, m)
+		if err != nil {
+			return fmt.Errorf("error applying migration %d: %v", m.version, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range m.statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO schema_migrations (version) VALUES (%d)`, m.version))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"fmt"
+	"os"
+)
+
+// OpenFromEnv opens the storage backend named by the RANKER_DB environment variable
+// "dynamodb" (the default) uses the AWS region in RANKER_AWS_REGION, or us-east-1 if unset
+// "memory" keeps everything in memory, which is handy for demos and frontend development
+// "sqlite" uses the SQLite database file in RANKER_SQLITE_PATH, or ranker.db if unset
+// "postgres" connects to the PostgreSQL database at the URL in RANKER_POSTGRES_URL
+func OpenFromEnv() (Database, error) {
+	backend := os.Getenv("RANKER_DB")
+	switch backend {
+	case "", "dynamodb":
+		region := os.Getenv("RANKER_AWS_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		client, err := GetClient(region)
+		if err != nil {
+			return Database{}, err
+		}
+		return GetDatabase(client)
+	case "memory":
+		return NewMemoryDatabase(), nil
+	case "sqlite":
+		path := os.Getenv("RANKER_SQLITE_PATH")
+		if path == "" {
+			path = "ranker.db"
+		}
+		return OpenSQLite(path)
+	case "postgres":
+		return OpenPostgres(os.Getenv("RANKER_POSTGRES_URL"))
+	default:
+		return Database{}, fmt.Errorf("unknown storage backend %s", backend)
+	}
+}
@@ -0,0 +1,268 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// which part of a listing to return
+type PageOptions struct {
+	// the maximum number of results; zero or less means no maximum
+	Limit int
+	// where to continue from, as returned along with the previous page; empty for the first page
+	Cursor string
+	// only return results whose name starts with this
+	Prefix string
+}
+
+// error type for cursors that weren't produced by the store they were given to
+type InvalidCursorError struct{}
+
+func (e InvalidCursorError) Error() string {
+	return "invalid cursor"
+}
+
+// cursors are opaque to clients: base64-encoded JSON of whatever the store needs to resume
+func encodeCursor(v any) (string, error) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+func decodeCursor(cursor string, v any) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return InvalidCursorError{}
+	}
+	if err := json.Unmarshal(bytes, v); err != nil {
+		return InvalidCursorError{}
+	}
+	return nil
+}
+
+// a single attribute of a DynamoDB key; keys only ever hold strings and numbers
+type dynamoKeyValue struct {
+	S *string `json:"s,omitempty"`
+	N *string `json:"n,omitempty"`
+}
+
+func dynamoKeyValues(key map[string]types.AttributeValue) map[string]dynamoKeyValue {
+	values := map[string]dynamoKeyValue{}
+	for name, value := range key {
+		switch v := value.(type) {
+		case *types.AttributeValueMemberS:
+			values[name] = dynamoKeyValue{S: &v.Value}
+		case *types.AttributeValueMemberN:
+			values[name] = dynamoKeyValue{N: &v.Value}
+		}
+	}
+	return values
+}
+
+func dynamoKeyFromValues(values map[string]dynamoKeyValue) (map[string]types.AttributeValue, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	key := map[string]types.AttributeValue{}
+	for name, value := range values {
+		switch {
+		case value.S != nil:
+			key[name] = &types.AttributeValueMemberS{Value: *value.S}
+		case value.N != nil:
+			key[name] = &types.AttributeValueMemberN{Value: *value.N}
+		default:
+			return nil, InvalidCursorError{}
+		}
+	}
+	return key, nil
+}
+
+// turns a LastEvaluatedKey into a cursor
+func encodeDynamoKey(key map[string]types.AttributeValue) (string, error) {
+	if key == nil {
+		return "", nil
+	}
+	return encodeCursor(dynamoKeyValues(key))
+}
+
+// turns a cursor back into an ExclusiveStartKey
+func decodeDynamoKey(cursor string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	var values map[string]dynamoKeyValue
+	if err := decodeCursor(cursor, &values); err != nil {
+		return nil, err
+	}
+	return dynamoKeyFromValues(values)
+}
+
+// scans a DynamoDB table from the cursor until limit matching records have been read or the table is exhausted
+// returns the records and the cursor for the page after them, which is empty if there are no more
+func scanPage(t Table, input *dynamodb.ScanInput, options PageOptions) ([]map[string]types.AttributeValue, string, error) {
+	startKey, err := decodeDynamoKey(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	input.ExclusiveStartKey = startKey
+	if options.Prefix != "" {
+		// the filter runs after Limit is applied, which is why we keep scanning until the page is full
+		filter := "begins_with(#name, :prefix)"
+		if input.FilterExpression != nil {
+			filter = *input.FilterExpression + " AND " + filter
+		}
+		input.FilterExpression = aws.String(filter)
+		if input.ExpressionAttributeNames == nil {
+			input.ExpressionAttributeNames = map[string]string{}
+		}
+		input.ExpressionAttributeNames["#name"] = "Name"
+		if input.ExpressionAttributeValues == nil {
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{}
+		}
+		input.ExpressionAttributeValues[":prefix"] = &types.AttributeValueMemberS{Value: options.Prefix}
+	}
+	var records []map[string]types.AttributeValue
+	for {
+		if options.Limit > 0 {
+			input.Limit = aws.Int32(int32(options.Limit - len(records)))
+		}
+		output, err := t.Client.Scan(context.TODO(), input)
+		if err != nil {
+			return nil, "", err
+		}
+		records = append(records, output.Items...)
+		if output.LastEvaluatedKey == nil {
+			return records, "", nil
+		}
+		if options.Limit > 0 && len(records) >= options.Limit {
+			next, err := encodeDynamoKey(output.LastEvaluatedKey)
+			return records, next, err
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// like scanPage, but for a Query; any prefix has to be part of the input's key condition already
+func queryPage(t Table, input *dynamodb.QueryInput, options PageOptions) ([]map[string]types.AttributeValue, string, error) {
+	startKey, err := decodeDynamoKey(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	input.ExclusiveStartKey = startKey
+	var records []map[string]types.AttributeValue
+	for {
+		if options.Limit > 0 {
+			input.Limit = aws.Int32(int32(options.Limit - len(records)))
+		}
+		output, err := t.Client.Query(context.TODO(), input)
+		if err != nil {
+			return nil, "", err
+		}
+		records = append(records, output.Items...)
+		if output.LastEvaluatedKey == nil {
+			return records, "", nil
+		}
+		if options.Limit > 0 && len(records) >= options.Limit {
+			next, err := encodeDynamoKey(output.LastEvaluatedKey)
+			return records, next, err
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// encodes the key of the last of a page of SQL or in-memory results, ordered by name
+func nameCursor(name string) (string, error) {
+	return encodeCursor(name)
+}
+
+func decodeNameCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	var name string
+	err := decodeCursor(cursor, &name)
+	return name, err
+}
+
+// the LIMIT clause for a SQL page query: one more than the page size, so we can tell whether there's another page
+func limitClause(options PageOptions) string {
+	if options.Limit <= 0 {
+		return ""
+	}
+	return " LIMIT " + strconv.Itoa(options.Limit+1)
+}
+
+// a condition restricting a column to the prefix, and its arguments
+func prefixCondition(column string, options PageOptions) (string, []any) {
+	if options.Prefix == "" {
+		return "", nil
+	}
+	// compare the leading characters directly, since LIKE is case-insensitive in SQLite but not in PostgreSQL
+	return " AND substr(" + column + ", 1, ?) = ?", []any{utf8.RuneCountInString(options.Prefix), options.Prefix}
+}
+
+// cuts results fetched with one extra row (or all of them) down to a page and works out the next cursor
+func trimPage[T any](results []T, options PageOptions, key func(T) string) ([]T, string, error) {
+	if options.Limit <= 0 || len(results) <= options.Limit {
+		return results, "", nil
+	}
+	results = results[:options.Limit]
+	next, err := nameCursor(key(results[len(results)-1]))
+	return results, next, err
+}
+
+// where a SQL or in-memory leaderboard page left off
+type rankCursor struct {
+	Rating int    `json:"rating"`
+	ItemID string `json:"itemId"`
+	Rank   int    `json:"rank"`
+}
+
+func decodeRankCursor(cursor string) (*rankCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	var c rankCursor
+	err := decodeCursor(cursor, &c)
+	return &c, err
+}
+
+// numbers leaderboard results fetched with one extra row (or all of them), cuts them down to a page,
+// and works out the next cursor
+func rankPage(scores []GlobalScore, options LeaderboardOptions, after *rankCursor) ([]RankedScore, string, error) {
+	rank := 0
+	if after != nil {
+		rank = after.Rank
+	}
+	more := options.Limit > 0 && len(scores) > options.Limit
+	if more {
+		scores = scores[:options.Limit]
+	}
+	ranked := make([]RankedScore, len(scores))
+	for i, g := range scores {
+		ranked[i] = RankedScore{GlobalScore: g, Rank: rank + i + 1}
+	}
+	if !more {
+		return ranked, "", nil
+	}
+	last := ranked[len(ranked)-1]
+	next, err := encodeCursor(rankCursor{Rating: last.Rating, ItemID: last.ItemID, Rank: last.Rank})
+	return ranked, next, err
+}
+
+// the order of the leaderboard: highest rating first, with ties broken by item ID
+func rankedBefore(a, b GlobalScore) bool {
+	if a.Rating != b.Rating {
+		return a.Rating > b.Rating
+	}
+	return a.ItemID < b.ItemID
+}
@@ -0,0 +1,401 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type PollTable Table
+
+// a set of items that are ranked against each other, separately from the items in every other poll
+// polls are owned by the user who created them, apart from the default poll, which has no owner
+// visibility is one of public, unlisted or private; see the server for what each allows
+// invite codes are only accepted if they were created at the poll's current InviteGeneration,
+// which goes up whenever the outstanding codes are revoked
+type Poll struct {
+	Name             string `json:"name"`
+	Description      string `json:"description"`
+	Owner            string `json:"owner"`
+	Visibility       string `json:"visibility"`
+	InviteGeneration int    `json:"-"`
+}
+
+// the visibility of polls created before polls had one
+const legacyVisibility = "public"
+
+// the poll that everything created before there were polls belongs to
+// it always exists, and the routes without a poll in them use it
+const DEFAULT_POLL = "default"
+
+func CreatePollTable(client *dynamodb.Client) (PollTable, error) {
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("Name"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("Name"),
+				KeyType:       types.KeyTypeHash,
+			},
+		},
+		TableName:   aws.String("Polls"),
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	err := createTable(client, input)
+	if err != nil {
+		return PollTable{}, err
+	}
+	return PollTable{Name: "Polls", Client: client}, nil
+}
+
+func pollKey(name string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Name": &types.AttributeValueMemberS{Value: name},
+	}
+}
+
+func pollToAttributes(poll Poll) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Name":        &types.AttributeValueMemberS{Value: poll.Name},
+		"Description": &types.AttributeValueMemberS{Value: poll.Description},
+		"Owner":       &types.AttributeValueMemberS{Value: poll.Owner},
+		"Visibility":  &types.AttributeValueMemberS{Value: poll.Visibility},
+	}
+}
+
+func (t PollTable) CreatePoll(poll Poll) error {
+	input := &dynamodb.PutItemInput{
+		Item:                     pollToAttributes(poll),
+		TableName:                aws.String(t.Name),
+		ConditionExpression:      aws.String("attribute_not_exists(#name)"),
+		ExpressionAttributeNames: map[string]string{"#name": "Name"},
+	}
+	_, err := t.Client.PutItem(context.TODO(), input)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return MakeAlreadyExistsError(fmt.Sprintf("a poll named %s already exists", poll.Name))
+	}
+	return err
+}
+
+// leaves the invite generation alone, so that saving an old copy of the poll can't bring back revoked invite codes
+func (t PollTable) PutPoll(poll Poll) error {
+	input := &dynamodb.UpdateItemInput{
+		Key:                      pollKey(poll.Name),
+		TableName:                aws.String(t.Name),
+		UpdateExpression:         aws.String("SET Description = :description, #owner = :owner, #visibility = :visibility"),
+		ExpressionAttributeNames: map[string]string{"#owner": "Owner", "#visibility": "Visibility"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":description": &types.AttributeValueMemberS{Value: poll.Description},
+			":owner":       &types.AttributeValueMemberS{Value: poll.Owner},
+			":visibility":  &types.AttributeValueMemberS{Value: poll.Visibility},
+		},
+	}
+	_, err := t.Client.UpdateItem(context.TODO(), input)
+	return err
+}
+
+func (t PollTable) RevokeInvites(name string) error {
+	input := &dynamodb.UpdateItemInput{
+		Key:                      pollKey(name),
+		TableName:                aws.String(t.Name),
+		UpdateExpression:         aws.String("ADD InviteGeneration :one"),
+		ConditionExpression:      aws.String("attribute_exists(#name)"),
+		ExpressionAttributeNames: map[string]string{"#name": "Name"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+	}
+	_, err := t.Client.UpdateItem(context.TODO(), input)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return MakeNotFoundError(fmt.Sprintf("no poll found with name %s", name))
+	}
+	return err
+}
+
+func (t PollTable) GetPoll(name string) (Poll, error) {
+	input := &dynamodb.GetItemInput{
+		Key:       pollKey(name),
+		TableName: aws.String(t.Name),
+	}
+	output, err := t.Client.GetItem(context.TODO(), input)
+	if err != nil {
+		return Poll{}, err
+	}
+	if output.Item == nil {
+		return Poll{}, MakeNotFoundError(fmt.Sprintf("no poll found with name %s", name))
+	}
+	return pollFromAttributes(output.Item), nil
+}
+
+// returns a page of the polls with the given visibility, in no particular order, and the cursor for the next page
+func (t PollTable) PollsPage(visibility string, options PageOptions) ([]Poll, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(t.Name),
+		FilterExpression:         aws.String("#visibility = :visibility"),
+		ExpressionAttributeNames: map[string]string{"#visibility": "Visibility"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":visibility": &types.AttributeValueMemberS{Value: visibility},
+		},
+	}
+	if visibility == legacyVisibility {
+		input.FilterExpression = aws.String("(#visibility = :visibility OR attribute_not_exists(#visibility))")
+	}
+	records, next, err := scanPage(Table(t), input, options)
+	if err != nil {
+		return nil, "", err
+	}
+	polls := make([]Poll, len(records))
+	for i, item := range records {
+		polls[i] = pollFromAttributes(item)
+	}
+	return polls, next, nil
+}
+
+func pollFromAttributes(item map[string]types.AttributeValue) Poll {
+	poll := Poll{
+		Name:        item["Name"].(*types.AttributeValueMemberS).Value,
+		Description: item["Description"].(*types.AttributeValueMemberS).Value,
+		Visibility:  legacyVisibility,
+	}
+	if owner, ok := item["Owner"].(*types.AttributeValueMemberS); ok {
+		poll.Owner = owner.Value
+	}
+	if visibility, ok := item["Visibility"].(*types.AttributeValueMemberS); ok {
+		poll.Visibility = visibility.Value
+	}
+	if generation, ok := item["InviteGeneration"].(*types.AttributeValueMemberN); ok {
+		poll.InviteGeneration, _ = strconv.Atoi(generation.Value)
+	}
+	return poll
+}
+
+// the ID of a poll's latest vote event, which polls that haven't had a vote since votes were ordered don't have
+func lastVoteEvent(item map[string]types.AttributeValue) string {
+	if latest, ok := item["LastVoteEvent"].(*types.AttributeValueMemberS); ok {
+		return latest.Value
+	}
+	return ""
+}
+
+// the condition for a poll's latest vote event to still be the one that was read, and the values it uses
+func lastVoteEventCondition(latest string, values map[string]types.AttributeValue) string {
+	if latest == "" {
+		return "attribute_not_exists(LastVoteEvent)"
+	}
+	values[":latest"] = &types.AttributeValueMemberS{Value: latest}
+	return "LastVoteEvent = :latest"
+}
+
+// the write that records a poll's latest vote event, as part of the transaction that records the vote,
+// if the poll's latest event and generation of scores are still the ones that were read
+func (t PollTable) setLastVoteEvent(poll, generation, latest, id string) types.TransactWriteItem {
+	values := map[string]types.AttributeValue{
+		":id": &types.AttributeValueMemberS{Value: id},
+	}
+	condition := "attribute_exists(#name) AND " + lastVoteEventCondition(latest, values) + " AND " + scoreGenerationCondition(generation, values)
+	return types.TransactWriteItem{
+		Update: &types.Update{
+			Key:                       pollKey(poll),
+			TableName:                 aws.String(t.Name),
+			UpdateExpression:          aws.String("SET LastVoteEvent = :id"),
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeNames:  map[string]string{"#name": "Name"},
+			ExpressionAttributeValues: values,
+		},
+	}
+}
+
+// the generation of a poll's scores that is in use, which is empty until its scores are first rebuilt
+// each rebuild writes its scores under a new generation, and swaps them in by making it the poll's ScoreGeneration
+func scoreGeneration(item map[string]types.AttributeValue) string {
+	if generation, ok := item["ScoreGeneration"].(*types.AttributeValueMemberS); ok {
+		return generation.Value
+	}
+	return ""
+}
+
+// the condition for a poll's generation of scores to still be the one that was read, and the values it uses
+func scoreGenerationCondition(generation string, values map[string]types.AttributeValue) string {
+	if generation == "" {
+		return "attribute_not_exists(ScoreGeneration)"
+	}
+	values[":generation"] = &types.AttributeValueMemberS{Value: generation}
+	return "ScoreGeneration = :generation"
+}
+
+// how many times items have been put in or taken out of a poll's trash, which rebuilds check to know that
+// the trash marks they copied onto their scores are still right
+func trashVersion(item map[string]types.AttributeValue) (int, error) {
+	if version, ok := item["TrashVersion"].(*types.AttributeValueMemberN); ok {
+		return strconv.Atoi(version.Value)
+	}
+	return 0, nil
+}
+
+// the condition for a poll's trash version to still be the one that was read, and the values it uses
+func trashVersionCondition(version int, values map[string]types.AttributeValue) string {
+	if version == 0 {
+		return "attribute_not_exists(TrashVersion)"
+	}
+	values[":trashVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(version)}
+	return "TrashVersion = :trashVersion"
+}
+
+// reads a poll's record, which has the state of its scores, consistently
+func (t PollTable) getPollRecord(name string) (map[string]types.AttributeValue, error) {
+	output, err := t.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		Key:            pollKey(name),
+		TableName:      aws.String(t.Name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.Item == nil {
+		return nil, MakeNotFoundError(fmt.Sprintf("no poll found with name %s", name))
+	}
+	return output.Item, nil
+}
+
+// the generation of a poll's scores that is in use
+func (t PollTable) getScoreGeneration(poll string) (string, error) {
+	item, err := t.getPollRecord(poll)
+	if err != nil {
+		return "", err
+	}
+	return scoreGeneration(item), nil
+}
+
+// the write that counts a move into or out of a poll's trash, as part of the transaction that makes it,
+// if the poll's generation of scores is still the one whose trash marks the move changes
+func (t PollTable) countTrashChange(poll, generation string) types.TransactWriteItem {
+	values := map[string]types.AttributeValue{
+		":one": &types.AttributeValueMemberN{Value: "1"},
+	}
+	condition := "attribute_exists(#name) AND " + scoreGenerationCondition(generation, values)
+	return types.TransactWriteItem{
+		Update: &types.Update{
+			Key:                       pollKey(poll),
+			TableName:                 aws.String(t.Name),
+			UpdateExpression:          aws.String("ADD TrashVersion :one"),
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeNames:  map[string]string{"#name": "Name"},
+			ExpressionAttributeValues: values,
+		},
+	}
+}
+
+// makes sure the default poll exists, for stores that don't create it in a migration
+func createDefaultPoll(polls PollStore) error {
+	err := polls.CreatePoll(Poll{Name: DEFAULT_POLL, Visibility: legacyVisibility})
+	if _, ok := err.(AlreadyExistsError); ok {
+		return nil
+	}
+	return err
+}
+
+type PollMemberTable Table
+
+func CreatePollMemberTable(client *dynamodb.Client) (PollMemberTable, error) {
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("Poll"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("UserName"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("Poll"),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String("UserName"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		TableName:   aws.String("PollMembers"),
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	err := createTable(client, input)
+	if err != nil {
+		return PollMemberTable{}, err
+	}
+	return PollMemberTable{Name: "PollMembers", Client: client}, nil
+}
+
+func pollMemberKey(poll, userName string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Poll":     &types.AttributeValueMemberS{Value: poll},
+		"UserName": &types.AttributeValueMemberS{Value: userName},
+	}
+}
+
+func (t PollMemberTable) AddPollMember(poll, userName string) error {
+	input := &dynamodb.PutItemInput{
+		Item:      pollMemberKey(poll, userName),
+		TableName: aws.String(t.Name),
+	}
+	_, err := t.Client.PutItem(context.TODO(), input)
+	return err
+}
+
+func (t PollMemberTable) RemovePollMember(poll, userName string) error {
+	input := &dynamodb.DeleteItemInput{
+		Key:       pollMemberKey(poll, userName),
+		TableName: aws.String(t.Name),
+	}
+	_, err := t.Client.DeleteItem(context.TODO(), input)
+	return err
+}
+
+func (t PollMemberTable) IsPollMember(poll, userName string) (bool, error) {
+	input := &dynamodb.GetItemInput{
+		Key:       pollMemberKey(poll, userName),
+		TableName: aws.String(t.Name),
+	}
+	output, err := t.Client.GetItem(context.TODO(), input)
+	if err != nil {
+		return false, err
+	}
+	return output.Item != nil, nil
+}
+
+// returns a page of the names of a poll's members in order, and the cursor for the next page
+func (t PollMemberTable) PollMembers(poll string, options PageOptions) ([]string, string, error) {
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":poll": &types.AttributeValueMemberS{Value: poll},
+		},
+		KeyConditionExpression: aws.String("Poll = :poll"),
+		TableName:              aws.String(t.Name),
+	}
+	if options.Prefix != "" {
+		input.KeyConditionExpression = aws.String("Poll = :poll AND begins_with(UserName, :prefix)")
+		input.ExpressionAttributeValues[":prefix"] = &types.AttributeValueMemberS{Value: options.Prefix}
+	}
+	records, next, err := queryPage(Table(t), input, options)
+	if err != nil {
+		return nil, "", err
+	}
+	members := make([]string, len(records))
+	for i, item := range records {
+		members[i] = item["UserName"].(*types.AttributeValueMemberS).Value
+	}
+	return members, next, nil
+}
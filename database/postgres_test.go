@@ -0,0 +1,94 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// opens the PostgreSQL database at RANKER_TEST_POSTGRES_URL, skipping the test if it isn't set,
+// with everything in a new schema that's dropped after the test, so that runs don't see each other's data
+func openTestPostgres(t *testing.T) Database {
+	t.Helper()
+	base := os.Getenv("RANKER_TEST_POSTGRES_URL")
+	if base == "" {
+		t.Skip("RANKER_TEST_POSTGRES_URL isn't set")
+	}
+	schema := fmt.Sprintf("ranker_test_%d_%d", time.Now().UnixNano(), rand.Intn(1000000))
+	admin, err := sql.Open("postgres", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	_, err = admin.Exec(`CREATE SCHEMA ` + schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		if err != nil {
+			t.Errorf("error dropping test schema %s: %v", schema, err)
+		}
+	})
+
+	// lib/pq sends settings it doesn't know itself to the server, so search_path puts the tables in the schema
+	withSchema := base + " search_path=" + schema
+	if strings.HasPrefix(base, "postgres://") || strings.HasPrefix(base, "postgresql://") {
+		u, err := url.Parse(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		withSchema = u.String()
+	}
+	db, err := OpenPostgres(withSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Polls.(SQLStore).DB.Close() })
+	return db
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	db := openTestPostgres(t)
+	testMigrations(t, db.Polls.(SQLStore), postgresMigrations)
+}
+
+func TestPostgresStore(t *testing.T) {
+	testStore(t, openTestPostgres(t))
+}
+
+func TestPostgresVotesRecordedInOrder(t *testing.T) {
+	testVotesRecordedInOrder(t, openTestPostgres(t))
+}
+
+func TestPostgresBind(t *testing.T) {
+	s := SQLStore{dialect: postgresDialect}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`SELECT name FROM polls`, `SELECT name FROM polls`},
+		{`SELECT name FROM polls WHERE name = ?`, `SELECT name FROM polls WHERE name = $1`},
+		{
+			`INSERT INTO items (poll, id, name) VALUES (?, ?, ?) ON CONFLICT (poll, name) DO UPDATE SET id = ?`,
+			`INSERT INTO items (poll, id, name) VALUES ($1, $2, $3) ON CONFLICT (poll, name) DO UPDATE SET id = $4`,
+		},
+		{
+			`SELECT 1 WHERE a = ? AND (b < ? OR (b = ? AND c > ?)) LIMIT ? OFFSET ? AND d = ? AND e = ? AND f = ? AND g = ?`,
+			`SELECT 1 WHERE a = $1 AND (b < $2 OR (b = $3 AND c > $4)) LIMIT $5 OFFSET $6 AND d = $7 AND e = $8 AND f = $9 AND g = $10`,
+		},
+	}
+	for _, test := range tests {
+		if got := s.bind(test.query); got != test.want {
+			t.Errorf("bind(%q) gave %q, want %q", test.query, got, test.want)
+		}
+	}
+}
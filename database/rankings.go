@@ -0,0 +1,180 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type FittedRankingTable Table
+
+// a ranking of a poll's items fitted to all of the votes in its vote log at once,
+// as opposed to the scores, which are updated a vote at a time
+// UserName is empty for the ranking fitted to everyone's votes, and otherwise the user whose votes it was fitted to
+type FittedRanking struct {
+	Poll     string    `json:"poll"`
+	UserName string    `json:"userName,omitempty"`
+	FittedAt time.Time `json:"fittedAt"`
+	// the ID of the last vote event the fit included, and how many votes it included
+	LastEvent string        `json:"lastEvent"`
+	NumVotes  int           `json:"numVotes"`
+	Scores    []FittedScore `json:"scores"`
+}
+
+// an item's place in a fitted ranking
+// Strength is on a log scale, so that the difference between two items' strengths is the log odds of one being preferred
+type FittedScore struct {
+	ItemID   string  `json:"itemId"`
+	Strength float64 `json:"strength"`
+	NumVotes int     `json:"numVotes"`
+}
+
+func CreateFittedRankingTable(client *dynamodb.Client) (FittedRankingTable, error) {
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("Poll"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("Ranking"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("Poll"),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String("Ranking"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		TableName:   aws.String("FittedRankings"),
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	err := createTable(client, input)
+	if err != nil {
+		return FittedRankingTable{}, err
+	}
+	return FittedRankingTable{Name: "FittedRankings", Client: client}, nil
+}
+
+// keys can't be empty, so the global ranking is keyed by a name no user can have
+// user names can't contain a #, so a user's ranking never clashes with it
+func fittedRankingKey(poll, userName string) map[string]types.AttributeValue {
+	ranking := "#global"
+	if userName != "" {
+		ranking = "user#" + userName
+	}
+	return map[string]types.AttributeValue{
+		"Poll":    &types.AttributeValueMemberS{Value: poll},
+		"Ranking": &types.AttributeValueMemberS{Value: ranking},
+	}
+}
+
+// the whole ranking is kept in one record, which limits it to some thousands of items
+func (t FittedRankingTable) PutFittedRanking(ranking FittedRanking) error {
+	scores := make([]types.AttributeValue, len(ranking.Scores))
+	for i, score := range ranking.Scores {
+		scores[i] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"ItemID":   &types.AttributeValueMemberS{Value: score.ItemID},
+			"Strength": &types.AttributeValueMemberN{Value: strconv.FormatFloat(score.Strength, 'g', -1, 64)},
+			"NumVotes": &types.AttributeValueMemberN{Value: strconv.Itoa(score.NumVotes)},
+		}}
+	}
+	item := fittedRankingKey(ranking.Poll, ranking.UserName)
+	item["UserName"] = &types.AttributeValueMemberS{Value: ranking.UserName}
+	item["FittedAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(ranking.FittedAt.Unix(), 10)}
+	item["LastEvent"] = &types.AttributeValueMemberS{Value: ranking.LastEvent}
+	item["NumVotes"] = &types.AttributeValueMemberN{Value: strconv.Itoa(ranking.NumVotes)}
+	item["Scores"] = &types.AttributeValueMemberL{Value: scores}
+	_, err := t.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{Item: item, TableName: aws.String(t.Name)})
+	return err
+}
+
+func (t FittedRankingTable) GetFittedRanking(poll, userName string) (FittedRanking, error) {
+	output, err := t.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		Key:       fittedRankingKey(poll, userName),
+		TableName: aws.String(t.Name),
+	})
+	if err != nil {
+		return FittedRanking{}, err
+	}
+	if output.Item == nil {
+		return FittedRanking{}, fittedRankingNotFound(poll, userName)
+	}
+	item := output.Item
+	fittedAt, err := strconv.ParseInt(item["FittedAt"].(*types.AttributeValueMemberN).Value, 10, 64)
+	if err != nil {
+		return FittedRanking{}, err
+	}
+	numVotes, err := strconv.Atoi(item["NumVotes"].(*types.AttributeValueMemberN).Value)
+	if err != nil {
+		return FittedRanking{}, err
+	}
+	ranking := FittedRanking{
+		Poll:      item["Poll"].(*types.AttributeValueMemberS).Value,
+		UserName:  item["UserName"].(*types.AttributeValueMemberS).Value,
+		FittedAt:  time.Unix(fittedAt, 0),
+		LastEvent: item["LastEvent"].(*types.AttributeValueMemberS).Value,
+		NumVotes:  numVotes,
+		Scores:    []FittedScore{},
+	}
+	for _, value := range item["Scores"].(*types.AttributeValueMemberL).Value {
+		attributes := value.(*types.AttributeValueMemberM).Value
+		var score FittedScore
+		score.ItemID = attributes["ItemID"].(*types.AttributeValueMemberS).Value
+		score.Strength, err = strconv.ParseFloat(attributes["Strength"].(*types.AttributeValueMemberN).Value, 64)
+		if err != nil {
+			return FittedRanking{}, err
+		}
+		score.NumVotes, err = strconv.Atoi(attributes["NumVotes"].(*types.AttributeValueMemberN).Value)
+		if err != nil {
+			return FittedRanking{}, err
+		}
+		ranking.Scores = append(ranking.Scores, score)
+	}
+	return ranking, nil
+}
+
+// rankings are only keyed by poll, so this scans the table; it's only needed when users are deleted
+func (t FittedRankingTable) DeleteUserFittedRankings(userName string) error {
+	paginator := dynamodb.NewScanPaginator(t.Client, &dynamodb.ScanInput{
+		TableName:            aws.String(t.Name),
+		ProjectionExpression: aws.String("Poll, Ranking"),
+		FilterExpression:     aws.String("UserName = :userName"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userName": &types.AttributeValueMemberS{Value: userName},
+		},
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			_, err := t.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+				Key:       map[string]types.AttributeValue{"Poll": item["Poll"], "Ranking": item["Ranking"]},
+				TableName: aws.String(t.Name),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fittedRankingNotFound(poll, userName string) error {
+	if userName == "" {
+		return MakeNotFoundError(fmt.Sprintf("no ranking has been fitted for poll %s yet", poll))
+	}
+	return MakeNotFoundError(fmt.Sprintf("no ranking has been fitted for user %s in poll %s yet", userName, poll))
+}
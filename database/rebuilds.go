@@ -0,0 +1,314 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// reads and writes the scores of the generation that is in use in their poll,
+// which takes reading the poll first (see scoreGeneration)
+type DynamoScoreStore struct {
+	Polls        PollTable
+	UserScores   UserScoreTable
+	GlobalScores GlobalScoreTable
+}
+
+// the partition that a poll's scores are kept under at the moment
+func (s DynamoScoreStore) partition(poll string) (string, error) {
+	generation, err := s.Polls.getScoreGeneration(poll)
+	if err != nil {
+		return "", err
+	}
+	return scorePartition(poll, generation), nil
+}
+
+func (s DynamoScoreStore) PutUserScore(u UserScore) error {
+	partition, err := s.partition(u.Poll)
+	if err != nil {
+		return err
+	}
+	u.Poll = partition
+	return s.UserScores.PutUserScore(u)
+}
+
+func (s DynamoScoreStore) UpdateUserScore(u UserScore) error {
+	partition, err := s.partition(u.Poll)
+	if err != nil {
+		return err
+	}
+	u.Poll = partition
+	return s.UserScores.UpdateUserScore(u)
+}
+
+func (s DynamoScoreStore) GetUserScore(poll, itemID, userName string) (UserScore, error) {
+	partition, err := s.partition(poll)
+	if err != nil {
+		return UserScore{}, err
+	}
+	return s.UserScores.GetUserScore(partition, itemID, userName)
+}
+
+func (s DynamoScoreStore) GetUserScores(poll, userName string) ([]UserScore, error) {
+	partition, err := s.partition(poll)
+	if err != nil {
+		return nil, err
+	}
+	return s.UserScores.GetUserScores(partition, userName)
+}
+
+func (s DynamoScoreStore) PutGlobalScore(g GlobalScore) error {
+	partition, err := s.partition(g.Poll)
+	if err != nil {
+		return err
+	}
+	g.Poll = partition
+	return s.GlobalScores.PutGlobalScore(g)
+}
+
+func (s DynamoScoreStore) UpdateGlobalScore(g GlobalScore) error {
+	partition, err := s.partition(g.Poll)
+	if err != nil {
+		return err
+	}
+	g.Poll = partition
+	return s.GlobalScores.UpdateGlobalScore(g)
+}
+
+func (s DynamoScoreStore) GetGlobalScore(poll, itemID string) (GlobalScore, error) {
+	partition, err := s.partition(poll)
+	if err != nil {
+		return GlobalScore{}, err
+	}
+	return s.GlobalScores.GetGlobalScore(partition, itemID)
+}
+
+func (s DynamoScoreStore) Leaderboard(poll string, options LeaderboardOptions) ([]RankedScore, string, error) {
+	partition, err := s.partition(poll)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.GlobalScores.Leaderboard(partition, options)
+}
+
+// StageScores writes the scores under a generation named after the rebuild, which nothing reads until SwapScores
+// makes it the poll's; they're marked with the generation too, so that DiscardScores can find them
+func (s DynamoVoteStore) StageScores(poll, rebuild string, userScores []UserScore, globalScores []GlobalScore) error {
+	partition := scorePartition(poll, rebuild)
+	generation := &types.AttributeValueMemberS{Value: rebuild}
+	for _, u := range userScores {
+		_, err := s.UserScores.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			Item: standingAttributes(u.Standing, map[string]types.AttributeValue{
+				"UserName":   &types.AttributeValueMemberS{Value: u.UserName},
+				"PollItem":   &types.AttributeValueMemberS{Value: pollItem(partition, u.ItemID)},
+				"Poll":       &types.AttributeValueMemberS{Value: partition},
+				"ItemName":   &types.AttributeValueMemberS{Value: u.ItemID},
+				"Generation": generation,
+			}),
+			TableName: aws.String(s.UserScores.Name),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, g := range globalScores {
+		_, err := s.GlobalScores.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			Item: standingAttributes(g.Standing, map[string]types.AttributeValue{
+				"Poll":       &types.AttributeValueMemberS{Value: partition},
+				"ItemName":   &types.AttributeValueMemberS{Value: g.ItemID},
+				"Generation": generation,
+			}),
+			TableName: aws.String(s.GlobalScores.Name),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SwapScores makes the rebuild's generation the poll's in a single conditional write to the poll, which only goes through
+// if no vote has been recorded and no item has gone into or out of the trash since the poll was read
+// the rebuild's global scores are marked with what's in the trash before that, and the scores of the generation
+// it replaces are deleted after
+func (s DynamoVoteStore) SwapScores(poll, rebuild, lastEvent string) error {
+	record, err := s.Polls.getPollRecord(poll)
+	if err != nil {
+		return err
+	}
+	latest := lastVoteEvent(record)
+	// polls that haven't had a vote since votes were ordered don't have a latest event,
+	// and the condition below makes sure that's still so
+	if latest != "" && latest != lastEvent {
+		return MakeVersionMismatchError(fmt.Sprintf("votes have been cast in poll %s since its scores were rebuilt", poll))
+	}
+	generation := scoreGeneration(record)
+	version, err := trashVersion(record)
+	if err != nil {
+		return err
+	}
+	err = s.markTrashedScores(poll, rebuild)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]types.AttributeValue{
+		":rebuild": &types.AttributeValueMemberS{Value: rebuild},
+	}
+	condition := "attribute_exists(#name) AND " + lastVoteEventCondition(latest, values) +
+		" AND " + scoreGenerationCondition(generation, values) + " AND " + trashVersionCondition(version, values)
+	_, err = s.Polls.Client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		Key:                       pollKey(poll),
+		TableName:                 aws.String(s.Polls.Name),
+		UpdateExpression:          aws.String("SET ScoreGeneration = :rebuild"),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  map[string]string{"#name": "Name"},
+		ExpressionAttributeValues: values,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return MakeVersionMismatchError(fmt.Sprintf("votes have been cast or items trashed in poll %s since its scores were rebuilt", poll))
+	}
+	if err != nil {
+		return err
+	}
+
+	// the swap has happened, so the scores left behind by a failure here are only taking up space
+	err = s.deleteScores(scorePartition(poll, generation))
+	if err != nil {
+		log.Printf("error deleting the scores of poll %s from before rebuild %s: %v", poll, rebuild, err)
+	}
+	return nil
+}
+
+// marks the global scores that a rebuild staged for items in the trash, and unmarks the rest
+func (s DynamoVoteStore) markTrashedScores(poll, rebuild string) error {
+	trashed, err := s.Items.trashedIDs(poll)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":poll": &types.AttributeValueMemberS{Value: scorePartition(poll, rebuild)},
+		},
+		KeyConditionExpression: aws.String("Poll = :poll"),
+		TableName:              aws.String(s.GlobalScores.Name),
+		ConsistentRead:         aws.Bool(true),
+	}
+	paginator := dynamodb.NewQueryPaginator(s.GlobalScores.Client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			itemID := item["ItemName"].(*types.AttributeValueMemberS).Value
+			_, marked := item["Trashed"]
+			if marked == trashed[itemID] {
+				continue
+			}
+			update := &dynamodb.UpdateItemInput{
+				Key:              globalScoreKey(scorePartition(poll, rebuild), itemID),
+				TableName:        aws.String(s.GlobalScores.Name),
+				UpdateExpression: aws.String("REMOVE Trashed"),
+			}
+			if trashed[itemID] {
+				update.UpdateExpression = aws.String("SET Trashed = :true")
+				update.ExpressionAttributeValues = map[string]types.AttributeValue{
+					":true": &types.AttributeValueMemberBOOL{Value: true},
+				}
+			}
+			_, err = s.GlobalScores.Client.UpdateItem(context.TODO(), update)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DiscardScores leaves the rebuild's scores alone if they were swapped in after all,
+// which a swap whose write to the poll failed on the way back can have done
+func (s DynamoVoteStore) DiscardScores(rebuild string) error {
+	inUse := map[string]bool{}
+	keep := func(partition string) (bool, error) {
+		poll, _ := partitionPoll(partition)
+		if kept, ok := inUse[poll]; ok {
+			return kept, nil
+		}
+		generation, err := s.Polls.getScoreGeneration(poll)
+		if _, ok := err.(NotFoundError); ok {
+			generation, err = "", nil
+		}
+		if err != nil {
+			return false, err
+		}
+		inUse[poll] = generation == rebuild
+		return inUse[poll], nil
+	}
+	values := map[string]types.AttributeValue{
+		":generation": &types.AttributeValueMemberS{Value: rebuild},
+	}
+	err := deleteScoreRecords(Table(s.UserScores), userScoreKeyAttributes, "Generation = :generation", values, keep)
+	if err != nil {
+		return err
+	}
+	return deleteScoreRecords(Table(s.GlobalScores), globalScoreKeyAttributes, "Generation = :generation", values, keep)
+}
+
+// deletes the user and global scores kept under a partition
+func (s DynamoVoteStore) deleteScores(partition string) error {
+	values := map[string]types.AttributeValue{
+		":poll": &types.AttributeValueMemberS{Value: partition},
+	}
+	err := deleteScoreRecords(Table(s.UserScores), userScoreKeyAttributes, "Poll = :poll", values, nil)
+	if err != nil {
+		return err
+	}
+	return deleteScoreRecords(Table(s.GlobalScores), globalScoreKeyAttributes, "Poll = :poll", values, nil)
+}
+
+var userScoreKeyAttributes = []string{"UserName", "PollItem"}
+var globalScoreKeyAttributes = []string{"Poll", "ItemName"}
+
+// deletes the scores in a score table that match filter, apart from those in partitions that keep says to keep, if given
+// user scores are partitioned by user, so finding a generation's scores takes a scan
+func deleteScoreRecords(t Table, keyAttributes []string, filter string, values map[string]types.AttributeValue, keep func(partition string) (bool, error)) error {
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(t.Name),
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeValues: values,
+	}
+	paginator := dynamodb.NewScanPaginator(t.Client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			if keep != nil {
+				kept, err := keep(item["Poll"].(*types.AttributeValueMemberS).Value)
+				if err != nil {
+					return err
+				}
+				if kept {
+					continue
+				}
+			}
+			key := map[string]types.AttributeValue{}
+			for _, attribute := range keyAttributes {
+				key[attribute] = item[attribute]
+			}
+			_, err = t.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{Key: key, TableName: aws.String(t.Name)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
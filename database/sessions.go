@@ -0,0 +1,147 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type SessionTable Table
+
+// a login that can be kept alive with a refresh token, until it expires or the user logs out
+// only hashes of the current refresh token and the one it replaced are stored
+// PreviousRefreshHash is empty until the session has been refreshed
+type Session struct {
+	ID                  string
+	UserName            string
+	RefreshHash         string
+	PreviousRefreshHash string
+	ExpiresAt           time.Time
+}
+
+func CreateSessionTable(client *dynamodb.Client) (SessionTable, error) {
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("ID"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("ID"),
+				KeyType:       types.KeyTypeHash,
+			},
+		},
+		TableName:   aws.String("Sessions"),
+		BillingMode: types.BillingModePayPerRequest,
+	}
+	err := createTable(client, input)
+	if err != nil {
+		return SessionTable{}, err
+	}
+	// let DynamoDB clean up expired sessions
+	_, err = client.UpdateTimeToLive(context.TODO(), &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String("Sessions"),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("ExpiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return SessionTable{}, err
+	}
+	return SessionTable{Name: "Sessions", Client: client}, nil
+}
+
+func (t SessionTable) PutSession(session Session) error {
+	input := &dynamodb.PutItemInput{
+		Item: map[string]types.AttributeValue{
+			"ID":                  &types.AttributeValueMemberS{Value: session.ID},
+			"UserName":            &types.AttributeValueMemberS{Value: session.UserName},
+			"RefreshHash":         &types.AttributeValueMemberS{Value: session.RefreshHash},
+			"PreviousRefreshHash": &types.AttributeValueMemberS{Value: session.PreviousRefreshHash},
+			"ExpiresAt":           &types.AttributeValueMemberN{Value: strconv.FormatInt(session.ExpiresAt.Unix(), 10)},
+		},
+		TableName: aws.String(t.Name),
+	}
+	_, err := t.Client.PutItem(context.TODO(), input)
+	return err
+}
+
+// returns a NotFoundError for expired sessions too, since DynamoDB may take a while to delete them
+func (t SessionTable) GetSession(id string) (Session, error) {
+	input := &dynamodb.GetItemInput{
+		Key: map[string]types.AttributeValue{
+			"ID": &types.AttributeValueMemberS{Value: id},
+		},
+		TableName: aws.String(t.Name),
+	}
+	output, err := t.Client.GetItem(context.TODO(), input)
+	if err != nil {
+		return Session{}, err
+	}
+	if output.Item == nil {
+		return Session{}, MakeNotFoundError(fmt.Sprintf("no session found with id %s", id))
+	}
+	expiresAt, err := strconv.ParseInt(output.Item["ExpiresAt"].(*types.AttributeValueMemberN).Value, 10, 64)
+	if err != nil {
+		return Session{}, err
+	}
+	session := Session{
+		ID:          output.Item["ID"].(*types.AttributeValueMemberS).Value,
+		UserName:    output.Item["UserName"].(*types.AttributeValueMemberS).Value,
+		RefreshHash: output.Item["RefreshHash"].(*types.AttributeValueMemberS).Value,
+		ExpiresAt:   time.Unix(expiresAt, 0),
+	}
+	// sessions from before the previous hash was kept don't have it
+	if previous, ok := output.Item["PreviousRefreshHash"].(*types.AttributeValueMemberS); ok {
+		session.PreviousRefreshHash = previous.Value
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return Session{}, MakeNotFoundError(fmt.Sprintf("no session found with id %s", id))
+	}
+	return session, nil
+}
+
+func (t SessionTable) DeleteSession(id string) error {
+	input := &dynamodb.DeleteItemInput{
+		Key: map[string]types.AttributeValue{
+			"ID": &types.AttributeValueMemberS{Value: id},
+		},
+		TableName: aws.String(t.Name),
+	}
+	_, err := t.Client.DeleteItem(context.TODO(), input)
+	return err
+}
+
+// sessions are only keyed by ID, so this scans the table; it's only needed for rare events like password changes
+func (t SessionTable) DeleteUserSessions(userName string, except string) error {
+	paginator := dynamodb.NewScanPaginator(t.Client, &dynamodb.ScanInput{
+		TableName:            aws.String(t.Name),
+		ProjectionExpression: aws.String("ID"),
+		FilterExpression:     aws.String("UserName = :userName AND ID <> :except"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userName": &types.AttributeValueMemberS{Value: userName},
+			":except":   &types.AttributeValueMemberS{Value: except},
+		},
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			err := t.DeleteSession(item["ID"].(*types.AttributeValueMemberS).Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
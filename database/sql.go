@@ -0,0 +1,1227 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// an implementation of all the stores on top of a SQL database
+// the tables are created by the migrations for the specific backend
+type SQLStore struct {
+	DB      *sql.DB
+	dialect sqlDialect
+}
+
+// the differences between the SQL backends that the queries have to account for
+// the zero value is SQLite's
+type sqlDialect struct {
+	// PostgreSQL numbers its placeholders ($1, $2, ...) instead of using ?
+	numberedParams bool
+	// clause for locking selected rows until the end of the transaction, if transactions don't already
+	// SQLite's take the write lock when they begin, so only one runs at a time
+	forUpdate string
+}
+
+var postgresDialect = sqlDialect{
+	numberedParams: true,
+	forUpdate:      " FOR UPDATE",
+}
+
+// rewrites the ? placeholders in query for the store's dialect
+func (s SQLStore) bind(query string) string {
+	if !s.dialect.numberedParams {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func (s SQLStore) exec(query string, args ...any) (sql.Result, error) {
+	return s.DB.Exec(s.bind(query), args...)
+}
+
+func (s SQLStore) query(query string, args ...any) (*sql.Rows, error) {
+	return s.DB.Query(s.bind(query), args...)
+}
+
+func (s SQLStore) queryRow(query string, args ...any) *sql.Row {
+	return s.DB.QueryRow(s.bind(query), args...)
+}
+
+func (s SQLStore) CreatePoll(poll Poll) error {
+	result, err := s.exec(
+		`INSERT INTO polls (name, description, owner, visibility) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO NOTHING`,
+		poll.Name, poll.Description, poll.Owner, poll.Visibility,
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return MakeAlreadyExistsError(fmt.Sprintf("a poll named %s already exists", poll.Name))
+	}
+	return nil
+}
+
+func (s SQLStore) PutPoll(poll Poll) error {
+	_, err := s.exec(
+		`INSERT INTO polls (name, description, owner, visibility) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET description = excluded.description, owner = excluded.owner, visibility = excluded.visibility`,
+		poll.Name, poll.Description, poll.Owner, poll.Visibility,
+	)
+	return err
+}
+
+func (s SQLStore) RevokeInvites(name string) error {
+	result, err := s.exec(`UPDATE polls SET invite_generation = invite_generation + 1 WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return MakeNotFoundError(fmt.Sprintf("no poll found with name %s", name))
+	}
+	return nil
+}
+
+func (s SQLStore) GetPoll(name string) (Poll, error) {
+	var poll Poll
+	err := s.queryRow(
+		`SELECT name, description, owner, visibility, invite_generation FROM polls WHERE name = ?`, name,
+	).Scan(&poll.Name, &poll.Description, &poll.Owner, &poll.Visibility, &poll.InviteGeneration)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Poll{}, MakeNotFoundError(fmt.Sprintf("no poll found with name %s", name))
+	}
+	if err != nil {
+		return Poll{}, err
+	}
+	return poll, nil
+}
+
+// returns a page of the polls with the given visibility ordered by name, and the cursor for the next page
+func (s SQLStore) PollsPage(visibility string, options PageOptions) ([]Poll, string, error) {
+	after, err := decodeNameCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	condition, args := prefixCondition("name", options)
+	rows, err := s.query(
+		`SELECT name, description, owner, visibility, invite_generation FROM polls WHERE visibility = ? AND name > ?`+condition+` ORDER BY name`+limitClause(options),
+		append([]any{visibility, after}, args...)...,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	polls := []Poll{}
+	for rows.Next() {
+		var poll Poll
+		if err := rows.Scan(&poll.Name, &poll.Description, &poll.Owner, &poll.Visibility, &poll.InviteGeneration); err != nil {
+			return nil, "", err
+		}
+		polls = append(polls, poll)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return trimPage(polls, options, func(poll Poll) string { return poll.Name })
+}
+
+func (s SQLStore) AddPollMember(poll, userName string) error {
+	_, err := s.exec(
+		`INSERT INTO poll_members (poll, user_name) VALUES (?, ?)
+		ON CONFLICT (poll, user_name) DO NOTHING`,
+		poll, userName,
+	)
+	return err
+}
+
+func (s SQLStore) RemovePollMember(poll, userName string) error {
+	_, err := s.exec(`DELETE FROM poll_members WHERE poll = ? AND user_name = ?`, poll, userName)
+	return err
+}
+
+func (s SQLStore) IsPollMember(poll, userName string) (bool, error) {
+	var n int
+	err := s.queryRow(
+		`SELECT COUNT(*) FROM poll_members WHERE poll = ? AND user_name = ?`, poll, userName,
+	).Scan(&n)
+	return n > 0, err
+}
+
+// returns a page of the names of a poll's members in order, and the cursor for the next page
+func (s SQLStore) PollMembers(poll string, options PageOptions) ([]string, string, error) {
+	after, err := decodeNameCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	condition, args := prefixCondition("user_name", options)
+	rows, err := s.query(
+		`SELECT user_name FROM poll_members WHERE poll = ? AND user_name > ?`+condition+` ORDER BY user_name`+limitClause(options),
+		append([]any{poll, after}, args...)...,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	members := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, "", err
+		}
+		members = append(members, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return trimPage(members, options, func(name string) string { return name })
+}
+
+// metadata is stored as a JSON object
+func (s SQLStore) CreateItem(item Item) error {
+	metadata, err := json.Marshal(item.Metadata)
+	if err != nil {
+		return err
+	}
+	result, err := s.exec(
+		`INSERT INTO items (poll, id, name, description, metadata, version) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (poll, name) DO NOTHING`,
+		item.Poll, item.ID, item.Name, item.Description, string(metadata), item.Version,
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return MakeAlreadyExistsError(fmt.Sprintf("an item named %s already exists in poll %s", item.Name, item.Poll))
+	}
+	return nil
+}
+
+func (s SQLStore) UpdateItem(name string, item Item) error {
+	metadata, err := json.Marshal(item.Metadata)
+	if err != nil {
+		return err
+	}
+	if name != item.Name {
+		// items in the trash keep their names, so they count here too
+		_, err := s.getItem(item.Poll, item.Name, "")
+		if err == nil {
+			return MakeAlreadyExistsError(fmt.Sprintf("an item named %s already exists in poll %s", item.Name, item.Poll))
+		}
+		if _, ok := err.(NotFoundError); !ok {
+			return err
+		}
+	}
+	result, err := s.exec(
+		`UPDATE items SET name = ?, description = ?, metadata = ?, version = version + 1 WHERE poll = ? AND name = ? AND version = ?`,
+		item.Name, item.Description, string(metadata), item.Poll, name, item.Version,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		// either the item is gone or someone else changed it first; GetItem tells us which
+		_, err := s.GetItem(item.Poll, name)
+		if err != nil {
+			return err
+		}
+		return MakeVersionMismatchError(fmt.Sprintf("item %s has changed since version %d", name, item.Version))
+	}
+	return nil
+}
+
+const itemColumns = `poll, id, name, description, metadata, version, deleted_at, merged_from`
+
+// reads a row of itemColumns
+func scanItem(row rowScanner) (Item, error) {
+	var item Item
+	var metadata string
+	var deletedAt sql.NullInt64
+	var mergedFrom string
+	err := row.Scan(&item.Poll, &item.ID, &item.Name, &item.Description, &metadata, &item.Version, &deletedAt, &mergedFrom)
+	if err != nil {
+		return Item{}, err
+	}
+	err = json.Unmarshal([]byte(mergedFrom), &item.MergedFrom)
+	if err != nil {
+		return Item{}, err
+	}
+	err = json.Unmarshal([]byte(metadata), &item.Metadata)
+	if err != nil {
+		return Item{}, err
+	}
+	if item.Metadata == nil {
+		item.Metadata = map[string]string{}
+	}
+	if deletedAt.Valid {
+		at := time.Unix(deletedAt.Int64, 0)
+		item.DeletedAt = &at
+	}
+	return item, nil
+}
+
+// reads an item whether or not it's in the trash, with condition narrowing that down if it isn't empty
+func (s SQLStore) getItem(poll, name, condition string) (Item, error) {
+	item, err := scanItem(s.queryRow(
+		`SELECT `+itemColumns+` FROM items WHERE poll = ? AND name = ?`+condition, poll, name,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Item{}, MakeNotFoundError(fmt.Sprintf("no item found with name %s in poll %s", name, poll))
+	}
+	if err != nil {
+		return Item{}, err
+	}
+	return item, nil
+}
+
+func (s SQLStore) GetItem(poll, name string) (Item, error) {
+	return s.getItem(poll, name, ` AND deleted_at IS NULL`)
+}
+
+func (s SQLStore) GetTrashedItem(poll, name string) (Item, error) {
+	item, err := s.getItem(poll, name, ` AND deleted_at IS NOT NULL`)
+	if _, ok := err.(NotFoundError); ok {
+		return Item{}, MakeNotFoundError(fmt.Sprintf("no item found with name %s in the trash of poll %s", name, poll))
+	}
+	return item, err
+}
+
+func (s SQLStore) DeleteItem(poll, name string) error {
+	_, err := s.exec(`DELETE FROM items WHERE poll = ? AND name = ?`, poll, name)
+	return err
+}
+
+// reads every item a query returns
+func (s SQLStore) queryItems(query string, args ...any) ([]Item, error) {
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []Item{}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s SQLStore) AllItems(poll string) ([]Item, error) {
+	return s.queryItems(`SELECT `+itemColumns+` FROM items WHERE poll = ? AND deleted_at IS NULL ORDER BY name`, poll)
+}
+
+// returns a page of a poll's items that match condition, ordered by name, and the cursor for the next page
+func (s SQLStore) itemsPage(poll, condition string, options PageOptions) ([]Item, string, error) {
+	after, err := decodeNameCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix, args := prefixCondition("name", options)
+	items, err := s.queryItems(
+		`SELECT `+itemColumns+` FROM items WHERE poll = ? AND name > ?`+condition+prefix+` ORDER BY name`+limitClause(options),
+		append([]any{poll, after}, args...)...,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	return trimPage(items, options, func(item Item) string { return item.Name })
+}
+
+// returns a page of a poll's items ordered by name, and the cursor for the next page
+func (s SQLStore) ItemsPage(poll string, options PageOptions) ([]Item, string, error) {
+	return s.itemsPage(poll, ` AND deleted_at IS NULL`, options)
+}
+
+// returns a page of the items in a poll's trash ordered by name, and the cursor for the next page
+func (s SQLStore) TrashedItemsPage(poll string, options PageOptions) ([]Item, string, error) {
+	return s.itemsPage(poll, ` AND deleted_at IS NOT NULL`, options)
+}
+
+func (s SQLStore) TrashedBefore(before time.Time) ([]Item, error) {
+	return s.queryItems(`SELECT `+itemColumns+` FROM items WHERE deleted_at < ?`, before.Unix())
+}
+
+// created_at is in Unix nanoseconds, and 0 for users from before it was kept
+const userColumns = "name, password, roles, created_at"
+
+func unixNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (s SQLStore) CreateUser(user User) error {
+	result, err := s.exec(
+		`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO NOTHING`,
+		user.Name, user.PasswordHash, strings.Join(user.Roles, ","), unixNanos(user.CreatedAt),
+	)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return MakeAlreadyExistsError(fmt.Sprintf("a user named %s already exists", user.Name))
+	}
+	return nil
+}
+
+// roles are stored comma-separated
+func (s SQLStore) PutUser(user User) error {
+	_, err := s.exec(
+		`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET password = excluded.password, roles = excluded.roles`,
+		user.Name, user.PasswordHash, strings.Join(user.Roles, ","), unixNanos(user.CreatedAt),
+	)
+	return err
+}
+
+// updates in place, so it only touches an existing user
+func (s SQLStore) SetUserRoles(name string, roles []string) error {
+	result, err := s.exec(`UPDATE users SET roles = ? WHERE name = ?`, strings.Join(roles, ","), name)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return MakeNotFoundError(fmt.Sprintf("No user found with name %s", name))
+	}
+	return nil
+}
+
+func (s SQLStore) SetUserPassword(name string, passwordHash string) error {
+	result, err := s.exec(`UPDATE users SET password = ? WHERE name = ?`, passwordHash, name)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return MakeNotFoundError(fmt.Sprintf("No user found with name %s", name))
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// reads a row of userColumns
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var roles string
+	var createdAt int64
+	err := row.Scan(&user.Name, &user.PasswordHash, &roles, &createdAt)
+	if err != nil {
+		return User{}, err
+	}
+	if createdAt != 0 {
+		user.CreatedAt = time.Unix(0, createdAt)
+	}
+	user.Roles = []string{}
+	if roles != "" {
+		user.Roles = strings.Split(roles, ",")
+	}
+	return user, nil
+}
+
+func (s SQLStore) GetUser(name string) (User, error) {
+	user, err := scanUser(s.queryRow(
+		`SELECT `+userColumns+` FROM users WHERE name = ?`, name,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, MakeNotFoundError(fmt.Sprintf("No user found with name %s", name))
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s SQLStore) DeleteUser(name string) error {
+	_, err := s.exec(`DELETE FROM users WHERE name = ?`, name)
+	return err
+}
+
+func (s SQLStore) AllUsers() ([]User, error) {
+	rows, err := s.query(`SELECT ` + userColumns + ` FROM users ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// returns a page of users ordered by name, and the cursor for the next page
+func (s SQLStore) UsersPage(options PageOptions) ([]User, string, error) {
+	after, err := decodeNameCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	condition, args := prefixCondition("name", options)
+	rows, err := s.query(
+		`SELECT `+userColumns+` FROM users WHERE name > ?`+condition+` ORDER BY name`+limitClause(options),
+		append([]any{after}, args...)...,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return trimPage(users, options, func(user User) string { return user.Name })
+}
+
+// the columns a score's standing is stored in, in the order of standingFields and standingArgs
+const standingColumns = `rating, num_votes, deviation, volatility`
+
+// sets standingColumns from standingArgs
+const standingAssignments = `rating = ?, num_votes = ?, deviation = ?, volatility = ?`
+
+// sets standingColumns to the values an insert that conflicted tried to give them
+const standingUpserts = `rating = excluded.rating, num_votes = excluded.num_votes, deviation = excluded.deviation, volatility = excluded.volatility`
+
+// where to scan standingColumns into
+func standingFields(standing *Standing) []any {
+	return []any{&standing.Rating, &standing.NumVotes, &standing.Deviation, &standing.Volatility}
+}
+
+func standingArgs(standing Standing) []any {
+	return []any{standing.Rating, standing.NumVotes, standing.Deviation, standing.Volatility}
+}
+
+func (s SQLStore) PutUserScore(u UserScore) error {
+	_, err := s.exec(
+		`INSERT INTO user_scores (user_name, poll, item_id, `+standingColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_name, poll, item_id) DO UPDATE SET `+standingUpserts,
+		append([]any{u.UserName, u.Poll, u.ItemID}, standingArgs(u.Standing)...)...,
+	)
+	return err
+}
+
+// like the DynamoDB UpdateItem call, this creates the score if it doesn't exist yet
+func (s SQLStore) UpdateUserScore(u UserScore) error {
+	return s.PutUserScore(u)
+}
+
+func (s SQLStore) GetUserScore(poll, itemID, userName string) (UserScore, error) {
+	var u UserScore
+	err := s.queryRow(
+		`SELECT poll, item_id, user_name, `+standingColumns+` FROM user_scores WHERE user_name = ? AND poll = ? AND item_id = ?`,
+		userName, poll, itemID,
+	).Scan(append([]any{&u.Poll, &u.ItemID, &u.UserName}, standingFields(&u.Standing)...)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserScore{}, MakeNotFoundError(fmt.Sprintf("no user score found for item %s and user %s in poll %s", itemID, userName, poll))
+	}
+	if err != nil {
+		return UserScore{}, err
+	}
+	return u, nil
+}
+
+func (s SQLStore) GetUserScores(poll, userName string) ([]UserScore, error) {
+	rows, err := s.query(
+		`SELECT poll, item_id, user_name, `+standingColumns+` FROM user_scores WHERE user_name = ? AND poll = ? ORDER BY item_id`,
+		userName, poll,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ratings []UserScore
+	for rows.Next() {
+		var u UserScore
+		if err := rows.Scan(append([]any{&u.Poll, &u.ItemID, &u.UserName}, standingFields(&u.Standing)...)...); err != nil {
+			return nil, err
+		}
+		ratings = append(ratings, u)
+	}
+	return ratings, rows.Err()
+}
+
+func (s SQLStore) PutGlobalScore(g GlobalScore) error {
+	_, err := s.exec(
+		`INSERT INTO global_scores (poll, item_id, `+standingColumns+`) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (poll, item_id) DO UPDATE SET `+standingUpserts,
+		append([]any{g.Poll, g.ItemID}, standingArgs(g.Standing)...)...,
+	)
+	return err
+}
+
+// like the DynamoDB UpdateItem call, this creates the score if it doesn't exist yet
+func (s SQLStore) UpdateGlobalScore(g GlobalScore) error {
+	return s.PutGlobalScore(g)
+}
+
+func (s SQLStore) GetGlobalScore(poll, itemID string) (GlobalScore, error) {
+	var g GlobalScore
+	err := s.queryRow(
+		`SELECT poll, item_id, `+standingColumns+` FROM global_scores WHERE poll = ? AND item_id = ?`, poll, itemID,
+	).Scan(append([]any{&g.Poll, &g.ItemID}, standingFields(&g.Standing)...)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return GlobalScore{}, MakeNotFoundError(fmt.Sprintf("no global score found for item %s in poll %s", itemID, poll))
+	}
+	if err != nil {
+		return GlobalScore{}, err
+	}
+	return g, nil
+}
+
+// returns a poll's global scores from highest to lowest rating, and the cursor for the next page
+func (s SQLStore) Leaderboard(poll string, options LeaderboardOptions) ([]RankedScore, string, error) {
+	after, err := decodeRankCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	// items in the trash keep their scores but aren't ranked
+	query := `SELECT g.poll, g.item_id, g.rating, g.num_votes, g.deviation, g.volatility FROM global_scores g
+		JOIN items i ON i.poll = g.poll AND i.id = g.item_id
+		WHERE g.poll = ? AND g.num_votes >= ? AND i.deleted_at IS NULL`
+	args := []any{poll, options.MinVotes}
+	if after != nil {
+		query += ` AND (g.rating < ? OR (g.rating = ? AND g.item_id > ?))`
+		args = append(args, after.Rating, after.Rating, after.ItemID)
+	}
+	query += ` ORDER BY g.rating DESC, g.item_id` + limitClause(PageOptions{Limit: options.Limit})
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	scores := []GlobalScore{}
+	for rows.Next() {
+		var g GlobalScore
+		if err := rows.Scan(append([]any{&g.Poll, &g.ItemID}, standingFields(&g.Standing)...)...); err != nil {
+			return nil, "", err
+		}
+		scores = append(scores, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return rankPage(scores, options, after)
+}
+
+func (s SQLStore) PutSession(session Session) error {
+	_, err := s.exec(
+		`INSERT INTO sessions (id, user_name, refresh_hash, previous_refresh_hash, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET refresh_hash = excluded.refresh_hash,
+			previous_refresh_hash = excluded.previous_refresh_hash, expires_at = excluded.expires_at`,
+		session.ID, session.UserName, session.RefreshHash, session.PreviousRefreshHash, session.ExpiresAt.Unix(),
+	)
+	return err
+}
+
+func (s SQLStore) GetSession(id string) (Session, error) {
+	var session Session
+	var expiresAt int64
+	err := s.queryRow(
+		`SELECT id, user_name, refresh_hash, previous_refresh_hash, expires_at FROM sessions WHERE id = ? AND expires_at > ?`,
+		id, time.Now().Unix(),
+	).Scan(&session.ID, &session.UserName, &session.RefreshHash, &session.PreviousRefreshHash, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, MakeNotFoundError(fmt.Sprintf("no session found with id %s", id))
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	session.ExpiresAt = time.Unix(expiresAt, 0)
+	return session, nil
+}
+
+// also clears out any sessions that have expired
+func (s SQLStore) DeleteSession(id string) error {
+	_, err := s.exec(`DELETE FROM sessions WHERE id = ? OR expires_at <= ?`, id, time.Now().Unix())
+	return err
+}
+
+func (s SQLStore) DeleteUserSessions(userName string, except string) error {
+	_, err := s.exec(`DELETE FROM sessions WHERE user_name = ? AND id <> ?`, userName, except)
+	return err
+}
+
+// locks a poll's row until the end of the transaction and returns the ID of its latest vote event,
+// which keeps votes in the poll from being recorded in the meantime
+func (s SQLStore) lockVoteEvents(tx *sql.Tx, poll string) (string, error) {
+	var latest string
+	err := tx.QueryRow(s.bind(`SELECT last_vote_event FROM polls WHERE name = ?`+s.dialect.forUpdate), poll).Scan(&latest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", MakeNotFoundError(fmt.Sprintf("no poll found with name %s", poll))
+	}
+	return latest, err
+}
+
+// RecordVote locks the poll, the four scores involved in the vote and the two items, applies update to the scores,
+// and writes them back in one transaction along with the vote's event
+func (s SQLStore) RecordVote(event VoteEvent, votedItem1, votedItem2 Item, update VoteUpdate) error {
+	poll, user, item1, item2 := event.Poll, event.UserName, event.Item1, event.Item2
+	metadata, err := json.Marshal(event.Metadata)
+	if err != nil {
+		return err
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the poll goes first, so that a vote waits for the one before it and for a score swap to finish
+	// before locking any scores, rather than holding scores the swap is waiting for
+	latest, err := s.lockVoteEvents(tx, poll)
+	if err != nil {
+		return err
+	}
+	event.ID, err = nextVoteEventID(latest, event.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.bind(`UPDATE polls SET last_vote_event = ? WHERE name = ?`), event.ID, poll)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.bind(
+		`INSERT INTO vote_events (poll, id, user_name, item1, item2, winner, created_at, metadata) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+	), event.Poll, event.ID, event.UserName, event.Item1, event.Item2, event.Winner, event.Timestamp.Unix(), string(metadata))
+	if err != nil {
+		return err
+	}
+
+	// lock rows in a consistent order so that concurrent votes on the same items can't deadlock
+	items := []string{item1, item2}
+	sort.Strings(items)
+	userScores := map[string]*UserScore{}
+	for _, item := range items {
+		// make sure the row exists so that there is something to lock
+		_, err = tx.Exec(s.bind(
+			`INSERT INTO user_scores (user_name, poll, item_id, `+standingColumns+`) VALUES (?, ?, ?, 0, 0, 0, 0)
+			ON CONFLICT (user_name, poll, item_id) DO NOTHING`,
+		), user, poll, item)
+		if err != nil {
+			return err
+		}
+		var u UserScore
+		err = tx.QueryRow(s.bind(
+			`SELECT poll, item_id, user_name, `+standingColumns+` FROM user_scores
+			WHERE user_name = ? AND poll = ? AND item_id = ?`+s.dialect.forUpdate,
+		), user, poll, item).Scan(append([]any{&u.Poll, &u.ItemID, &u.UserName}, standingFields(&u.Standing)...)...)
+		if err != nil {
+			return err
+		}
+		userScores[item] = &u
+	}
+	globalScores := map[string]*GlobalScore{}
+	for _, item := range items {
+		_, err = tx.Exec(s.bind(
+			`INSERT INTO global_scores (poll, item_id, `+standingColumns+`) VALUES (?, ?, 0, 0, 0, 0)
+			ON CONFLICT (poll, item_id) DO NOTHING`,
+		), poll, item)
+		if err != nil {
+			return err
+		}
+		var g GlobalScore
+		err = tx.QueryRow(s.bind(
+			`SELECT poll, item_id, `+standingColumns+` FROM global_scores WHERE poll = ? AND item_id = ?`+s.dialect.forUpdate,
+		), poll, item).Scan(append([]any{&g.Poll, &g.ItemID}, standingFields(&g.Standing)...)...)
+		if err != nil {
+			return err
+		}
+		globalScores[item] = &g
+	}
+
+	// the items are locked after their scores, as merges do, so that an item can't be trashed or merged away
+	// before the vote is in
+	rows, err := tx.Query(s.bind(
+		`SELECT id FROM items WHERE poll = ? AND id IN (?, ?) AND deleted_at IS NULL`+s.dialect.forUpdate,
+	), poll, item1, item2)
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		found[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, voted := range []Item{votedItem1, votedItem2} {
+		if !found[voted.ID] {
+			return MakeNotFoundError(fmt.Sprintf("no item found with name %s in poll %s", voted.Name, poll))
+		}
+	}
+
+	update(userScores[item1], userScores[item2], globalScores[item1], globalScores[item2])
+
+	for _, u := range userScores {
+		_, err = tx.Exec(s.bind(
+			`UPDATE user_scores SET `+standingAssignments+` WHERE user_name = ? AND poll = ? AND item_id = ?`,
+		), append(standingArgs(u.Standing), u.UserName, u.Poll, u.ItemID)...)
+		if err != nil {
+			return err
+		}
+	}
+	for _, g := range globalScores {
+		_, err = tx.Exec(s.bind(
+			`UPDATE global_scores SET `+standingAssignments+` WHERE poll = ? AND item_id = ?`,
+		), append(standingArgs(g.Standing), g.Poll, g.ItemID)...)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// returns a page of a poll's vote events in the order they were cast, and the cursor for the next page
+func (s SQLStore) VoteEventsPage(poll string, options PageOptions) ([]VoteEvent, string, error) {
+	after, err := decodeNameCursor(options.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	rows, err := s.query(
+		`SELECT poll, id, user_name, item1, item2, winner, created_at, metadata FROM vote_events
+		WHERE poll = ? AND id > ? ORDER BY id`+limitClause(options),
+		poll, after,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	events := []VoteEvent{}
+	for rows.Next() {
+		var event VoteEvent
+		var createdAt int64
+		var metadata string
+		err := rows.Scan(&event.Poll, &event.ID, &event.UserName, &event.Item1, &event.Item2, &event.Winner, &createdAt, &metadata)
+		if err != nil {
+			return nil, "", err
+		}
+		event.Timestamp = time.Unix(createdAt, 0)
+		err = json.Unmarshal([]byte(metadata), &event.Metadata)
+		if err != nil {
+			return nil, "", err
+		}
+		if event.Metadata == nil {
+			event.Metadata = map[string]string{}
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return trimPage(events, options, func(event VoteEvent) string { return event.ID })
+}
+
+// MergeItems folds the scores together and deletes the item in one transaction
+func (s SQLStore) MergeItems(from, into Item, merge ScoreMerge) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// adds a score of from, identified by the values of keyColumns apart from the item ID, to the matching score of into
+	mergeScore := func(table string, keyColumns []string, key []any, standing Standing) error {
+		columns := strings.Join(keyColumns, ", ")
+		// make sure the row exists so that there is something to lock
+		_, err := tx.Exec(s.bind(
+			`INSERT INTO `+table+` (`+columns+`, item_id, `+standingColumns+`) VALUES (`+strings.Repeat("?, ", len(keyColumns))+`?, 0, 0, 0, 0)
+			ON CONFLICT (`+columns+`, item_id) DO NOTHING`,
+		), append(key, into.ID)...)
+		if err != nil {
+			return err
+		}
+		where := strings.Join(keyColumns, " = ? AND ") + ` = ? AND item_id = ?`
+		var intoStanding Standing
+		err = tx.QueryRow(s.bind(
+			`SELECT `+standingColumns+` FROM `+table+` WHERE `+where+s.dialect.forUpdate,
+		), append(key, into.ID)...).Scan(standingFields(&intoStanding)...)
+		if err != nil {
+			return err
+		}
+		intoStanding = merge(standing, intoStanding)
+		_, err = tx.Exec(s.bind(
+			`UPDATE `+table+` SET `+standingAssignments+` WHERE `+where,
+		), append(standingArgs(intoStanding), append(key, into.ID)...)...)
+		return err
+	}
+
+	rows, err := tx.Query(s.bind(
+		`SELECT user_name, `+standingColumns+` FROM user_scores WHERE poll = ? AND item_id = ?`+s.dialect.forUpdate,
+	), from.Poll, from.ID)
+	if err != nil {
+		return err
+	}
+	var userScores []UserScore
+	for rows.Next() {
+		var u UserScore
+		if err := rows.Scan(append([]any{&u.UserName}, standingFields(&u.Standing)...)...); err != nil {
+			rows.Close()
+			return err
+		}
+		userScores = append(userScores, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, u := range userScores {
+		err = mergeScore("user_scores", []string{"user_name", "poll"}, []any{u.UserName, from.Poll}, u.Standing)
+		if err != nil {
+			return err
+		}
+	}
+
+	var g GlobalScore
+	err = tx.QueryRow(s.bind(
+		`SELECT `+standingColumns+` FROM global_scores WHERE poll = ? AND item_id = ?`+s.dialect.forUpdate,
+	), from.Poll, from.ID).Scan(standingFields(&g.Standing)...)
+	if err == nil {
+		err = mergeScore("global_scores", []string{"poll"}, []any{from.Poll}, g.Standing)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	// record the merge on into, reading both items' MergedFrom here in case of another merge since they were read
+	mergedFrom := map[string][]string{}
+	for _, id := range []string{from.ID, into.ID} {
+		var encoded string
+		err = tx.QueryRow(s.bind(
+			`SELECT merged_from FROM items WHERE poll = ? AND id = ?`+s.dialect.forUpdate,
+		), from.Poll, id).Scan(&encoded)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		err = json.Unmarshal([]byte(encoded), &ids)
+		if err != nil {
+			return err
+		}
+		mergedFrom[id] = ids
+	}
+	encoded, err := json.Marshal(append(mergedFrom[into.ID], mergedIDs(Item{ID: from.ID, MergedFrom: mergedFrom[from.ID]})...))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.bind(
+		`UPDATE items SET merged_from = ?, version = version + 1 WHERE poll = ? AND id = ?`,
+	), string(encoded), into.Poll, into.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range []string{
+		`DELETE FROM user_scores WHERE poll = ? AND item_id = ?`,
+		`DELETE FROM global_scores WHERE poll = ? AND item_id = ?`,
+		`DELETE FROM items WHERE poll = ? AND id = ?`,
+	} {
+		_, err = tx.Exec(s.bind(statement), from.Poll, from.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s SQLStore) DeleteItemScores(poll, itemID string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range []string{
+		`DELETE FROM user_scores WHERE poll = ? AND item_id = ?`,
+		`DELETE FROM global_scores WHERE poll = ? AND item_id = ?`,
+	} {
+		_, err = tx.Exec(s.bind(statement), poll, itemID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteUserScores backs the user's votes out and deletes their scores in one transaction
+func (s SQLStore) DeleteUserScores(userName string, backOut ScoreBackOut) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if backOut != nil {
+		rows, err := tx.Query(s.bind(
+			`SELECT poll, item_id, user_name, `+standingColumns+` FROM user_scores WHERE user_name = ?`,
+		), userName)
+		if err != nil {
+			return err
+		}
+		var userScores []UserScore
+		for rows.Next() {
+			var u UserScore
+			if err := rows.Scan(append([]any{&u.Poll, &u.ItemID, &u.UserName}, standingFields(&u.Standing)...)...); err != nil {
+				rows.Close()
+				return err
+			}
+			userScores = append(userScores, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, u := range userScores {
+			var g GlobalScore
+			err = tx.QueryRow(s.bind(
+				`SELECT poll, item_id, `+standingColumns+` FROM global_scores WHERE poll = ? AND item_id = ?`+s.dialect.forUpdate,
+			), u.Poll, u.ItemID).Scan(append([]any{&g.Poll, &g.ItemID}, standingFields(&g.Standing)...)...)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			backOut(u, &g)
+			if g.NumVotes <= 0 {
+				_, err = tx.Exec(s.bind(`DELETE FROM global_scores WHERE poll = ? AND item_id = ?`), g.Poll, g.ItemID)
+			} else {
+				_, err = tx.Exec(s.bind(
+					`UPDATE global_scores SET `+standingAssignments+` WHERE poll = ? AND item_id = ?`,
+				), append(standingArgs(g.Standing), g.Poll, g.ItemID)...)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec(s.bind(`DELETE FROM user_scores WHERE user_name = ?`), userName)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sets or clears an item's deletion time, if it's in the state condition says it should be in
+func (s SQLStore) changeTrash(item Item, deletedAt any, condition string, notFound error) error {
+	result, err := s.exec(
+		`UPDATE items SET deleted_at = ? WHERE poll = ? AND name = ?`+condition,
+		deletedAt, item.Poll, item.Name,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// the leaderboard joins scores with their items, so trashing an item only has to mark the item itself
+func (s SQLStore) TrashItem(item Item, at time.Time) error {
+	return s.changeTrash(item, at.Unix(), ` AND deleted_at IS NULL`,
+		MakeNotFoundError(fmt.Sprintf("no item found with name %s in poll %s", item.Name, item.Poll)))
+}
+
+func (s SQLStore) RestoreItem(item Item) error {
+	return s.changeTrash(item, nil, ` AND deleted_at IS NOT NULL`,
+		MakeNotFoundError(fmt.Sprintf("no item found with name %s in the trash of poll %s", item.Name, item.Poll)))
+}
+
+func (s SQLStore) StageScores(poll, rebuild string, userScores []UserScore, globalScores []GlobalScore) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, u := range userScores {
+		_, err = tx.Exec(s.bind(
+			`INSERT INTO user_score_rebuilds (rebuild, user_name, poll, item_id, `+standingColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (rebuild, user_name, poll, item_id) DO UPDATE SET `+standingUpserts,
+		), append([]any{rebuild, u.UserName, u.Poll, u.ItemID}, standingArgs(u.Standing)...)...)
+		if err != nil {
+			return err
+		}
+	}
+	for _, g := range globalScores {
+		_, err = tx.Exec(s.bind(
+			`INSERT INTO global_score_rebuilds (rebuild, poll, item_id, `+standingColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (rebuild, poll, item_id) DO UPDATE SET `+standingUpserts,
+		), append([]any{rebuild, g.Poll, g.ItemID}, standingArgs(g.Standing)...)...)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SwapScores keeps votes from being recorded while it checks the vote log and replaces the scores,
+// so no vote can come in between
+func (s SQLStore) SwapScores(poll, rebuild, lastEvent string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	latest, err := s.lockVoteEvents(tx, poll)
+	if err != nil {
+		return err
+	}
+	if latest != lastEvent {
+		return MakeVersionMismatchError(fmt.Sprintf("votes have been cast in poll %s since its scores were rebuilt", poll))
+	}
+	for _, statement := range []string{
+		`DELETE FROM user_scores WHERE poll = ?`,
+		`DELETE FROM global_scores WHERE poll = ?`,
+	} {
+		_, err = tx.Exec(s.bind(statement), poll)
+		if err != nil {
+			return err
+		}
+	}
+	for _, statement := range []string{
+		`INSERT INTO user_scores (user_name, poll, item_id, ` + standingColumns + `)
+		SELECT user_name, poll, item_id, ` + standingColumns + ` FROM user_score_rebuilds WHERE rebuild = ?`,
+		`INSERT INTO global_scores (poll, item_id, ` + standingColumns + `)
+		SELECT poll, item_id, ` + standingColumns + ` FROM global_score_rebuilds WHERE rebuild = ?`,
+		`DELETE FROM user_score_rebuilds WHERE rebuild = ?`,
+		`DELETE FROM global_score_rebuilds WHERE rebuild = ?`,
+	} {
+		_, err = tx.Exec(s.bind(statement), rebuild)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s SQLStore) DiscardScores(rebuild string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range []string{
+		`DELETE FROM user_score_rebuilds WHERE rebuild = ?`,
+		`DELETE FROM global_score_rebuilds WHERE rebuild = ?`,
+	} {
+		_, err = tx.Exec(s.bind(statement), rebuild)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// the scores are kept as JSON, since they're only ever read and written all together
+func (s SQLStore) PutFittedRanking(ranking FittedRanking) error {
+	scores, err := json.Marshal(ranking.Scores)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(
+		`INSERT INTO fitted_rankings (poll, user_name, fitted_at, last_event, num_votes, scores) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (poll, user_name) DO UPDATE SET fitted_at = excluded.fitted_at, last_event = excluded.last_event,
+		num_votes = excluded.num_votes, scores = excluded.scores`,
+		ranking.Poll, ranking.UserName, ranking.FittedAt.Unix(), ranking.LastEvent, ranking.NumVotes, string(scores),
+	)
+	return err
+}
+
+func (s SQLStore) GetFittedRanking(poll, userName string) (FittedRanking, error) {
+	var ranking FittedRanking
+	var fittedAt int64
+	var scores string
+	err := s.queryRow(
+		`SELECT poll, user_name, fitted_at, last_event, num_votes, scores FROM fitted_rankings WHERE poll = ? AND user_name = ?`,
+		poll, userName,
+	).Scan(&ranking.Poll, &ranking.UserName, &fittedAt, &ranking.LastEvent, &ranking.NumVotes, &scores)
+	if errors.Is(err, sql.ErrNoRows) {
+		return FittedRanking{}, fittedRankingNotFound(poll, userName)
+	}
+	if err != nil {
+		return FittedRanking{}, err
+	}
+	ranking.FittedAt = time.Unix(fittedAt, 0)
+	err = json.Unmarshal([]byte(scores), &ranking.Scores)
+	if err != nil {
+		return FittedRanking{}, err
+	}
+	if ranking.Scores == nil {
+		ranking.Scores = []FittedScore{}
+	}
+	return ranking, nil
+}
+
+func (s SQLStore) DeleteUserFittedRankings(userName string) error {
+	_, err := s.exec(`DELETE FROM fitted_rankings WHERE user_name = ?`, userName)
+	return err
+}
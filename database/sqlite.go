@@ -0,0 +1,273 @@
+package database
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		statements: []string{
+			`CREATE TABLE items (
+				name TEXT PRIMARY KEY,
+				description TEXT NOT NULL
+			)`,
+			`CREATE TABLE users (
+				name TEXT PRIMARY KEY,
+				password TEXT NOT NULL
+			)`,
+			`CREATE TABLE user_scores (
+				user_name TEXT NOT NULL,
+				item_name TEXT NOT NULL,
+				rating INTEGER NOT NULL,
+				num_votes INTEGER NOT NULL,
+				PRIMARY KEY (user_name, item_name)
+			)`,
+			`CREATE TABLE global_scores (
+				item_name TEXT PRIMARY KEY,
+				rating INTEGER NOT NULL,
+				num_votes INTEGER NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 2,
+		statements: []string{
+			`CREATE INDEX global_scores_leaderboard ON global_scores (rating DESC, item_name)`,
+		},
+	},
+	{
+		version: 3,
+		statements: []string{
+			`CREATE TABLE sessions (
+				id TEXT PRIMARY KEY,
+				user_name TEXT NOT NULL,
+				refresh_hash TEXT NOT NULL,
+				expires_at BIGINT NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 4,
+		statements: []string{
+			// existing users keep the permissions they had before roles (see legacyRoles)
+			`ALTER TABLE users ADD COLUMN roles TEXT NOT NULL DEFAULT 'voter'`,
+			`UPDATE users SET roles = 'voter,admin' WHERE name = 'admin'`,
+		},
+	},
+	{
+		version: 5,
+		statements: []string{
+			`CREATE INDEX sessions_user_name ON sessions (user_name)`,
+		},
+	},
+	{
+		version: 6,
+		statements: []string{
+			// everything from before there were polls goes in the default poll
+			// SQLite can't change a primary key, so the tables keyed by item are rebuilt with the poll in their keys
+			`CREATE TABLE polls (
+				name TEXT PRIMARY KEY,
+				description TEXT NOT NULL
+			)`,
+			`INSERT INTO polls (name, description) VALUES ('default', '')`,
+			`CREATE TABLE poll_items (
+				poll TEXT NOT NULL,
+				name TEXT NOT NULL,
+				description TEXT NOT NULL,
+				PRIMARY KEY (poll, name)
+			)`,
+			`INSERT INTO poll_items (poll, name, description) SELECT 'default', name, description FROM items`,
+			`DROP TABLE items`,
+			`ALTER TABLE poll_items RENAME TO items`,
+			`CREATE TABLE poll_user_scores (
+				user_name TEXT NOT NULL,
+				poll TEXT NOT NULL,
+				item_name TEXT NOT NULL,
+				rating INTEGER NOT NULL,
+				num_votes INTEGER NOT NULL,
+				PRIMARY KEY (user_name, poll, item_name)
+			)`,
+			`INSERT INTO poll_user_scores (user_name, poll, item_name, rating, num_votes)
+			SELECT user_name, 'default', item_name, rating, num_votes FROM user_scores`,
+			`DROP TABLE user_scores`,
+			`ALTER TABLE poll_user_scores RENAME TO user_scores`,
+			`CREATE TABLE poll_global_scores (
+				poll TEXT NOT NULL,
+				item_name TEXT NOT NULL,
+				rating INTEGER NOT NULL,
+				num_votes INTEGER NOT NULL,
+				PRIMARY KEY (poll, item_name)
+			)`,
+			`INSERT INTO poll_global_scores (poll, item_name, rating, num_votes)
+			SELECT 'default', item_name, rating, num_votes FROM global_scores`,
+			`DROP TABLE global_scores`,
+			`ALTER TABLE poll_global_scores RENAME TO global_scores`,
+			`CREATE INDEX global_scores_leaderboard ON global_scores (poll, rating DESC, item_name)`,
+		},
+	},
+	{
+		version: 7,
+		statements: []string{
+			// polls created before ownership have no owner and stay public
+			`ALTER TABLE polls ADD COLUMN owner TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE polls ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public'`,
+			`CREATE TABLE poll_members (
+				poll TEXT NOT NULL,
+				user_name TEXT NOT NULL,
+				PRIMARY KEY (poll, user_name)
+			)`,
+		},
+	},
+	{
+		version: 8,
+		statements: []string{
+			`ALTER TABLE items ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}'`,
+			`ALTER TABLE items ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		},
+	},
+	{
+		version: 9,
+		statements: []string{
+			// items from before there were IDs use their names, which is what their scores are already keyed by
+			`ALTER TABLE items ADD COLUMN id TEXT NOT NULL DEFAULT ''`,
+			`UPDATE items SET id = name`,
+			`CREATE UNIQUE INDEX items_id ON items (poll, id)`,
+			`ALTER TABLE user_scores RENAME COLUMN item_name TO item_id`,
+			`ALTER TABLE global_scores RENAME COLUMN item_name TO item_id`,
+		},
+	},
+	{
+		version: 10,
+		statements: []string{
+			// when the item was put in the trash, in Unix seconds, or NULL if it isn't there
+			`ALTER TABLE items ADD COLUMN deleted_at BIGINT`,
+		},
+	},
+	{
+		version: 11,
+		statements: []string{
+			`CREATE TABLE vote_events (
+				poll TEXT NOT NULL,
+				id TEXT NOT NULL,
+				user_name TEXT NOT NULL,
+				item1 TEXT NOT NULL,
+				item2 TEXT NOT NULL,
+				winner TEXT NOT NULL,
+				created_at BIGINT NOT NULL,
+				metadata TEXT NOT NULL,
+				PRIMARY KEY (poll, id)
+			)`,
+		},
+	},
+	{
+		version: 12,
+		statements: []string{
+			`ALTER TABLE items ADD COLUMN merged_from TEXT NOT NULL DEFAULT '[]'`,
+			// the shadow sets that rebuilt scores are written into before they replace the live ones
+			`CREATE TABLE user_score_rebuilds (
+				rebuild TEXT NOT NULL,
+				user_name TEXT NOT NULL,
+				poll TEXT NOT NULL,
+				item_id TEXT NOT NULL,
+				rating INTEGER NOT NULL,
+				num_votes INTEGER NOT NULL,
+				PRIMARY KEY (rebuild, user_name, poll, item_id)
+			)`,
+			`CREATE TABLE global_score_rebuilds (
+				rebuild TEXT NOT NULL,
+				poll TEXT NOT NULL,
+				item_id TEXT NOT NULL,
+				rating INTEGER NOT NULL,
+				num_votes INTEGER NOT NULL,
+				PRIMARY KEY (rebuild, poll, item_id)
+			)`,
+		},
+	},
+	{
+		version: 13,
+		statements: []string{
+			// for rating systems that track how certain a rating is
+			`ALTER TABLE user_scores ADD COLUMN deviation REAL NOT NULL DEFAULT 0`,
+			`ALTER TABLE user_scores ADD COLUMN volatility REAL NOT NULL DEFAULT 0`,
+			`ALTER TABLE global_scores ADD COLUMN deviation REAL NOT NULL DEFAULT 0`,
+			`ALTER TABLE global_scores ADD COLUMN volatility REAL NOT NULL DEFAULT 0`,
+			`ALTER TABLE user_score_rebuilds ADD COLUMN deviation REAL NOT NULL DEFAULT 0`,
+			`ALTER TABLE user_score_rebuilds ADD COLUMN volatility REAL NOT NULL DEFAULT 0`,
+			`ALTER TABLE global_score_rebuilds ADD COLUMN deviation REAL NOT NULL DEFAULT 0`,
+			`ALTER TABLE global_score_rebuilds ADD COLUMN volatility REAL NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version: 14,
+		statements: []string{
+			`CREATE TABLE fitted_rankings (
+				poll TEXT NOT NULL,
+				user_name TEXT NOT NULL,
+				fitted_at BIGINT NOT NULL,
+				last_event TEXT NOT NULL,
+				num_votes INTEGER NOT NULL,
+				scores TEXT NOT NULL,
+				PRIMARY KEY (poll, user_name)
+			)`,
+		},
+	},
+	{
+		version: 15,
+		statements: []string{
+			// so that an old refresh token can be told apart from one that was never issued
+			`ALTER TABLE sessions ADD COLUMN previous_refresh_hash TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 16,
+		statements: []string{
+			// in Unix nanoseconds, so that votes by an earlier account with the same name can be told apart; 0 for older users
+			`ALTER TABLE users ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version: 17,
+		statements: []string{
+			`ALTER TABLE polls ADD COLUMN invite_generation INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version: 18,
+		statements: []string{
+			// votes are recorded in the order of their IDs from now on, after the latest one so far (see nextVoteEventID)
+			`ALTER TABLE polls ADD COLUMN last_vote_event TEXT NOT NULL DEFAULT ''`,
+			`UPDATE polls SET last_vote_event = COALESCE((SELECT MAX(id) FROM vote_events WHERE vote_events.poll = polls.name), '')`,
+		},
+	},
+}
+
+// OpenSQLite opens (creating if needed) the SQLite database file at path and brings its schema up to date
+func OpenSQLite(path string) (Database, error) {
+	// immediate transactions take the write lock up front, so concurrent writers wait instead of failing
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return Database{}, err
+	}
+	err = migrate(db, sqliteMigrations)
+	if err != nil {
+		db.Close()
+		return Database{}, err
+	}
+	s := SQLStore{DB: db}
+	return Database{
+		Polls:          s,
+		PollMembers:    s,
+		Items:          s,
+		Users:          s,
+		UserScores:     s,
+		GlobalScores:   s,
+		Sessions:       s,
+		Votes:          s,
+		VoteEvents:     s,
+		ScoreRebuilds:  s,
+		FittedRankings: s,
+	}, nil
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// opens a new SQLite database in a file that's deleted after the test
+func openTestSQLite(t *testing.T) Database {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "ranker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Polls.(SQLStore).DB.Close() })
+	return db
+}
+
+// the versions recorded in schema_migrations, in order
+func appliedMigrations(t *testing.T, s SQLStore) []int {
+	t.Helper()
+	rows, err := s.DB.Query(`SELECT version FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+func testMigrations(t *testing.T, s SQLStore, migrations []migration) {
+	versions := appliedMigrations(t, s)
+	if len(versions) != len(migrations) {
+		t.Fatalf("%d migrations were applied, want %d", len(versions), len(migrations))
+	}
+	for i, m := range migrations {
+		if versions[i] != m.version {
+			t.Errorf("migration %d applied was version %d, want %d", i, versions[i], m.version)
+		}
+	}
+	// migrating a database that's up to date does nothing
+	err := migrate(s.DB, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again := appliedMigrations(t, s); len(again) != len(versions) {
+		t.Errorf("migrating again applied %d migrations, want none", len(again)-len(versions))
+	}
+	// the default poll is created by a migration
+	_, err = s.GetPoll(DEFAULT_POLL)
+	if err != nil {
+		t.Errorf("getting the default poll gave %v", err)
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranker.db")
+	db, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMigrations(t, db.Polls.(SQLStore), sqliteMigrations)
+	db.Polls.(SQLStore).DB.Close()
+
+	// and so does opening it again
+	db, err = OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Polls.(SQLStore).DB.Close()
+	if versions := appliedMigrations(t, db.Polls.(SQLStore)); len(versions) != len(sqliteMigrations) {
+		t.Errorf("%d migrations are recorded after opening the database again, want %d", len(versions), len(sqliteMigrations))
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, openTestSQLite(t))
+}
+
+// SQLite runs each placeholder through as it is
+func TestSQLiteBind(t *testing.T) {
+	query := `SELECT a FROM t WHERE b = ? AND c IN (?, ?)`
+	if got := (SQLStore{}).bind(query); got != query {
+		t.Errorf("bind gave %q, want the query unchanged", got)
+	}
+}
@@ -0,0 +1,202 @@
+package database
+
+import "time"
+
+// storage for polls, each of which has its own items and scores
+type PollStore interface {
+	// CreatePoll adds a new poll, failing with an AlreadyExistsError if the name is taken
+	CreatePoll(poll Poll) error
+	// PutPoll saves a poll's description, owner and visibility
+	PutPoll(poll Poll) error
+	GetPoll(name string) (Poll, error)
+	// RevokeInvites bumps a poll's invite generation, so that the invite codes created before stop working
+	RevokeInvites(name string) error
+	// PollsPage lists only the polls with the given visibility
+	PollsPage(visibility string, options PageOptions) ([]Poll, string, error)
+}
+
+// storage for the users who have joined each poll
+type PollMemberStore interface {
+	AddPollMember(poll, userName string) error
+	RemovePollMember(poll, userName string) error
+	IsPollMember(poll, userName string) (bool, error)
+	PollMembers(poll string, options PageOptions) ([]string, string, error)
+}
+
+// storage for the items that will be voted on, which are named uniquely within their poll
+type ItemStore interface {
+	// CreateItem adds a new item, failing with an AlreadyExistsError if the poll already has one with that name
+	// new items are never in the trash and nothing has been merged into them, so DeletedAt and MergedFrom aren't stored
+	CreateItem(item Item) error
+	// UpdateItem saves an edited item, currently named name, if its stored version is still item.Version,
+	// and bumps the version; otherwise it fails with a VersionMismatchError
+	// if item.Name is different, the item is renamed, failing with an AlreadyExistsError if the new name is taken
+	UpdateItem(name string, item Item) error
+	// GetItem, AllItems and ItemsPage leave out items in the trash
+	GetItem(poll, name string) (Item, error)
+	// DeleteItem deletes an item for good, whether or not it's in the trash
+	DeleteItem(poll, name string) error
+	AllItems(poll string) ([]Item, error)
+	ItemsPage(poll string, options PageOptions) ([]Item, string, error)
+	// GetTrashedItem and TrashedItemsPage only return items in the trash
+	GetTrashedItem(poll, name string) (Item, error)
+	TrashedItemsPage(poll string, options PageOptions) ([]Item, string, error)
+	// TrashedBefore returns the items in the trash of every poll that were put there before the given time
+	TrashedBefore(before time.Time) ([]Item, error)
+}
+
+// storage for registered users
+type UserStore interface {
+	// CreateUser adds a new user, failing with an AlreadyExistsError if the name is taken
+	CreateUser(user User) error
+	PutUser(user User) error
+	// SetUserRoles replaces only a user's roles, failing with a NotFoundError if the user doesn't exist,
+	// so that it can't undo a password change or bring back a deleted user
+	SetUserRoles(name string, roles []string) error
+	// SetUserPassword likewise replaces only a user's password hash
+	SetUserPassword(name string, passwordHash string) error
+	GetUser(name string) (User, error)
+	DeleteUser(name string) error
+	AllUsers() ([]User, error)
+	UsersPage(options PageOptions) ([]User, string, error)
+}
+
+// storage for each user's personal rating of each item
+type UserScoreStore interface {
+	PutUserScore(u UserScore) error
+	UpdateUserScore(u UserScore) error
+	GetUserScore(poll, itemID, userName string) (UserScore, error)
+	// GetUserScores returns all of a user's scores in a poll
+	GetUserScores(poll, userName string) ([]UserScore, error)
+}
+
+// storage for the aggregate rating of each item across all users
+type GlobalScoreStore interface {
+	PutGlobalScore(g GlobalScore) error
+	UpdateGlobalScore(g GlobalScore) error
+	GetGlobalScore(poll, itemID string) (GlobalScore, error)
+	Leaderboard(poll string, options LeaderboardOptions) ([]RankedScore, string, error)
+}
+
+// storage for login sessions
+type SessionStore interface {
+	PutSession(session Session) error
+	// expired sessions are reported as not found
+	GetSession(id string) (Session, error)
+	DeleteSession(id string) error
+	// ends all of a user's sessions except the one with id except
+	DeleteUserSessions(userName string, except string) error
+}
+
+// storage for the log of every vote cast, which is only ever added to, by VoteStore.RecordVote
+type VoteEventStore interface {
+	// VoteEventsPage lists a poll's vote events in the order they were cast; options.Prefix isn't used
+	VoteEventsPage(poll string, options PageOptions) ([]VoteEvent, string, error)
+}
+
+// storage for the shadow sets of scores that rebuilds of a poll's scores are written into before they replace the live ones
+// each rebuild has its own ID, so that rebuilds can't mix up each other's scores
+type ScoreRebuildStore interface {
+	// StageScores adds scores to a rebuild's shadow set, replacing any it already has for the same user or item
+	StageScores(poll, rebuild string, userScores []UserScore, globalScores []GlobalScore) error
+	// SwapScores replaces all of a poll's user and global scores with a rebuild's shadow set in one step,
+	// and deletes the shadow set, as long as the poll's latest vote event is still lastEvent (empty if it had none)
+	// otherwise it fails with a VersionMismatchError and keeps the shadow set, so the newer votes can be added to it
+	SwapScores(poll, rebuild, lastEvent string) error
+	// DiscardScores deletes a rebuild's shadow set without swapping it in
+	DiscardScores(rebuild string) error
+}
+
+// storage for the rankings fitted to a poll's whole vote log, which are replaced each time they're fitted again
+type FittedRankingStore interface {
+	// PutFittedRanking saves a ranking, replacing the one for the same poll and user
+	PutFittedRanking(ranking FittedRanking) error
+	// GetFittedRanking returns the latest ranking fitted to a user's votes, or to everyone's if userName is empty
+	GetFittedRanking(poll, userName string) (FittedRanking, error)
+	// DeleteUserFittedRankings deletes the rankings fitted to a user's votes in every poll
+	DeleteUserFittedRankings(userName string) error
+}
+
+// adjusts the scores involved in a single vote in place
+// scores that don't exist yet are passed in with a zero Standing
+type VoteUpdate func(userScore1, userScore2 *UserScore, globalScore1, globalScore2 *GlobalScore)
+
+// combines the standing of a score for an item that is being merged away with that of
+// the matching score for the item it's merged into
+// scores that don't exist yet for the item merged into are passed in with a zero Standing
+type ScoreMerge func(from, into Standing) Standing
+
+// takes a deleted user's votes out of the global score of one of the items they voted on, in place,
+// given their own score for that item
+type ScoreBackOut func(userScore UserScore, globalScore *GlobalScore)
+
+// records votes so that the user and global scores of both items change together,
+// and makes the other changes to items that their scores have to follow
+type VoteStore interface {
+	// RecordVote reads the scores of the items in a vote event for its user and globally,
+	// applies update to them, and saves the results along with the event
+	// votes in a poll are recorded one at a time, and the event's ID is moved past the poll's latest if it isn't later
+	// (see nextVoteEventID), so that a poll's events are recorded in the order of their IDs
+	// item1 and item2 are the items with the event's Item1 and Item2 IDs; the vote is only recorded if both
+	// still exist and are out of the trash when it is, and fails with a NotFoundError otherwise
+	RecordVote(event VoteEvent, item1, item2 Item, update VoteUpdate) error
+	// MergeItems folds every user and global score of from into the matching score of into, using merge,
+	// and then deletes from; both items must be in the same poll
+	MergeItems(from, into Item, merge ScoreMerge) error
+	// DeleteItemScores deletes every user and global score of the item with the given ID
+	DeleteItemScores(poll, itemID string) error
+	// DeleteUserScores deletes all of a user's scores, in every poll
+	// if backOut isn't nil, it is applied to the global scores of the items they voted on first,
+	// and global scores that are left with no votes are deleted
+	DeleteUserScores(userName string, backOut ScoreBackOut) error
+	// TrashItem puts an item in the trash, which also takes its global score off the leaderboard,
+	// failing with a NotFoundError if it's already there; its scores are kept in case it's restored
+	TrashItem(item Item, at time.Time) error
+	// RestoreItem takes an item back out of the trash, failing with a NotFoundError if it isn't there
+	RestoreItem(item Item) error
+}
+
+// make sure the DynamoDB tables satisfy the store interfaces
+var (
+	_ PollStore          = PollTable{}
+	_ PollMemberStore    = PollMemberTable{}
+	_ ItemStore          = ItemTable{}
+	_ UserStore          = UserTable{}
+	_ UserScoreStore     = DynamoScoreStore{}
+	_ GlobalScoreStore   = DynamoScoreStore{}
+	_ SessionStore       = SessionTable{}
+	_ VoteStore          = DynamoVoteStore{}
+	_ VoteEventStore     = VoteEventTable{}
+	_ ScoreRebuildStore  = DynamoVoteStore{}
+	_ FittedRankingStore = FittedRankingTable{}
+)
+
+// and the in-memory store
+var (
+	_ PollStore          = (*MemoryStore)(nil)
+	_ PollMemberStore    = (*MemoryStore)(nil)
+	_ ItemStore          = (*MemoryStore)(nil)
+	_ UserStore          = (*MemoryStore)(nil)
+	_ UserScoreStore     = (*MemoryStore)(nil)
+	_ GlobalScoreStore   = (*MemoryStore)(nil)
+	_ SessionStore       = (*MemoryStore)(nil)
+	_ VoteStore          = (*MemoryStore)(nil)
+	_ VoteEventStore     = (*MemoryStore)(nil)
+	_ ScoreRebuildStore  = (*MemoryStore)(nil)
+	_ FittedRankingStore = (*MemoryStore)(nil)
+)
+
+// and the SQL store
+var (
+	_ PollStore          = SQLStore{}
+	_ PollMemberStore    = SQLStore{}
+	_ ItemStore          = SQLStore{}
+	_ UserStore          = SQLStore{}
+	_ UserScoreStore     = SQLStore{}
+	_ GlobalScoreStore   = SQLStore{}
+	_ SessionStore       = SQLStore{}
+	_ VoteStore          = SQLStore{}
+	_ VoteEventStore     = SQLStore{}
+	_ ScoreRebuildStore  = SQLStore{}
+	_ FittedRankingStore = SQLStore{}
+)
@@ -0,0 +1,438 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// runs the store tests that every backend has to pass against db, each in a poll of its own
+func testStore(t *testing.T, db Database) {
+	t.Run("polls", func(t *testing.T) { testPolls(t, db) })
+	t.Run("items", func(t *testing.T) { testItems(t, db) })
+	t.Run("votes", func(t *testing.T) { testVotes(t, db) })
+	t.Run("merge", func(t *testing.T) { testMerge(t, db) })
+	t.Run("trash", func(t *testing.T) { testTrash(t, db) })
+	t.Run("rebuild", func(t *testing.T) { testRebuild(t, db) })
+}
+
+func createTestPoll(t *testing.T, db Database, name string) {
+	t.Helper()
+	err := db.Polls.CreatePoll(Poll{Name: name, Description: "a poll", Owner: "owner1", Visibility: "public"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// creates items in a poll, each with its name as its ID, and returns them
+func createTestItems(t *testing.T, db Database, poll string, names ...string) []Item {
+	t.Helper()
+	items := make([]Item, len(names))
+	for i, name := range names {
+		items[i] = Item{Poll: poll, ID: name + "-id", Name: name, Description: "about " + name, Metadata: map[string]string{}, Version: 1}
+		err := db.Items.CreateItem(items[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return items
+}
+
+// counts a vote for the first item, moving its ratings up and the second's down by 10
+func countVote(userScore1, userScore2 *UserScore, globalScore1, globalScore2 *GlobalScore) {
+	for _, s := range []*Standing{&userScore1.Standing, &userScore2.Standing, &globalScore1.Standing, &globalScore2.Standing} {
+		s.NumVotes++
+	}
+	userScore1.Rating += 10
+	globalScore1.Rating += 10
+	userScore2.Rating -= 10
+	globalScore2.Rating -= 10
+}
+
+// records a vote by user for winner over loser, and returns the ID it was recorded with
+func recordTestVote(t *testing.T, db Database, user string, winner, loser Item) string {
+	t.Helper()
+	id, err := NewVoteEventID(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := VoteEvent{ID: id, Poll: winner.Poll, UserName: user, Item1: winner.ID, Item2: loser.ID, Winner: winner.ID, Timestamp: time.Now(), Metadata: map[string]string{}}
+	err = db.Votes.RecordVote(event, winner, loser, countVote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _, err := db.VoteEvents.VoteEventsPage(winner.Poll, PageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events[len(events)-1].ID
+}
+
+// the item IDs on a poll's leaderboard, from the top
+func leaderboardIDs(t *testing.T, db Database, poll string) []string {
+	t.Helper()
+	scores, _, err := db.GlobalScores.Leaderboard(poll, LeaderboardOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for i, score := range scores {
+		if score.Rank != i+1 {
+			t.Errorf("%s is ranked %d at position %d", score.ItemID, score.Rank, i+1)
+		}
+		ids = append(ids, score.ItemID)
+	}
+	return ids
+}
+
+func testPolls(t *testing.T, db Database) {
+	createTestPoll(t, db, "polls")
+	err := db.Polls.CreatePoll(Poll{Name: "polls", Visibility: "public"})
+	if _, ok := err.(AlreadyExistsError); !ok {
+		t.Errorf("creating a poll twice gave %v, want an AlreadyExistsError", err)
+	}
+
+	poll, err := db.Polls.GetPoll("polls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Poll{Name: "polls", Description: "a poll", Owner: "owner1", Visibility: "public"}
+	if poll != want {
+		t.Errorf("poll is %+v, want %+v", poll, want)
+	}
+
+	want.Description = "edited"
+	want.Visibility = "private"
+	err = db.Polls.PutPoll(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Polls.RevokeInvites("polls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll, err = db.Polls.GetPoll("polls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.InviteGeneration = 1
+	if poll != want {
+		t.Errorf("poll is %+v after editing and revoking invites, want %+v", poll, want)
+	}
+
+	private, _, err := db.Polls.PollsPage("private", PageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(private) != 1 || private[0].Name != "polls" {
+		t.Errorf("private polls are %+v, want only polls", private)
+	}
+	if _, err := db.Polls.GetPoll("no-such-poll"); err == nil {
+		t.Error("got a poll that doesn't exist")
+	} else if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("getting a poll that doesn't exist gave %v, want a NotFoundError", err)
+	}
+}
+
+func testItems(t *testing.T, db Database) {
+	createTestPoll(t, db, "items")
+	items := createTestItems(t, db, "items", "apple", "banana", "cherry")
+	err := db.Items.CreateItem(items[0])
+	if _, ok := err.(AlreadyExistsError); !ok {
+		t.Errorf("creating an item twice gave %v, want an AlreadyExistsError", err)
+	}
+
+	edited := items[0]
+	edited.Description = "edited"
+	edited.Metadata = map[string]string{"color": "red"}
+	err = db.Items.UpdateItem("apple", edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := db.Items.GetItem("items", "apple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.ID != "apple-id" || item.Description != "edited" || !reflect.DeepEqual(item.Metadata, edited.Metadata) || item.Version != 2 {
+		t.Errorf("item is %+v after editing, want %+v at version 2", item, edited)
+	}
+	// an edit based on the copy from before the last one is refused
+	err = db.Items.UpdateItem("apple", edited)
+	if _, ok := err.(VersionMismatchError); !ok {
+		t.Errorf("editing an old copy gave %v, want a VersionMismatchError", err)
+	}
+
+	page, next, err := db.Items.ItemsPage("items", PageOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].Name != "apple" || page[1].Name != "banana" || next == "" {
+		t.Fatalf("first page is %+v with cursor %q, want apple and banana and a cursor", page, next)
+	}
+	page, next, err = db.Items.ItemsPage("items", PageOptions{Limit: 2, Cursor: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Name != "cherry" || next != "" {
+		t.Errorf("second page is %+v with cursor %q, want only cherry", page, next)
+	}
+}
+
+func testVotes(t *testing.T, db Database) {
+	createTestPoll(t, db, "votes")
+	items := createTestItems(t, db, "votes", "apple", "banana", "cherry")
+	apple, banana, cherry := items[0], items[1], items[2]
+	recordTestVote(t, db, "user1", apple, banana)
+	recordTestVote(t, db, "user1", apple, cherry)
+	recordTestVote(t, db, "user2", banana, cherry)
+
+	userScore, err := db.UserScores.GetUserScore("votes", apple.ID, "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := UserScore{Poll: "votes", ItemID: apple.ID, UserName: "user1", Standing: Standing{Rating: 20, NumVotes: 2}}
+	if userScore != want {
+		t.Errorf("user score is %+v, want %+v", userScore, want)
+	}
+	userScores, err := db.UserScores.GetUserScores("votes", "user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userScores) != 2 {
+		t.Errorf("user2 has scores %+v, want 2", userScores)
+	}
+	globalScore, err := db.GlobalScores.GetGlobalScore("votes", banana.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if globalScore.Rating != 0 || globalScore.NumVotes != 2 {
+		t.Errorf("banana's global score is %+v, want rating 0 from 2 votes", globalScore)
+	}
+	if _, err := db.UserScores.GetUserScore("votes", cherry.ID, "user3"); err == nil {
+		t.Error("got a score for a user who never voted")
+	} else if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("getting a score that doesn't exist gave %v, want a NotFoundError", err)
+	}
+
+	if got := leaderboardIDs(t, db, "votes"); !reflect.DeepEqual(got, []string{apple.ID, banana.ID, cherry.ID}) {
+		t.Errorf("leaderboard is %v, want apple, banana, cherry", got)
+	}
+	scores, next, err := db.GlobalScores.Leaderboard("votes", LeaderboardOptions{Limit: 1, MinVotes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores, _, err = db.GlobalScores.Leaderboard("votes", LeaderboardOptions{Limit: 1, MinVotes: 1, Cursor: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != 1 || scores[0].ItemID != banana.ID || scores[0].Rank != 2 {
+		t.Errorf("second page of the leaderboard is %+v, want banana ranked 2", scores)
+	}
+
+	events, _, err := db.VoteEvents.VoteEventsPage("votes", PageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[2].UserName != "user2" || events[2].Winner != banana.ID {
+		t.Errorf("vote log is %+v, want 3 events ending with user2's vote for banana", events)
+	}
+
+	// PutUserScore replaces whatever is there
+	want.Standing = Standing{Rating: 5, NumVotes: 1}
+	err = db.UserScores.PutUserScore(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userScore, err = db.UserScores.GetUserScore("votes", apple.ID, "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userScore != want {
+		t.Errorf("user score is %+v after replacing it, want %+v", userScore, want)
+	}
+}
+
+func testMerge(t *testing.T, db Database) {
+	createTestPoll(t, db, "merge")
+	items := createTestItems(t, db, "merge", "apple", "banana", "cherry")
+	apple, banana, cherry := items[0], items[1], items[2]
+	recordTestVote(t, db, "user1", apple, banana)
+	recordTestVote(t, db, "user1", cherry, banana)
+	recordTestVote(t, db, "user2", apple, banana)
+
+	sum := func(from, into Standing) Standing {
+		return Standing{Rating: from.Rating + into.Rating, NumVotes: from.NumVotes + into.NumVotes}
+	}
+	err := db.Votes.MergeItems(apple, cherry, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userScore, err := db.UserScores.GetUserScore("merge", cherry.ID, "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userScore.Rating != 20 || userScore.NumVotes != 2 {
+		t.Errorf("user1's merged score is %+v, want rating 20 from 2 votes", userScore)
+	}
+	// user2 had no score for cherry, so theirs is apple's
+	userScore, err = db.UserScores.GetUserScore("merge", cherry.ID, "user2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userScore.Rating != 10 || userScore.NumVotes != 1 {
+		t.Errorf("user2's merged score is %+v, want rating 10 from 1 vote", userScore)
+	}
+	globalScore, err := db.GlobalScores.GetGlobalScore("merge", cherry.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if globalScore.Rating != 30 || globalScore.NumVotes != 3 {
+		t.Errorf("merged global score is %+v, want rating 30 from 3 votes", globalScore)
+	}
+	if _, err := db.GlobalScores.GetGlobalScore("merge", apple.ID); err == nil {
+		t.Error("the merged item still has a global score")
+	}
+	if _, err := db.Items.GetItem("merge", "apple"); err == nil {
+		t.Error("the merged item still exists")
+	}
+	item, err := db.Items.GetItem("merge", "cherry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(item.MergedFrom, []string{apple.ID}) {
+		t.Errorf("cherry was merged from %v, want [%s]", item.MergedFrom, apple.ID)
+	}
+}
+
+func testTrash(t *testing.T, db Database) {
+	createTestPoll(t, db, "trash")
+	items := createTestItems(t, db, "trash", "apple", "banana")
+	apple, banana := items[0], items[1]
+	recordTestVote(t, db, "user1", apple, banana)
+
+	err := db.Votes.TrashItem(apple, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := leaderboardIDs(t, db, "trash"); !reflect.DeepEqual(got, []string{banana.ID}) {
+		t.Errorf("leaderboard is %v with apple in the trash, want only banana", got)
+	}
+	// the scores are kept in case the item comes back
+	if _, err := db.GlobalScores.GetGlobalScore("trash", apple.ID); err != nil {
+		t.Errorf("getting the global score of an item in the trash gave %v", err)
+	}
+	if _, err := db.Items.GetTrashedItem("trash", "apple"); err != nil {
+		t.Errorf("getting an item in the trash gave %v", err)
+	}
+	// votes on items that are in the trash or were never there are refused without touching any scores
+	before, err := db.GlobalScores.GetGlobalScore("trash", banana.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := Item{Poll: "trash", ID: "durian-id", Name: "durian"}
+	for _, voted := range [][2]Item{{banana, apple}, {banana, missing}} {
+		id, err := NewVoteEventID(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := VoteEvent{ID: id, Poll: "trash", UserName: "user1", Item1: voted[0].ID, Item2: voted[1].ID, Winner: voted[0].ID, Timestamp: time.Now(), Metadata: map[string]string{}}
+		err = db.Votes.RecordVote(event, voted[0], voted[1], countVote)
+		if _, ok := err.(NotFoundError); !ok {
+			t.Errorf("voting on %s gave %v, want a NotFoundError", voted[1].Name, err)
+		}
+	}
+	if after, _ := db.GlobalScores.GetGlobalScore("trash", banana.ID); after.Standing != before.Standing {
+		t.Errorf("refused votes changed banana's global score from %+v to %+v", before.Standing, after.Standing)
+	}
+	if events, _, _ := db.VoteEvents.VoteEventsPage("trash", PageOptions{}); len(events) != 1 {
+		t.Errorf("%d vote events were recorded, want only the one from before apple was trashed", len(events))
+	}
+	err = db.Votes.TrashItem(apple, time.Now())
+	if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("trashing an item twice gave %v, want a NotFoundError", err)
+	}
+
+	err = db.Votes.RestoreItem(apple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := leaderboardIDs(t, db, "trash"); !reflect.DeepEqual(got, []string{apple.ID, banana.ID}) {
+		t.Errorf("leaderboard is %v after restoring apple, want apple and banana", got)
+	}
+	err = db.Votes.RestoreItem(apple)
+	if _, ok := err.(NotFoundError); !ok {
+		t.Errorf("restoring an item that isn't in the trash gave %v, want a NotFoundError", err)
+	}
+}
+
+func testRebuild(t *testing.T, db Database) {
+	createTestPoll(t, db, "rebuild")
+	items := createTestItems(t, db, "rebuild", "apple", "banana", "cherry")
+	apple, banana, cherry := items[0], items[1], items[2]
+	recordTestVote(t, db, "user1", apple, banana)
+	lastEvent := recordTestVote(t, db, "user1", banana, cherry)
+
+	// staging a score again replaces it
+	stage := func(rating int) {
+		err := db.ScoreRebuilds.StageScores("rebuild", "rebuild1",
+			[]UserScore{{Poll: "rebuild", ItemID: cherry.ID, UserName: "user1", Standing: Standing{Rating: rating, NumVotes: 1}}},
+			[]GlobalScore{
+				{Poll: "rebuild", ItemID: cherry.ID, Standing: Standing{Rating: rating, NumVotes: 1}},
+				{Poll: "rebuild", ItemID: banana.ID, Standing: Standing{Rating: -rating, NumVotes: 1}},
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stage(50)
+	stage(100)
+	err := db.ScoreRebuilds.StageScores("rebuild", "rebuild2", nil, []GlobalScore{{Poll: "rebuild", ItemID: apple.ID, Standing: Standing{Rating: 999, NumVotes: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.ScoreRebuilds.SwapScores("rebuild", "rebuild1", "an-older-event")
+	if _, ok := err.(VersionMismatchError); !ok {
+		t.Errorf("swapping in scores that missed a vote gave %v, want a VersionMismatchError", err)
+	}
+	if got := leaderboardIDs(t, db, "rebuild"); !reflect.DeepEqual(got, []string{apple.ID, banana.ID, cherry.ID}) {
+		t.Errorf("leaderboard is %v after a failed swap, want it unchanged", got)
+	}
+
+	err = db.ScoreRebuilds.SwapScores("rebuild", "rebuild1", lastEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := leaderboardIDs(t, db, "rebuild"); !reflect.DeepEqual(got, []string{cherry.ID, banana.ID}) {
+		t.Errorf("leaderboard is %v after the swap, want only the rebuilt cherry and banana", got)
+	}
+	userScore, err := db.UserScores.GetUserScore("rebuild", cherry.ID, "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userScore.Rating != 100 {
+		t.Errorf("user score is %+v after the swap, want rating 100", userScore)
+	}
+	// scores that the rebuild didn't stage are gone
+	if _, err := db.UserScores.GetUserScore("rebuild", apple.ID, "user1"); err == nil {
+		t.Error("a user score the rebuild left out is still there")
+	}
+
+	err = db.ScoreRebuilds.DiscardScores("rebuild2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.ScoreRebuilds.SwapScores("rebuild", "rebuild2", lastEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := leaderboardIDs(t, db, "rebuild"); len(got) != 0 {
+		t.Errorf("leaderboard is %v after swapping in a discarded rebuild, want it empty", got)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryDatabase())
+}
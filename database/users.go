@@ -2,7 +2,10 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -12,10 +15,23 @@ import (
 type UserTable Table
 
 // a user who can vote on items
-// TODO: add fields for credentials
+// the password is stored as a bcrypt hash (or in plaintext for users who haven't logged in since hashing was added)
+// and is never included in API responses
+// CreatedAt tells the account apart from earlier ones with the same name that were deleted; it's zero for users from before it was kept
 type User struct {
-	Name     string `json:"name"`
-	Password string `json:"password"`
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"-"`
+	Roles        []string  `json:"roles"`
+	CreatedAt    time.Time `json:"-"`
+}
+
+// the roles of users who registered before there were roles: everyone could vote,
+// and whoever registered as "admin" was the administrator
+func legacyRoles(name string) []string {
+	if name == "admin" {
+		return []string{"voter", "admin"}
+	}
+	return []string{"voter"}
 }
 
 func CreateUserTable(client *dynamodb.Client) (UserTable, error) {
@@ -35,25 +51,75 @@ func CreateUserTable(client *dynamodb.Client) (UserTable, error) {
 		TableName:   aws.String("Users"),
 		BillingMode: types.BillingModePayPerRequest,
 	}
-	_, err := client.CreateTable(context.TODO(), input)
+	err := createTable(client, input)
 	if err != nil {
 		return UserTable{}, err
 	}
 	return UserTable{Name: "Users", Client: client}, nil
 }
 
+func (t UserTable) CreateUser(user User) error {
+	input := &dynamodb.PutItemInput{
+		Item:                     userToAttributes(user),
+		TableName:                aws.String(t.Name),
+		ConditionExpression:      aws.String("attribute_not_exists(#name)"),
+		ExpressionAttributeNames: map[string]string{"#name": "Name"},
+	}
+	_, err := t.Client.PutItem(context.TODO(), input)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return MakeAlreadyExistsError(fmt.Sprintf("a user named %s already exists", user.Name))
+	}
+	return err
+}
+
 func (t UserTable) PutUser(user User) error {
 	input := &dynamodb.PutItemInput{
-		Item: map[string]types.AttributeValue{
-			"Name":     &types.AttributeValueMemberS{Value: user.Name},
-			"Password": &types.AttributeValueMemberS{Value: user.Password},
-		},
+		Item:      userToAttributes(user),
 		TableName: aws.String(t.Name),
 	}
 	_, err := t.Client.PutItem(context.TODO(), input)
 	return err
 }
 
+func (t UserTable) SetUserRoles(name string, roles []string) error {
+	input := &dynamodb.UpdateItemInput{
+		Key: map[string]types.AttributeValue{
+			"Name": &types.AttributeValueMemberS{Value: name},
+		},
+		TableName:                 aws.String(t.Name),
+		UpdateExpression:          aws.String("SET Roles = :roles"),
+		ConditionExpression:       aws.String("attribute_exists(#name)"),
+		ExpressionAttributeNames:  map[string]string{"#name": "Name"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":roles": rolesToAttribute(roles)},
+	}
+	_, err := t.Client.UpdateItem(context.TODO(), input)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return MakeNotFoundError(fmt.Sprintf("No user found with name %s", name))
+	}
+	return err
+}
+
+func (t UserTable) SetUserPassword(name string, passwordHash string) error {
+	input := &dynamodb.UpdateItemInput{
+		Key: map[string]types.AttributeValue{
+			"Name": &types.AttributeValueMemberS{Value: name},
+		},
+		TableName:                 aws.String(t.Name),
+		UpdateExpression:          aws.String("SET Password = :password"),
+		ConditionExpression:       aws.String("attribute_exists(#name)"),
+		ExpressionAttributeNames:  map[string]string{"#name": "Name"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":password": &types.AttributeValueMemberS{Value: passwordHash}},
+	}
+	_, err := t.Client.UpdateItem(context.TODO(), input)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return MakeNotFoundError(fmt.Sprintf("No user found with name %s", name))
+	}
+	return err
+}
+
 func (t UserTable) GetUser(name string) (User, error) {
 	input := &dynamodb.GetItemInput{
 		Key: map[string]types.AttributeValue{
@@ -66,12 +132,9 @@ func (t UserTable) GetUser(name string) (User, error) {
 		return User{}, err
 	}
 	if len(output.Item) == 0 {
-		return User{}, fmt.Errorf("No user found with name %s", name)
+		return User{}, MakeNotFoundError(fmt.Sprintf("No user found with name %s", name))
 	}
-	return User{
-		Name:     output.Item["Name"].(*types.AttributeValueMemberS).Value,
-		Password: output.Item["Password"].(*types.AttributeValueMemberS).Value,
-	}, nil
+	return userFromAttributes(output.Item), nil
 }
 
 func (t UserTable) DeleteUser(name string) error {
@@ -89,16 +152,75 @@ func (t UserTable) AllUsers() ([]User, error) {
 	input := &dynamodb.ScanInput{
 		TableName: aws.String(t.Name),
 	}
-	output, err := t.Client.Scan(context.Background(), input)
-	if err != nil {
-		return nil, err
-	}
 	users := []User{}
-	for _, item := range output.Items {
-		users = append(users, User{
-			Name:     item["Name"].(*types.AttributeValueMemberS).Value,
-			Password: item["Password"].(*types.AttributeValueMemberS).Value,
-		})
+	paginator := dynamodb.NewScanPaginator(t.Client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range output.Items {
+			users = append(users, userFromAttributes(item))
+		}
 	}
 	return users, nil
 }
+
+// returns a page of users, in no particular order, and the cursor for the next page
+func (t UserTable) UsersPage(options PageOptions) ([]User, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(t.Name),
+	}
+	records, next, err := scanPage(Table(t), input, options)
+	if err != nil {
+		return nil, "", err
+	}
+	users := make([]User, len(records))
+	for i, item := range records {
+		users[i] = userFromAttributes(item)
+	}
+	return users, next, nil
+}
+
+// CreatedAt is stored in Unix nanoseconds, and only for users created since it was kept
+func userToAttributes(user User) map[string]types.AttributeValue {
+	attributes := map[string]types.AttributeValue{
+		"Name":     &types.AttributeValueMemberS{Value: user.Name},
+		"Password": &types.AttributeValueMemberS{Value: user.PasswordHash},
+		"Roles":    rolesToAttribute(user.Roles),
+	}
+	if !user.CreatedAt.IsZero() {
+		attributes["CreatedAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(user.CreatedAt.UnixNano(), 10)}
+	}
+	return attributes
+}
+
+func userFromAttributes(item map[string]types.AttributeValue) User {
+	user := User{
+		Name:         item["Name"].(*types.AttributeValueMemberS).Value,
+		PasswordHash: item["Password"].(*types.AttributeValueMemberS).Value,
+	}
+	if createdAt, ok := item["CreatedAt"].(*types.AttributeValueMemberN); ok {
+		nanos, _ := strconv.ParseInt(createdAt.Value, 10, 64)
+		user.CreatedAt = time.Unix(0, nanos)
+	}
+	roles, ok := item["Roles"].(*types.AttributeValueMemberL)
+	if !ok {
+		user.Roles = legacyRoles(user.Name)
+		return user
+	}
+	user.Roles = []string{}
+	for _, role := range roles.Value {
+		user.Roles = append(user.Roles, role.(*types.AttributeValueMemberS).Value)
+	}
+	return user
+}
+
+// roles are stored as a list rather than a string set, since sets can't be empty
+func rolesToAttribute(roles []string) types.AttributeValue {
+	values := []types.AttributeValue{}
+	for _, role := range roles {
+		values = append(values, &types.AttributeValueMemberS{Value: role})
+	}
+	return &types.AttributeValueMemberL{Value: values}
+}
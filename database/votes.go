@@ -2,22 +2,110 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
+// the score tables keep each generation of a poll's scores in a partition of its own (see scorePartition),
+// and the Poll of the scores their methods are given is the partition to use; scores read back have their poll's name
+// DynamoScoreStore works out which partition is in use
 type UserScoreTable Table
 
+// how an item stands according to some votes, in terms of whichever rating system the server uses
+// Deviation and Volatility are only used by rating systems that track how certain a rating is, and are 0 otherwise
+type Standing struct {
+	Rating     int     `json:"rating"`
+	NumVotes   int     `json:"numVotes"`
+	Deviation  float64 `json:"deviation,omitempty"`
+	Volatility float64 `json:"volatility,omitempty"`
+}
+
+// the attribute values for a standing, for use in update expressions like standingUpdate
+func standingValues(s Standing, values map[string]types.AttributeValue) map[string]types.AttributeValue {
+	values[":rating"] = &types.AttributeValueMemberN{Value: strconv.Itoa(s.Rating)}
+	values[":numVotes"] = &types.AttributeValueMemberN{Value: strconv.Itoa(s.NumVotes)}
+	values[":deviation"] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(s.Deviation, 'g', -1, 64)}
+	values[":volatility"] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(s.Volatility, 'g', -1, 64)}
+	return values
+}
+
+const standingUpdate = "Rating = :rating, NumVotes = :numVotes, Deviation = :deviation, Volatility = :volatility"
+
+// adds the attributes a standing is stored in to a record
+func standingAttributes(s Standing, item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	item["Rating"] = &types.AttributeValueMemberN{Value: strconv.Itoa(s.Rating)}
+	item["NumVotes"] = &types.AttributeValueMemberN{Value: strconv.Itoa(s.NumVotes)}
+	item["Deviation"] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(s.Deviation, 'g', -1, 64)}
+	item["Volatility"] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(s.Volatility, 'g', -1, 64)}
+	return item
+}
+
+// scores written before deviation and volatility were stored have neither, which reads as 0
+func standingFromAttributes(item map[string]types.AttributeValue) (Standing, error) {
+	var s Standing
+	var err error
+	s.Rating, err = strconv.Atoi(item["Rating"].(*types.AttributeValueMemberN).Value)
+	if err != nil {
+		return s, err
+	}
+	s.NumVotes, err = strconv.Atoi(item["NumVotes"].(*types.AttributeValueMemberN).Value)
+	if err != nil {
+		return s, err
+	}
+	if v, ok := item["Deviation"].(*types.AttributeValueMemberN); ok {
+		s.Deviation, err = strconv.ParseFloat(v.Value, 64)
+		if err != nil {
+			return s, err
+		}
+	}
+	if v, ok := item["Volatility"].(*types.AttributeValueMemberN); ok {
+		s.Volatility, err = strconv.ParseFloat(v.Value, 64)
+		if err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
 // a vote on an item
 type UserScore struct {
-	ItemName string `json:"itemName"`
+	Poll     string `json:"poll"`
+	ItemID   string `json:"itemId"`
 	UserName string `json:"userName"`
-	Rating   int    `json:"rating"`
-	NumVotes int    `json:"numVotes"`
+	Standing
+}
+
+// user scores are sorted by PollItem, which is the poll name and item ID joined by a #,
+// so that a user's scores in one poll can be read with a single Query
+// poll names can't contain a #, so a poll's prefix never matches another poll's scores
+// the item ID of a score is kept in its ItemName attribute, which is what scores were keyed by before items had IDs;
+// the IDs of those items are their names, so their scores didn't have to be rewritten
+func pollItem(poll, item string) string {
+	return poll + "#" + item
+}
+
+// the partition that the scores of a poll's generation are kept under: the poll's own name for the scores it had
+// before it was first rebuilt, and the name and generation joined by an @ for each rebuild's
+// poll names can't contain an @ either, so neither can be mistaken for another poll's
+func scorePartition(poll, generation string) string {
+	if generation == "" {
+		return poll
+	}
+	return poll + "@" + generation
+}
+
+// the poll and generation of a score partition
+func partitionPoll(partition string) (string, string) {
+	poll, generation, _ := strings.Cut(partition, "@")
+	return poll, generation
 }
 
 func CreateUserScoreTable(client *dynamodb.Client) (UserScoreTable, error) {
@@ -28,7 +116,7 @@ func CreateUserScoreTable(client *dynamodb.Client) (UserScoreTable, error) {
 				AttributeType: types.ScalarAttributeTypeS,
 			},
 			{
-				AttributeName: aws.String("ItemName"),
+				AttributeName: aws.String("PollItem"),
 				AttributeType: types.ScalarAttributeTypeS,
 			},
 		},
@@ -38,28 +126,35 @@ func CreateUserScoreTable(client *dynamodb.Client) (UserScoreTable, error) {
 				KeyType:       types.KeyTypeHash,
 			},
 			{
-				AttributeName: aws.String("ItemName"),
+				AttributeName: aws.String("PollItem"),
 				KeyType:       types.KeyTypeRange,
 			},
 		},
-		TableName:   aws.String("UserScores"),
+		TableName:   aws.String("PollUserScores"),
 		BillingMode: types.BillingModePayPerRequest,
 	}
-	_, err := client.CreateTable(context.TODO(), input)
+	err := createTable(client, input)
 	if err != nil {
 		return UserScoreTable{}, err
 	}
-	return UserScoreTable{Name: "UserScores", Client: client}, nil
+	return UserScoreTable{Name: "PollUserScores", Client: client}, nil
+}
+
+func userScoreKey(poll, itemID, userName string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"UserName": &types.AttributeValueMemberS{Value: userName},
+		"PollItem": &types.AttributeValueMemberS{Value: pollItem(poll, itemID)},
+	}
 }
 
 func (t UserScoreTable) PutUserScore(u UserScore) error {
 	input := &dynamodb.PutItemInput{
-		Item: map[string]types.AttributeValue{
-			"ItemName": &types.AttributeValueMemberS{Value: u.ItemName},
+		Item: standingAttributes(u.Standing, map[string]types.AttributeValue{
 			"UserName": &types.AttributeValueMemberS{Value: u.UserName},
-			"Rating":   &types.AttributeValueMemberN{Value: strconv.Itoa(u.Rating)},
-			"NumVotes": &types.AttributeValueMemberN{Value: strconv.Itoa(u.NumVotes)},
-		},
+			"PollItem": &types.AttributeValueMemberS{Value: pollItem(u.Poll, u.ItemID)},
+			"Poll":     &types.AttributeValueMemberS{Value: u.Poll},
+			"ItemName": &types.AttributeValueMemberS{Value: u.ItemID},
+		}),
 		TableName: aws.String(t.Name),
 	}
 	_, err := t.Client.PutItem(context.TODO(), input)
@@ -68,27 +163,23 @@ func (t UserScoreTable) PutUserScore(u UserScore) error {
 
 func (t UserScoreTable) UpdateUserScore(u UserScore) error {
 	input := &dynamodb.UpdateItemInput{
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":rating":   &types.AttributeValueMemberN{Value: strconv.Itoa(u.Rating)},
-			":numVotes": &types.AttributeValueMemberN{Value: strconv.Itoa(u.NumVotes)},
-		},
-		Key: map[string]types.AttributeValue{
-			"ItemName": &types.AttributeValueMemberS{Value: u.ItemName},
-			"UserName": &types.AttributeValueMemberS{Value: u.UserName},
-		},
-		TableName:        aws.String(t.Name),
-		UpdateExpression: aws.String("SET Rating = :rating, NumVotes = :numVotes"),
+		ExpressionAttributeValues: standingValues(u.Standing, map[string]types.AttributeValue{
+			":poll":   &types.AttributeValueMemberS{Value: u.Poll},
+			":itemID": &types.AttributeValueMemberS{Value: u.ItemID},
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+		}),
+		Key:       userScoreKey(u.Poll, u.ItemID, u.UserName),
+		TableName: aws.String(t.Name),
+		// bump the version so that concurrent votes on this score notice the change
+		UpdateExpression: aws.String("SET Poll = :poll, ItemName = :itemID, " + standingUpdate + " ADD Version :one"),
 	}
 	_, err := t.Client.UpdateItem(context.TODO(), input)
 	return err
 }
 
-func (t UserScoreTable) GetUserScore(itemName, userName string) (UserScore, error) {
+func (t UserScoreTable) GetUserScore(partition, itemID, userName string) (UserScore, error) {
 	input := &dynamodb.GetItemInput{
-		Key: map[string]types.AttributeValue{
-			"ItemName": &types.AttributeValueMemberS{Value: itemName},
-			"UserName": &types.AttributeValueMemberS{Value: userName},
-		},
+		Key:       userScoreKey(partition, itemID, userName),
 		TableName: aws.String(t.Name),
 	}
 	output, err := t.Client.GetItem(context.TODO(), input)
@@ -96,95 +187,147 @@ func (t UserScoreTable) GetUserScore(itemName, userName string) (UserScore, erro
 		return UserScore{}, err
 	}
 	if output.Item == nil {
-		return UserScore{}, MakeNotFoundError(fmt.Sprintf("no user score found for item %s and user %s", itemName, userName))
-	}
-	rating, err := strconv.Atoi(output.Item["Rating"].(*types.AttributeValueMemberN).Value)
-	if err != nil {
-		return UserScore{}, err
-	}
-	numVotes, err := strconv.Atoi(output.Item["NumVotes"].(*types.AttributeValueMemberN).Value)
-	if err != nil {
-		return UserScore{}, err
+		poll, _ := partitionPoll(partition)
+		return UserScore{}, MakeNotFoundError(fmt.Sprintf("no user score found for item %s and user %s in poll %s", itemID, userName, poll))
 	}
-	return UserScore{
-		ItemName: output.Item["ItemName"].(*types.AttributeValueMemberS).Value,
-		UserName: output.Item["UserName"].(*types.AttributeValueMemberS).Value,
-		Rating:   rating,
-		NumVotes: numVotes,
-	}, nil
+	return userScoreFromAttributes(output.Item)
 }
 
-func (t UserScoreTable) GetUserScores(userName string) ([]UserScore, error) {
+func (t UserScoreTable) GetUserScores(partition, userName string) ([]UserScore, error) {
 	input := &dynamodb.QueryInput{
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":userName": &types.AttributeValueMemberS{Value: userName},
+			":poll":     &types.AttributeValueMemberS{Value: pollItem(partition, "")},
 		},
-		KeyConditionExpression: aws.String("UserName = :userName"),
+		KeyConditionExpression: aws.String("UserName = :userName AND begins_with(PollItem, :poll)"),
 		TableName:              aws.String(t.Name),
 	}
-	output, err := t.Client.Query(context.TODO(), input)
-	if err != nil {
-		return nil, err
-	}
 	var ratings []UserScore
-	for _, item := range output.Items {
-		rating, err := strconv.Atoi(item["Rating"].(*types.AttributeValueMemberN).Value)
+	paginator := dynamodb.NewQueryPaginator(t.Client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
 		if err != nil {
 			return nil, err
 		}
-		numVotes, err := strconv.Atoi(item["NumVotes"].(*types.AttributeValueMemberN).Value)
-		if err != nil {
-			return nil, err
+		for _, item := range output.Items {
+			userScore, err := userScoreFromAttributes(item)
+			if err != nil {
+				return nil, err
+			}
+			ratings = append(ratings, userScore)
 		}
-		ratings = append(ratings, UserScore{
-			ItemName: item["ItemName"].(*types.AttributeValueMemberS).Value,
-			UserName: item["UserName"].(*types.AttributeValueMemberS).Value,
-			Rating:   rating,
-			NumVotes: numVotes,
-		})
 	}
 	return ratings, nil
 }
 
+func userScoreFromAttributes(item map[string]types.AttributeValue) (UserScore, error) {
+	standing, err := standingFromAttributes(item)
+	if err != nil {
+		return UserScore{}, err
+	}
+	poll, _ := partitionPoll(item["Poll"].(*types.AttributeValueMemberS).Value)
+	return UserScore{
+		Poll:     poll,
+		ItemID:   item["ItemName"].(*types.AttributeValueMemberS).Value,
+		UserName: item["UserName"].(*types.AttributeValueMemberS).Value,
+		Standing: standing,
+	}, nil
+}
+
 type GlobalScoreTable Table
 
 type GlobalScore struct {
-	ItemName string `json:"itemName"`
-	Rating   int    `json:"rating"`
-	NumVotes int    `json:"numVotes"`
+	Poll   string `json:"poll"`
+	ItemID string `json:"itemId"`
+	Standing
+}
+
+// a global score along with its position on the leaderboard, counting from 1
+type RankedScore struct {
+	GlobalScore
+	Rank int `json:"rank"`
 }
 
+// which part of the leaderboard to return
+type LeaderboardOptions struct {
+	// the maximum number of results; zero or less means no maximum
+	Limit int
+	// where to continue from, as returned along with the previous page; empty for the first page
+	Cursor string
+	// leave out items with fewer votes than this
+	MinVotes int
+}
+
+// global scores are kept sorted by rating in a secondary index partitioned by poll,
+// so a single Query reads a poll's whole leaderboard in order
+// the global scores of items in the trash are marked with a Trashed attribute, which keeps them off it
+const leaderboardIndex = "LeaderboardIndex"
+
 func CreateGlobalScoreTable(client *dynamodb.Client) (GlobalScoreTable, error) {
 	input := &dynamodb.CreateTableInput{
 		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("Poll"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
 			{
 				AttributeName: aws.String("ItemName"),
 				AttributeType: types.ScalarAttributeTypeS,
 			},
+			{
+				AttributeName: aws.String("Rating"),
+				AttributeType: types.ScalarAttributeTypeN,
+			},
 		},
 		KeySchema: []types.KeySchemaElement{
 			{
-				AttributeName: aws.String("ItemName"),
+				AttributeName: aws.String("Poll"),
 				KeyType:       types.KeyTypeHash,
 			},
+			{
+				AttributeName: aws.String("ItemName"),
+				KeyType:       types.KeyTypeRange,
+			},
 		},
-		TableName:   aws.String("GlobalScores"),
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(leaderboardIndex),
+				KeySchema: []types.KeySchemaElement{
+					{
+						AttributeName: aws.String("Poll"),
+						KeyType:       types.KeyTypeHash,
+					},
+					{
+						AttributeName: aws.String("Rating"),
+						KeyType:       types.KeyTypeRange,
+					},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+		TableName:   aws.String("PollGlobalScores"),
 		BillingMode: types.BillingModePayPerRequest,
 	}
-	_, err := client.CreateTable(context.TODO(), input)
+	err := createTable(client, input)
 	if err != nil {
 		return GlobalScoreTable{}, err
 	}
-	return GlobalScoreTable{Name: "GlobalScores", Client: client}, nil
+	return GlobalScoreTable{Name: "PollGlobalScores", Client: client}, nil
+}
+
+func globalScoreKey(poll, itemID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Poll":     &types.AttributeValueMemberS{Value: poll},
+		"ItemName": &types.AttributeValueMemberS{Value: itemID},
+	}
 }
 
 func (t GlobalScoreTable) PutGlobalScore(g GlobalScore) error {
 	input := &dynamodb.PutItemInput{
-		Item: map[string]types.AttributeValue{
-			"ItemName": &types.AttributeValueMemberS{Value: g.ItemName},
-			"Rating":   &types.AttributeValueMemberN{Value: strconv.Itoa(g.Rating)},
-			"NumVotes": &types.AttributeValueMemberN{Value: strconv.Itoa(g.NumVotes)},
-		},
+		Item: standingAttributes(g.Standing, map[string]types.AttributeValue{
+			"Poll":     &types.AttributeValueMemberS{Value: g.Poll},
+			"ItemName": &types.AttributeValueMemberS{Value: g.ItemID},
+		}),
 		TableName: aws.String(t.Name),
 	}
 	_, err := t.Client.PutItem(context.TODO(), input)
@@ -193,25 +336,21 @@ func (t GlobalScoreTable) PutGlobalScore(g GlobalScore) error {
 
 func (t GlobalScoreTable) UpdateGlobalScore(g GlobalScore) error {
 	input := &dynamodb.UpdateItemInput{
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":rating":   &types.AttributeValueMemberN{Value: strconv.Itoa(g.Rating)},
-			":numVotes": &types.AttributeValueMemberN{Value: strconv.Itoa(g.NumVotes)},
-		},
-		Key: map[string]types.AttributeValue{
-			"ItemName": &types.AttributeValueMemberS{Value: g.ItemName},
-		},
-		TableName:        aws.String(t.Name),
-		UpdateExpression: aws.String("set Rating = :rating, NumVotes = :numVotes"),
+		ExpressionAttributeValues: standingValues(g.Standing, map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		}),
+		Key:       globalScoreKey(g.Poll, g.ItemID),
+		TableName: aws.String(t.Name),
+		// bump the version so that concurrent votes on this score notice the change
+		UpdateExpression: aws.String("set " + standingUpdate + " ADD Version :one"),
 	}
 	_, err := t.Client.UpdateItem(context.TODO(), input)
 	return err
 }
 
-func (t GlobalScoreTable) GetGlobalScore(itemName string) (GlobalScore, error) {
+func (t GlobalScoreTable) GetGlobalScore(partition, itemID string) (GlobalScore, error) {
 	input := &dynamodb.GetItemInput{
-		Key: map[string]types.AttributeValue{
-			"ItemName": &types.AttributeValueMemberS{Value: itemName},
-		},
+		Key:       globalScoreKey(partition, itemID),
 		TableName: aws.String(t.Name),
 	}
 	output, err := t.Client.GetItem(context.TODO(), input)
@@ -219,19 +358,607 @@ func (t GlobalScoreTable) GetGlobalScore(itemName string) (GlobalScore, error) {
 		return GlobalScore{}, err
 	}
 	if output.Item == nil {
-		return GlobalScore{}, MakeNotFoundError(fmt.Sprintf("no global score found for item %s", itemName))
+		poll, _ := partitionPoll(partition)
+		return GlobalScore{}, MakeNotFoundError(fmt.Sprintf("no global score found for item %s in poll %s", itemID, poll))
 	}
-	rating, err := strconv.Atoi(output.Item["Rating"].(*types.AttributeValueMemberN).Value)
-	if err != nil {
-		return GlobalScore{}, err
-	}
-	numVotes, err := strconv.Atoi(output.Item["NumVotes"].(*types.AttributeValueMemberN).Value)
+	return globalScoreFromAttributes(output.Item)
+}
+
+func globalScoreFromAttributes(item map[string]types.AttributeValue) (GlobalScore, error) {
+	standing, err := standingFromAttributes(item)
 	if err != nil {
 		return GlobalScore{}, err
 	}
+	poll, _ := partitionPoll(item["Poll"].(*types.AttributeValueMemberS).Value)
 	return GlobalScore{
-		ItemName: output.Item["ItemName"].(*types.AttributeValueMemberS).Value,
-		Rating:   rating,
-		NumVotes: numVotes,
+		Poll:     poll,
+		ItemID:   item["ItemName"].(*types.AttributeValueMemberS).Value,
+		Standing: standing,
 	}, nil
 }
+
+// the position in the leaderboard index to continue from, and the rank of the score there
+type leaderboardCursor struct {
+	Key  map[string]dynamoKeyValue `json:"key"`
+	Rank int                       `json:"rank"`
+}
+
+// returns a poll's global scores from highest to lowest rating, and the cursor for the next page
+func (t GlobalScoreTable) Leaderboard(partition string, options LeaderboardOptions) ([]RankedScore, string, error) {
+	cursor := leaderboardCursor{}
+	if options.Cursor != "" {
+		if err := decodeCursor(options.Cursor, &cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	startKey, err := dynamoKeyFromValues(cursor.Key)
+	if err != nil {
+		return nil, "", err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(t.Name),
+		IndexName:              aws.String(leaderboardIndex),
+		KeyConditionExpression: aws.String("Poll = :poll"),
+		FilterExpression:       aws.String("NumVotes >= :minVotes AND attribute_not_exists(Trashed)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":poll":     &types.AttributeValueMemberS{Value: partition},
+			":minVotes": &types.AttributeValueMemberN{Value: strconv.Itoa(options.MinVotes)},
+		},
+		ScanIndexForward:  aws.Bool(false),
+		ExclusiveStartKey: startKey,
+	}
+	scores := []RankedScore{}
+	for {
+		// the filter runs after Limit is applied, so keep querying until the page is full
+		if options.Limit > 0 {
+			input.Limit = aws.Int32(int32(options.Limit - len(scores)))
+		}
+		output, err := t.Client.Query(context.TODO(), input)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, item := range output.Items {
+			globalScore, err := globalScoreFromAttributes(item)
+			if err != nil {
+				return nil, "", err
+			}
+			scores = append(scores, RankedScore{GlobalScore: globalScore, Rank: cursor.Rank + len(scores) + 1})
+		}
+		if output.LastEvaluatedKey == nil {
+			return scores, "", nil
+		}
+		if options.Limit > 0 && len(scores) >= options.Limit {
+			next, err := encodeCursor(leaderboardCursor{
+				Key:  dynamoKeyValues(output.LastEvaluatedKey),
+				Rank: scores[len(scores)-1].Rank,
+			})
+			return scores, next, err
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
+// how many times to try a vote before giving up when other votes keep changing the same scores
+const maxVoteAttempts = 8
+
+// records votes in DynamoDB with optimistic concurrency
+// every score carries a Version attribute; the four score updates of a vote are written in one transaction,
+// along with the vote's event, that only succeeds if none of the versions changed since they were read,
+// and is retried otherwise
+// the transaction also records the event as its poll's latest, if that and the poll's generation of scores haven't changed either,
+// so votes in the same poll are written one at a time, and never to scores that a rebuild has swapped out
+type DynamoVoteStore struct {
+	Polls        PollTable
+	Items        ItemTable
+	UserScores   UserScoreTable
+	GlobalScores GlobalScoreTable
+	VoteEvents   VoteEventTable
+}
+
+// an error that means the vote should be tried again with fresh scores
+func isTransactionConflict(err error) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		var conflict *types.TransactionConflictException
+		return errors.As(err, &conflict)
+	}
+	for _, reason := range canceled.CancellationReasons {
+		if reason.Code == nil {
+			continue
+		}
+		if *reason.Code == "ConditionalCheckFailed" || *reason.Code == "TransactionConflict" {
+			return true
+		}
+	}
+	return false
+}
+
+// runs attempt until it doesn't fail with a transaction conflict, up to maxVoteAttempts times
+func retryConflicts(what string, attempt func() error) error {
+	var err error
+	for i := 0; i < maxVoteAttempts; i++ {
+		if i > 0 {
+			// back off with jitter so that competing votes don't collide again
+			time.Sleep(time.Duration(rand.Intn(10*(1<<i))) * time.Millisecond)
+		}
+		err = attempt()
+		if err == nil || !isTransactionConflict(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("gave up %s after %d conflicting attempts: %v", what, maxVoteAttempts, err)
+}
+
+// reads the Version attribute of a score, which is zero for scores that don't exist or predate versioning
+func itemVersion(item map[string]types.AttributeValue) (int, error) {
+	v, ok := item["Version"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(v.Value)
+}
+
+// the condition for writing a score whose version is still the one that was read, and the values it uses
+func scoreVersionCondition(version int, values map[string]types.AttributeValue) string {
+	if version == 0 {
+		return "attribute_not_exists(Version)"
+	}
+	values[":version"] = &types.AttributeValueMemberN{Value: strconv.Itoa(version)}
+	return "Version = :version"
+}
+
+// an update to a single score that only applies if its version is still the one that was read
+func versionedUpdate(tableName string, key map[string]types.AttributeValue, standing Standing, version int) types.TransactWriteItem {
+	values := standingValues(standing, map[string]types.AttributeValue{
+		":newVersion": &types.AttributeValueMemberN{Value: strconv.Itoa(version + 1)},
+	})
+	condition := scoreVersionCondition(version, values)
+	return types.TransactWriteItem{
+		Update: &types.Update{
+			Key:                       key,
+			TableName:                 aws.String(tableName),
+			UpdateExpression:          aws.String("SET " + standingUpdate + ", Version = :newVersion"),
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeValues: values,
+		},
+	}
+}
+
+// deletes a single score if its version is still the one that was read
+func versionedDelete(tableName string, key map[string]types.AttributeValue, version int) types.TransactWriteItem {
+	values := map[string]types.AttributeValue{}
+	condition := scoreVersionCondition(version, values)
+	if len(values) == 0 {
+		values = nil
+	}
+	return types.TransactWriteItem{
+		Delete: &types.Delete{
+			Key:                       key,
+			TableName:                 aws.String(tableName),
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeValues: values,
+		},
+	}
+}
+
+// the poll and item ID of a user score aren't part of its key, so updates that might create it have to write them out too
+func withItem(write types.TransactWriteItem, poll, itemID string) types.TransactWriteItem {
+	write.Update.UpdateExpression = aws.String(*write.Update.UpdateExpression + ", Poll = :poll, ItemName = :itemID")
+	write.Update.ExpressionAttributeValues[":poll"] = &types.AttributeValueMemberS{Value: poll}
+	write.Update.ExpressionAttributeValues[":itemID"] = &types.AttributeValueMemberS{Value: itemID}
+	return write
+}
+
+func (s DynamoVoteStore) RecordVote(event VoteEvent, item1, item2 Item, update VoteUpdate) error {
+	return retryConflicts("recording vote", func() error {
+		return s.tryRecordVote(event, item1, item2, update)
+	})
+}
+
+func (s DynamoVoteStore) tryRecordVote(event VoteEvent, votedItem1, votedItem2 Item, update VoteUpdate) error {
+	poll, user, item1, item2 := event.Poll, event.UserName, event.Item1, event.Item2
+	generation, err := s.Polls.getScoreGeneration(poll)
+	if err != nil {
+		return err
+	}
+	partition := scorePartition(poll, generation)
+	keys := []types.TransactGetItem{
+		{Get: &types.Get{TableName: aws.String(s.UserScores.Name), Key: userScoreKey(partition, item1, user)}},
+		{Get: &types.Get{TableName: aws.String(s.UserScores.Name), Key: userScoreKey(partition, item2, user)}},
+		{Get: &types.Get{TableName: aws.String(s.GlobalScores.Name), Key: globalScoreKey(partition, item1)}},
+		{Get: &types.Get{TableName: aws.String(s.GlobalScores.Name), Key: globalScoreKey(partition, item2)}},
+		{Get: &types.Get{TableName: aws.String(s.Polls.Name), Key: pollKey(poll)}},
+	}
+	output, err := s.UserScores.Client.TransactGetItems(context.TODO(), &dynamodb.TransactGetItemsInput{TransactItems: keys})
+	if err != nil {
+		return err
+	}
+
+	pollRecord := output.Responses[4].Item
+	if pollRecord == nil {
+		return MakeNotFoundError(fmt.Sprintf("no poll found with name %s", poll))
+	}
+	latest := lastVoteEvent(pollRecord)
+	event.ID, err = nextVoteEventID(latest, event.ID)
+	if err != nil {
+		return err
+	}
+
+	versions := make([]int, 4)
+	userScores := []UserScore{{Poll: poll, ItemID: item1, UserName: user}, {Poll: poll, ItemID: item2, UserName: user}}
+	globalScores := []GlobalScore{{Poll: poll, ItemID: item1}, {Poll: poll, ItemID: item2}}
+	for i, response := range output.Responses[:4] {
+		if response.Item == nil {
+			continue
+		}
+		versions[i], err = itemVersion(response.Item)
+		if err != nil {
+			return err
+		}
+		if i < 2 {
+			userScores[i], err = userScoreFromAttributes(response.Item)
+		} else {
+			globalScores[i-2], err = globalScoreFromAttributes(response.Item)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	update(&userScores[0], &userScores[1], &globalScores[0], &globalScores[1])
+
+	writes := []types.TransactWriteItem{
+		withItem(versionedUpdate(s.UserScores.Name, userScoreKey(partition, item1, user), userScores[0].Standing, versions[0]), partition, item1),
+		withItem(versionedUpdate(s.UserScores.Name, userScoreKey(partition, item2, user), userScores[1].Standing, versions[1]), partition, item2),
+		versionedUpdate(s.GlobalScores.Name, globalScoreKey(partition, item1), globalScores[0].Standing, versions[2]),
+		versionedUpdate(s.GlobalScores.Name, globalScoreKey(partition, item2), globalScores[1].Standing, versions[3]),
+		s.VoteEvents.putVoteEvent(event),
+		s.Polls.setLastVoteEvent(poll, generation, latest, event.ID),
+		s.Items.checkVotable(votedItem1),
+		s.Items.checkVotable(votedItem2),
+	}
+	_, err = s.UserScores.Client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	// an item that's gone or in the trash won't come back by trying again, unlike a score that changed
+	for i, voted := range []Item{votedItem1, votedItem2} {
+		if checkFailed(err, len(writes)-2+i) {
+			return MakeNotFoundError(fmt.Sprintf("no item found with name %s in poll %s", voted.Name, poll))
+		}
+	}
+	return err
+}
+
+// whether err is a canceled transaction whose write at index failed its condition
+func checkFailed(err error, index int) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) || index >= len(canceled.CancellationReasons) {
+		return false
+	}
+	code := canceled.CancellationReasons[index].Code
+	return code != nil && *code == "ConditionalCheckFailed"
+}
+
+// MergeItems moves the scores over one at a time, each in its own transaction, and deletes the item last,
+// so a merge that fails part way through can simply be run again
+func (s DynamoVoteStore) MergeItems(from, into Item, merge ScoreMerge) error {
+	generation, err := s.Polls.getScoreGeneration(from.Poll)
+	if err != nil {
+		return err
+	}
+	partition := scorePartition(from.Poll, generation)
+	err = s.eachItemUserScore(partition, from.ID, func(user string) error {
+		return retryConflicts("merging user score", func() error {
+			return s.tryMergeScore(s.UserScores.Name, userScoreKey(partition, from.ID, user), userScoreKey(partition, into.ID, user), merge, func(write types.TransactWriteItem) types.TransactWriteItem {
+				return withItem(write, partition, into.ID)
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	err = retryConflicts("merging global score", func() error {
+		return s.tryMergeScore(s.GlobalScores.Name, globalScoreKey(partition, from.ID), globalScoreKey(partition, into.ID), merge, nil)
+	})
+	if err != nil {
+		return err
+	}
+	return s.Items.recordMerge(from, into)
+}
+
+// folds the score at fromKey into the score at intoKey and deletes it, if neither has changed since they were read
+// complete adds whatever else the update of the score at intoKey needs to write
+func (s DynamoVoteStore) tryMergeScore(tableName string, fromKey, intoKey map[string]types.AttributeValue, merge ScoreMerge, complete func(types.TransactWriteItem) types.TransactWriteItem) error {
+	keys := []types.TransactGetItem{
+		{Get: &types.Get{TableName: aws.String(tableName), Key: fromKey}},
+		{Get: &types.Get{TableName: aws.String(tableName), Key: intoKey}},
+	}
+	output, err := s.UserScores.Client.TransactGetItems(context.TODO(), &dynamodb.TransactGetItemsInput{TransactItems: keys})
+	if err != nil {
+		return err
+	}
+	if output.Responses[0].Item == nil {
+		// already merged by an earlier attempt
+		return nil
+	}
+	var standings [2]Standing
+	var versions [2]int
+	for i, response := range output.Responses {
+		if response.Item == nil {
+			continue
+		}
+		standings[i], err = standingFromAttributes(response.Item)
+		if err != nil {
+			return err
+		}
+		versions[i], err = itemVersion(response.Item)
+		if err != nil {
+			return err
+		}
+	}
+
+	update := versionedUpdate(tableName, intoKey, merge(standings[0], standings[1]), versions[1])
+	if complete != nil {
+		update = complete(update)
+	}
+	writes := []types.TransactWriteItem{update, versionedDelete(tableName, fromKey, versions[0])}
+	_, err = s.UserScores.Client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	return err
+}
+
+// calls each with the name of every user who has a score for the item in a score partition
+func (s DynamoVoteStore) eachItemUserScore(partition, itemID string, each func(user string) error) error {
+	// user scores are partitioned by user, so finding every user's score for an item takes a scan
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(s.UserScores.Name),
+		FilterExpression: aws.String("Poll = :poll AND ItemName = :itemID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":poll":   &types.AttributeValueMemberS{Value: partition},
+			":itemID": &types.AttributeValueMemberS{Value: itemID},
+		},
+	}
+	paginator := dynamodb.NewScanPaginator(s.UserScores.Client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			err = each(item["UserName"].(*types.AttributeValueMemberS).Value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s DynamoVoteStore) DeleteItemScores(poll, itemID string) error {
+	generation, err := s.Polls.getScoreGeneration(poll)
+	if err != nil {
+		return err
+	}
+	partition := scorePartition(poll, generation)
+	err = s.eachItemUserScore(partition, itemID, func(user string) error {
+		_, err := s.UserScores.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+			Key:       userScoreKey(partition, itemID, user),
+			TableName: aws.String(s.UserScores.Name),
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.GlobalScores.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		Key:       globalScoreKey(partition, itemID),
+		TableName: aws.String(s.GlobalScores.Name),
+	})
+	return err
+}
+
+// DeleteUserScores deletes the scores one at a time, each along with its back out in its own transaction,
+// so a deletion that fails part way through can simply be run again
+// scores of generations that aren't in use in their poll, which rebuilds are still staging or haven't cleaned up yet,
+// are deleted without being backed out
+func (s DynamoVoteStore) DeleteUserScores(userName string, backOut ScoreBackOut) error {
+	generations := map[string]string{}
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userName": &types.AttributeValueMemberS{Value: userName},
+		},
+		KeyConditionExpression: aws.String("UserName = :userName"),
+		TableName:              aws.String(s.UserScores.Name),
+	}
+	paginator := dynamodb.NewQueryPaginator(s.UserScores.Client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return err
+		}
+		for _, item := range output.Items {
+			userScore, err := userScoreFromAttributes(item)
+			if err != nil {
+				return err
+			}
+			partition := item["Poll"].(*types.AttributeValueMemberS).Value
+			_, generation := partitionPoll(partition)
+			inUse, ok := generations[userScore.Poll]
+			if !ok {
+				inUse, err = s.Polls.getScoreGeneration(userScore.Poll)
+				if err != nil {
+					return err
+				}
+				generations[userScore.Poll] = inUse
+			}
+			if backOut == nil || generation != inUse {
+				_, err = s.UserScores.Client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+					Key:       userScoreKey(partition, userScore.ItemID, userName),
+					TableName: aws.String(s.UserScores.Name),
+				})
+			} else {
+				err = retryConflicts("backing out user score", func() error {
+					return s.tryBackOutScore(partition, userScore.ItemID, userName, backOut)
+				})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applies backOut to the global score of the item and deletes the user's score, if neither has changed since they were read
+func (s DynamoVoteStore) tryBackOutScore(partition, itemID, userName string, backOut ScoreBackOut) error {
+	userKey, globalKey := userScoreKey(partition, itemID, userName), globalScoreKey(partition, itemID)
+	keys := []types.TransactGetItem{
+		{Get: &types.Get{TableName: aws.String(s.UserScores.Name), Key: userKey}},
+		{Get: &types.Get{TableName: aws.String(s.GlobalScores.Name), Key: globalKey}},
+	}
+	output, err := s.UserScores.Client.TransactGetItems(context.TODO(), &dynamodb.TransactGetItemsInput{TransactItems: keys})
+	if err != nil {
+		return err
+	}
+	if output.Responses[0].Item == nil {
+		// already deleted by an earlier attempt
+		return nil
+	}
+	userScore, err := userScoreFromAttributes(output.Responses[0].Item)
+	if err != nil {
+		return err
+	}
+	userVersion, err := itemVersion(output.Responses[0].Item)
+	if err != nil {
+		return err
+	}
+	writes := []types.TransactWriteItem{versionedDelete(s.UserScores.Name, userKey, userVersion)}
+	if output.Responses[1].Item != nil {
+		globalScore, err := globalScoreFromAttributes(output.Responses[1].Item)
+		if err != nil {
+			return err
+		}
+		globalVersion, err := itemVersion(output.Responses[1].Item)
+		if err != nil {
+			return err
+		}
+		backOut(userScore, &globalScore)
+		if globalScore.NumVotes <= 0 {
+			writes = append(writes, versionedDelete(s.GlobalScores.Name, globalKey, globalVersion))
+		} else {
+			writes = append(writes, versionedUpdate(s.GlobalScores.Name, globalKey, globalScore.Standing, globalVersion))
+		}
+	}
+	_, err = s.UserScores.Client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	return err
+}
+
+// TrashItem marks the item and its global score in one transaction,
+// which also counts the change in the poll's TrashVersion, so that a rebuild swapping in scores marked before it notices
+func (s DynamoVoteStore) TrashItem(item Item, at time.Time) error {
+	return retryConflicts("trashing item", func() error {
+		generation, err := s.Polls.getScoreGeneration(item.Poll)
+		if err != nil {
+			return err
+		}
+		write, err := s.markGlobalScore(item, generation, true)
+		if err != nil {
+			return err
+		}
+		writes := []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					Key:                      itemKey(item.Poll, item.Name),
+					TableName:                aws.String(s.Items.Name),
+					UpdateExpression:         aws.String("SET DeletedAt = :at"),
+					ConditionExpression:      aws.String("attribute_exists(#name) AND attribute_not_exists(DeletedAt)"),
+					ExpressionAttributeNames: map[string]string{"#name": "Name"},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":at": &types.AttributeValueMemberN{Value: strconv.FormatInt(at.Unix(), 10)},
+					},
+				},
+			},
+			write,
+			s.Polls.countTrashChange(item.Poll, generation),
+		}
+		return s.changeTrash(item, writes, fmt.Sprintf("no item found with name %s in poll %s", item.Name, item.Poll))
+	})
+}
+
+func (s DynamoVoteStore) RestoreItem(item Item) error {
+	return retryConflicts("restoring item", func() error {
+		generation, err := s.Polls.getScoreGeneration(item.Poll)
+		if err != nil {
+			return err
+		}
+		write, err := s.markGlobalScore(item, generation, false)
+		if err != nil {
+			return err
+		}
+		writes := []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					Key:                 itemKey(item.Poll, item.Name),
+					TableName:           aws.String(s.Items.Name),
+					UpdateExpression:    aws.String("REMOVE DeletedAt"),
+					ConditionExpression: aws.String("attribute_exists(DeletedAt)"),
+				},
+			},
+			write,
+			s.Polls.countTrashChange(item.Poll, generation),
+		}
+		return s.changeTrash(item, writes, fmt.Sprintf("no item found with name %s in the trash of poll %s", item.Name, item.Poll))
+	})
+}
+
+// a write that marks the item's global score in a generation as in the trash or not, if its version is still the one read just now
+// if the item has no global score yet, it's only a check that there still isn't one, so that a vote creating it
+// at the same time makes the transaction fail and be tried again, rather than leaving an unmarked score on the leaderboard
+func (s DynamoVoteStore) markGlobalScore(item Item, generation string, trashed bool) (types.TransactWriteItem, error) {
+	key := globalScoreKey(scorePartition(item.Poll, generation), item.ID)
+	output, err := s.GlobalScores.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		Key:            key,
+		TableName:      aws.String(s.GlobalScores.Name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	version, err := itemVersion(output.Item)
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	values := map[string]types.AttributeValue{}
+	condition := scoreVersionCondition(version, values)
+	if output.Item == nil {
+		check := &types.ConditionCheck{
+			Key:                 key,
+			TableName:           aws.String(s.GlobalScores.Name),
+			ConditionExpression: aws.String(condition),
+		}
+		return types.TransactWriteItem{ConditionCheck: check}, nil
+	}
+	values[":newVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(version + 1)}
+	expression := "REMOVE Trashed SET Version = :newVersion"
+	if trashed {
+		expression = "SET Trashed = :true, Version = :newVersion"
+		values[":true"] = &types.AttributeValueMemberBOOL{Value: true}
+	}
+	update := &types.Update{
+		Key:                       key,
+		TableName:                 aws.String(s.GlobalScores.Name),
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeValues: values,
+	}
+	return types.TransactWriteItem{Update: update}, nil
+}
+
+// writes a move into or out of the trash, reporting a failed condition on the item as notFound
+func (s DynamoVoteStore) changeTrash(item Item, writes []types.TransactWriteItem, notFound string) error {
+	_, err := s.Items.Client.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 {
+		if reason := canceled.CancellationReasons[0].Code; reason != nil && *reason == "ConditionalCheckFailed" {
+			return MakeNotFoundError(notFound)
+		}
+	}
+	return err
+}
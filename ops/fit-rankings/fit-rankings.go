@@ -0,0 +1,44 @@
+// fits Bradley–Terry rankings to the vote log, in the storage backend selected by the same environment variables as the server
+// usage: fit-rankings [-poll name]
+// without -poll, every poll is fitted; this is meant to be run on a schedule, like from cron
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/quevivasbien/ranker-backend/database"
+	"github.com/quevivasbien/ranker-backend/server"
+)
+
+func main() {
+	poll := flag.String("poll", "", "the poll to fit; every poll if empty")
+	flag.Parse()
+
+	db, err := database.OpenFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	polls := []string{*poll}
+	if *poll == "" {
+		polls, err = server.AllPolls(db)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	failed := false
+	for _, name := range polls {
+		ranking, err := server.FitRankings(db, name)
+		if err != nil {
+			log.Printf("%s: failed: %v", name, err)
+			failed = true
+			continue
+		}
+		log.Printf("%s: fitted %d items to %d votes", name, len(ranking.Scores), ranking.NumVotes)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
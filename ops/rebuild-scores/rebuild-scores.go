@@ -0,0 +1,46 @@
+// rebuilds scores from the vote log, in the storage backend selected by the same environment variables as the server
+// usage: rebuild-scores [-poll name] [-force]
+// without -poll, every poll is rebuilt
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/quevivasbien/ranker-backend/database"
+	"github.com/quevivasbien/ranker-backend/server"
+)
+
+func main() {
+	poll := flag.String("poll", "", "the poll to rebuild; every poll if empty")
+	force := flag.Bool("force", false, "rebuild even if votes that aren't in the vote log would be dropped")
+	flag.Parse()
+
+	db, err := database.OpenFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	polls := []string{*poll}
+	if *poll == "" {
+		polls, err = server.AllPolls(db)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	failed := false
+	for _, name := range polls {
+		progress, err := server.RebuildScores(db, name, *force, func(progress server.RebuildProgress) {
+			log.Printf("%s: %s, %d votes replayed, %d skipped, %d scores staged",
+				progress.Poll, progress.State, progress.EventsReplayed, progress.EventsSkipped, progress.ScoresStaged)
+		})
+		if err != nil {
+			log.Printf("%s: failed: %v", progress.Poll, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -1,11 +1,20 @@
 package server
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/quevivasbien/ranker-backend/database"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type PasswordMismatchError struct{}
@@ -26,53 +35,241 @@ func (e InsufficientPermissionsError) Error() string {
 	return "insufficient permissions"
 }
 
-func GetToken(user database.User) (string, error) {
+type InvalidTokenError struct {
+	Reason string
+}
+
+func (e InvalidTokenError) Error() string {
+	return "invalid token: " + e.Reason
+}
+
+// access tokens are short-lived; sessions (and the refresh tokens that keep them going) last longer
+const ACCESS_TOKEN_LIFETIME = 15 * time.Minute
+const SESSION_LIFETIME = 30 * 24 * time.Hour
+
+// the tokens handed out on login and refresh
+type Tokens struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	// seconds until the access token expires
+	ExpiresIn int `json:"expiresIn"`
+}
+
+// the claims in an access token
+// sid identifies the session the token was issued for, so that logging out revokes the token too
+// roles are copied from the user when the token is issued, so granted roles apply from the next refresh;
+// revoking one ends the user's sessions instead (see RevokeRole)
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	SessionID string   `json:"sid"`
+	Roles     []string `json:"roles"`
+}
+
+func randomString(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+func hashRefreshSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// GetToken returns an access token for the user in the given session
+func GetToken(user database.User, sessionID string) (string, error) {
 	secret := os.Getenv("RANKER_JWT_SECRET")
-	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.Name,
+	id, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.Name,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ACCESS_TOKEN_LIFETIME)),
+			ID:        id,
+		},
+		SessionID: sessionID,
+		Roles:     user.Roles,
 	})
 	return claims.SignedString([]byte(secret))
 }
 
-func CheckToken(token string) (string, error) {
+// gives the session a new refresh token, replacing the old one, and issues a matching access token
+func issueTokens(db database.Database, user database.User, session database.Session) (Tokens, error) {
+	secret, err := randomString(32)
+	if err != nil {
+		return Tokens{}, err
+	}
+	session.PreviousRefreshHash = session.RefreshHash
+	session.RefreshHash = hashRefreshSecret(secret)
+	session.ExpiresAt = time.Now().Add(SESSION_LIFETIME)
+	err = db.Sessions.PutSession(session)
+	if err != nil {
+		return Tokens{}, fmt.Errorf("error saving session in db: %v", err)
+	}
+	accessToken, err := GetToken(user, session.ID)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: session.ID + "." + secret,
+		ExpiresIn:    int(ACCESS_TOKEN_LIFETIME.Seconds()),
+	}, nil
+}
+
+// checks an access token's signature, expiry and session, and returns its claims
+func verifyToken(db database.Database, token string) (tokenClaims, error) {
 	secret := os.Getenv("RANKER_JWT_SECRET")
-	t, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
 		return []byte(secret), nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 	if err != nil {
-		return "", err
+		return claims, InvalidTokenError{Reason: err.Error()}
+	}
+	if claims.ExpiresAt == nil {
+		return claims, InvalidTokenError{Reason: "token has no expiry"}
+	}
+	session, err := db.Sessions.GetSession(claims.SessionID)
+	if _, ok := err.(database.NotFoundError); ok {
+		return claims, InvalidTokenError{Reason: "session has ended"}
+	}
+	if err != nil {
+		return claims, fmt.Errorf("error getting session from db: %v", err)
+	}
+	if session.UserName != claims.Subject {
+		return claims, InvalidTokenError{Reason: "token does not match session"}
 	}
-	user := t.Claims.(jwt.MapClaims)["sub"].(string)
-	return user, nil
+	return claims, nil
 }
 
-// Login returns a JWT token for the user if the username and password are correct
-func Login(db database.Database, username string, password string) (string, error) {
-	user, err := db.Users.GetUser(username)
+// CheckToken returns the name of the user an access token belongs to, if it's still valid
+func CheckToken(db database.Database, token string) (string, error) {
+	claims, err := verifyToken(db, token)
 	if err != nil {
 		return "", err
 	}
-	if user.Password != password {
-		return "", PasswordMismatchError{}
+	return claims.Subject, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh token
+// each refresh token can only be used once; presenting the one it replaced ends the session,
+// since it means the token has been copied
+// other secrets are just refused, so that knowing a session's ID isn't enough to end it
+func Refresh(db database.Database, refreshToken string) (Tokens, error) {
+	id, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok {
+		return Tokens{}, InvalidTokenError{Reason: "malformed refresh token"}
+	}
+	session, err := db.Sessions.GetSession(id)
+	if _, ok := err.(database.NotFoundError); ok {
+		return Tokens{}, InvalidTokenError{Reason: "session has ended"}
+	}
+	if err != nil {
+		return Tokens{}, fmt.Errorf("error getting session from db: %v", err)
+	}
+	hash := []byte(hashRefreshSecret(secret))
+	if subtle.ConstantTimeCompare(hash, []byte(session.RefreshHash)) != 1 {
+		if session.PreviousRefreshHash == "" || subtle.ConstantTimeCompare(hash, []byte(session.PreviousRefreshHash)) != 1 {
+			return Tokens{}, InvalidTokenError{Reason: "invalid refresh token"}
+		}
+		err = db.Sessions.DeleteSession(id)
+		if err != nil {
+			return Tokens{}, fmt.Errorf("error deleting session from db: %v", err)
+		}
+		return Tokens{}, InvalidTokenError{Reason: "refresh token has already been used"}
+	}
+	user, err := db.Users.GetUser(session.UserName)
+	if err != nil {
+		return Tokens{}, err
 	}
-	return GetToken(user)
+	return issueTokens(db, user, session)
 }
 
-func VerifyUser(r *http.Request) (string, error) {
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		return "", TokenMissingError{}
+// Logout ends the session the access token was issued for, revoking it and its refresh token
+func Logout(db database.Database, sessionID string) error {
+	err := db.Sessions.DeleteSession(sessionID)
+	if err != nil {
+		return fmt.Errorf("error deleting session from db: %v", err)
 	}
-	return CheckToken(token)
+	return nil
 }
 
-func VerifyAdmin(r *http.Request) (string, error) {
-	user, err := VerifyUser(r)
+const BCRYPT_COST = 12
+
+// HashPassword returns the bcrypt hash of a password, for storing in database.User
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), BCRYPT_COST)
 	if err != nil {
 		return "", err
 	}
-	if user != "admin" {
-		return "", InsufficientPermissionsError{}
+	return string(hash), nil
+}
+
+// checks a password against the one stored for the user
+// also reports whether the stored password should be rehashed: either it's a plaintext password from before
+// hashing was added, or it was hashed with a lower cost than we use now
+func checkPassword(user database.User, password string) (bool, bool) {
+	cost, err := bcrypt.Cost([]byte(user.PasswordHash))
+	if err != nil {
+		// not a bcrypt hash, so it must be a legacy plaintext password
+		match := subtle.ConstantTimeCompare([]byte(user.PasswordHash), []byte(password)) == 1
+		return match, true
+	}
+	match := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+	return match, cost < BCRYPT_COST
+}
+
+// a hash at BCRYPT_COST of a password nobody has, which logins as users that don't exist are checked against,
+// so that they take as long as a wrong password and don't give away which users exist
+const DUMMY_PASSWORD_HASH = "$2a$12$kfd9/RwPU6dYg5WPLHDv5OGhradKrZFNanXHwRWJGbaXXg2QNa8xm"
+
+// Login starts a session and returns its tokens if the username and password are correct
+// an unknown username fails the same way as a wrong password
+func Login(db database.Database, username string, password string) (Tokens, error) {
+	user, err := db.Users.GetUser(username)
+	if _, ok := err.(database.NotFoundError); ok {
+		bcrypt.CompareHashAndPassword([]byte(DUMMY_PASSWORD_HASH), []byte(password))
+		return Tokens{}, PasswordMismatchError{}
+	}
+	if err != nil {
+		return Tokens{}, err
+	}
+	match, rehash := checkPassword(user, password)
+	if !match {
+		return Tokens{}, PasswordMismatchError{}
+	}
+	if rehash {
+		user.PasswordHash, err = HashPassword(password)
+		if err != nil {
+			return Tokens{}, err
+		}
+		err = db.Users.SetUserPassword(user.Name, user.PasswordHash)
+		if _, ok := err.(database.NotFoundError); ok {
+			return Tokens{}, err
+		}
+		if err != nil {
+			return Tokens{}, fmt.Errorf("error upgrading stored password: %v", err)
+		}
+	}
+	sessionID, err := randomString(16)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return issueTokens(db, user, database.Session{ID: sessionID, UserName: user.Name})
+}
+
+// checks the access token in a request's Authorization header and returns its claims
+func verifyRequest(db database.Database, r *http.Request) (tokenClaims, error) {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return tokenClaims{}, TokenMissingError{}
 	}
-	return user, nil
+	return verifyToken(db, token)
 }
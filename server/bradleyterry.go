@@ -0,0 +1,311 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/quevivasbien/ranker-backend/database"
+)
+
+// how many votes each item is taken to have won, and lost, against an item of average strength on top of its real votes
+// this keeps the fit from running off to infinity for items that have won or lost every vote,
+// and pulls items with few votes towards the middle
+const BT_PRIOR_VOTES = 1
+
+// the fit stops once no item's strength changes by more than BT_TOLERANCE in an iteration,
+// or after BT_MAX_ITERATIONS
+const BT_TOLERANCE = 0.000001
+const BT_MAX_ITERATIONS = 1000
+
+// the votes a Bradley–Terry model is fitted to, with items numbered in the order they first came up
+type pairwiseVotes struct {
+	index    map[string]int
+	ids      []string
+	wins     []int
+	numVotes []int
+	// how many votes there were between each pair of items, with the lower number first
+	pairs map[[2]int]int
+	total int
+}
+
+func newPairwiseVotes() *pairwiseVotes {
+	return &pairwiseVotes{index: map[string]int{}, pairs: map[[2]int]int{}}
+}
+
+func (v *pairwiseVotes) item(id string) int {
+	i, ok := v.index[id]
+	if !ok {
+		i = len(v.ids)
+		v.index[id] = i
+		v.ids = append(v.ids, id)
+		v.wins = append(v.wins, 0)
+		v.numVotes = append(v.numVotes, 0)
+	}
+	return i
+}
+
+func (v *pairwiseVotes) add(winner, loser string) {
+	w, l := v.item(winner), v.item(loser)
+	v.wins[w]++
+	v.numVotes[w]++
+	v.numVotes[l]++
+	if w < l {
+		v.pairs[[2]int{w, l}]++
+	} else {
+		v.pairs[[2]int{l, w}]++
+	}
+	v.total++
+}
+
+// fits the strengths of the items, from strongest to weakest, by maximising the likelihood of the votes
+// under the Bradley–Terry model, where item i is preferred to item j with probability p_i / (p_i + p_j)
+// this uses Hunter's MM algorithm, counting the prior votes against an item with p = 1 along with the real ones
+func (v *pairwiseVotes) fit() []database.FittedScore {
+	type pair struct {
+		i, j  int
+		count float64
+	}
+	pairs := make([]pair, 0, len(v.pairs))
+	for key, count := range v.pairs {
+		pairs = append(pairs, pair{key[0], key[1], float64(count)})
+	}
+	strengths := make([]float64, len(v.ids))
+	for i := range strengths {
+		strengths[i] = 1
+	}
+	denominators := make([]float64, len(v.ids))
+	for iteration := 0; iteration < BT_MAX_ITERATIONS; iteration++ {
+		for i, p := range strengths {
+			denominators[i] = 2 * BT_PRIOR_VOTES / (p + 1)
+		}
+		for _, pair := range pairs {
+			d := pair.count / (strengths[pair.i] + strengths[pair.j])
+			denominators[pair.i] += d
+			denominators[pair.j] += d
+		}
+		next := make([]float64, len(strengths))
+		for i := range strengths {
+			next[i] = (float64(v.wins[i]) + BT_PRIOR_VOTES) / denominators[i]
+		}
+		scale := priorScale(next)
+		change := 0.0
+		for i, p := range strengths {
+			change = math.Max(change, math.Abs(math.Log(next[i]*scale)-math.Log(p)))
+			strengths[i] = next[i] * scale
+		}
+		if change < BT_TOLERANCE {
+			break
+		}
+	}
+
+	scores := make([]database.FittedScore, len(v.ids))
+	for i, id := range v.ids {
+		scores[i] = database.FittedScore{ItemID: id, Strength: math.Log(strengths[i]), NumVotes: v.numVotes[i]}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Strength != scores[j].Strength {
+			return scores[i].Strength > scores[j].Strength
+		}
+		return scores[i].ItemID < scores[j].ItemID
+	})
+	return scores
+}
+
+// the real votes only say how strong items are relative to each other, so only the prior votes pin down
+// their overall level, and MM steps move it very slowly; this finds the factor to multiply every strength by
+// that best fits the prior votes, which is where Σ tanh((log p_i + log k) / 2) = 0
+func priorScale(strengths []float64) float64 {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, p := range strengths {
+		lo = math.Min(lo, -math.Log(p))
+		hi = math.Max(hi, -math.Log(p))
+	}
+	// the sum is increasing in log k, and changes sign between these
+	for n := 0; n < 100 && hi-lo > BT_TOLERANCE/10; n++ {
+		mid := (lo + hi) / 2
+		sum := 0.0
+		for _, p := range strengths {
+			sum += math.Tanh((math.Log(p) + mid) / 2)
+		}
+		if sum < 0 {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return math.Exp((lo + hi) / 2)
+}
+
+// FitRankings fits a Bradley–Terry model to all of the votes in a poll's vote log at once, both to everyone's votes
+// and to each user's own, and saves the rankings in place of the ones fitted before; it returns the global ranking
+// unlike the scores, the result doesn't depend on the order the votes were cast in
+// votes are left out under the same rules as when rebuilding scores
+func FitRankings(db database.Database, poll string) (database.FittedRanking, error) {
+	_, err := db.Polls.GetPoll(poll)
+	if err != nil {
+		return database.FittedRanking{}, err
+	}
+	items, err := loggedItems(db, poll)
+	if err != nil {
+		return database.FittedRanking{}, err
+	}
+	voters := newVoters(db)
+	global := newPairwiseVotes()
+	users := map[string]*pairwiseVotes{}
+	lastEvent := ""
+	options := database.PageOptions{Limit: VOTE_LOG_PAGE_SIZE}
+	for {
+		events, next, err := db.VoteEvents.VoteEventsPage(poll, options)
+		if err != nil {
+			return database.FittedRanking{}, fmt.Errorf("error getting vote events from db: %v", err)
+		}
+		for _, event := range events {
+			lastEvent = event.ID
+			item1, ok1 := items[event.Item1]
+			item2, ok2 := items[event.Item2]
+			if !ok1 || !ok2 || item1.ID == item2.ID {
+				continue
+			}
+			cast, err := voters.cast(event)
+			if err != nil {
+				return database.FittedRanking{}, err
+			}
+			if !cast {
+				continue
+			}
+			winner, loser := item1.ID, item2.ID
+			if event.Winner != event.Item1 {
+				winner, loser = loser, winner
+			}
+			global.add(winner, loser)
+			if users[event.UserName] == nil {
+				users[event.UserName] = newPairwiseVotes()
+			}
+			users[event.UserName].add(winner, loser)
+		}
+		if next == "" {
+			break
+		}
+		options.Cursor = next
+	}
+
+	now := time.Now().Truncate(time.Second)
+	for user, votes := range users {
+		err = db.FittedRankings.PutFittedRanking(database.FittedRanking{
+			Poll: poll, UserName: user, FittedAt: now, LastEvent: lastEvent, NumVotes: votes.total, Scores: votes.fit(),
+		})
+		if err != nil {
+			return database.FittedRanking{}, fmt.Errorf("error saving fitted ranking in db: %v", err)
+		}
+	}
+	ranking := database.FittedRanking{Poll: poll, FittedAt: now, LastEvent: lastEvent, NumVotes: global.total, Scores: global.fit()}
+	err = db.FittedRankings.PutFittedRanking(ranking)
+	if err != nil {
+		return ranking, fmt.Errorf("error saving fitted ranking in db: %v", err)
+	}
+	return ranking, nil
+}
+
+// an item's place in a fitted ranking
+type fittedRankingEntry struct {
+	Rank        int     `json:"rank"`
+	ItemID      string  `json:"itemId"`
+	ItemName    string  `json:"itemName"`
+	Description string  `json:"description"`
+	Strength    float64 `json:"strength"`
+	NumVotes    int     `json:"numVotes"`
+}
+
+// a fitted ranking as it's served, with item names and descriptions
+type fittedRankingResponse struct {
+	FittedAt time.Time            `json:"fittedAt"`
+	NumVotes int                  `json:"numVotes"`
+	Items    []fittedRankingEntry `json:"items"`
+}
+
+// returns the latest ranking fitted to a user's votes, or everyone's if userName is empty,
+// leaving out items with fewer than minVotes votes
+// items that have been deleted or merged away since the fit are left out too
+func GetFittedRanking(db database.Database, poll string, userName string, minVotes int) (fittedRankingResponse, error) {
+	var user database.User
+	if userName != "" {
+		var err error
+		user, err = db.Users.GetUser(userName)
+		if err != nil {
+			return fittedRankingResponse{}, err
+		}
+	}
+	ranking, err := db.FittedRankings.GetFittedRanking(poll, userName)
+	if err != nil {
+		return fittedRankingResponse{}, err
+	}
+	// a fit that was running when an earlier account with the same name was deleted may have saved a ranking for it afterwards
+	if ranking.FittedAt.Before(user.CreatedAt.Truncate(time.Second)) {
+		return fittedRankingResponse{}, database.MakeNotFoundError(fmt.Sprintf("no ranking has been fitted for user %s in poll %s yet", userName, poll))
+	}
+	allItems, err := db.Items.AllItems(poll)
+	if err != nil {
+		return fittedRankingResponse{}, fmt.Errorf("error getting list of items from db: %v", err)
+	}
+	items := map[string]database.Item{}
+	for _, item := range allItems {
+		items[item.ID] = item
+	}
+	response := fittedRankingResponse{FittedAt: ranking.FittedAt, NumVotes: ranking.NumVotes, Items: []fittedRankingEntry{}}
+	for _, score := range ranking.Scores {
+		item, ok := items[score.ItemID]
+		if !ok || score.NumVotes < minVotes {
+			continue
+		}
+		response.Items = append(response.Items, fittedRankingEntry{
+			Rank:        len(response.Items) + 1,
+			ItemID:      item.ID,
+			ItemName:    item.Name,
+			Description: item.Description,
+			Strength:    score.Strength,
+			NumVotes:    score.NumVotes,
+		})
+	}
+	return response, nil
+}
+
+// reads how often to fit the rankings of every poll from RANKER_FIT_INTERVAL, which is a Go duration like 24h
+// if it's unset, rankings are only fitted on demand
+func fitIntervalFromEnv() (time.Duration, error) {
+	value := os.Getenv("RANKER_FIT_INTERVAL")
+	if value == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid RANKER_FIT_INTERVAL: %v", err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("invalid RANKER_FIT_INTERVAL: must be positive")
+	}
+	return interval, nil
+}
+
+// fits the rankings of every poll every interval, for as long as the server runs
+func startRankingFitter(db database.Database, interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			polls, err := AllPolls(db)
+			if err != nil {
+				log.Printf("error fitting rankings: %v", err)
+				continue
+			}
+			for _, poll := range polls {
+				_, err = FitRankings(db, poll)
+				if err != nil {
+					log.Printf("error fitting rankings of poll %s: %v", poll, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/quevivasbien/ranker-backend/database"
+)
+
+func strengthsByItem(scores []database.FittedScore) map[string]float64 {
+	strengths := map[string]float64{}
+	for _, score := range scores {
+		strengths[score.ItemID] = score.Strength
+	}
+	return strengths
+}
+
+func TestBradleyTerryRecoversStrengths(t *testing.T) {
+	// log strengths, which average to 0 so that they're on the same footing as the prior
+	want := map[string]float64{"a": 1, "b": 0.5, "c": 0, "d": -0.5, "e": -1}
+	ids := []string{"a", "b", "c", "d", "e"}
+
+	random := rand.New(rand.NewSource(1))
+	votes := newPairwiseVotes()
+	for i, id1 := range ids {
+		for _, id2 := range ids[i+1:] {
+			p1, p2 := math.Exp(want[id1]), math.Exp(want[id2])
+			for n := 0; n < 2000; n++ {
+				if random.Float64() < p1/(p1+p2) {
+					votes.add(id1, id2)
+				} else {
+					votes.add(id2, id1)
+				}
+			}
+		}
+	}
+	scores := votes.fit()
+
+	for i, score := range scores {
+		if score.ItemID != ids[i] {
+			t.Fatalf("item %d is %s, want %s", i, score.ItemID, ids[i])
+		}
+		if score.NumVotes != 8000 {
+			t.Errorf("%s has %d votes, want 8000", score.ItemID, score.NumVotes)
+		}
+	}
+	got := strengthsByItem(scores)
+	for _, id := range ids {
+		if !closeTo(got[id], want[id], 0.05) {
+			t.Errorf("%s has strength %f, want %f", id, got[id], want[id])
+		}
+	}
+}
+
+func TestBradleyTerryPriorKeepsUndefeatedFinite(t *testing.T) {
+	votes := newPairwiseVotes()
+	for n := 0; n < 10; n++ {
+		votes.add("undefeated", "middle")
+		votes.add("middle", "winless")
+	}
+	for n := 0; n < 5; n++ {
+		votes.add("undefeated", "winless")
+	}
+	got := strengthsByItem(votes.fit())
+
+	for id, strength := range got {
+		if math.IsInf(strength, 0) || math.IsNaN(strength) {
+			t.Errorf("%s has strength %f, want it finite", id, strength)
+		}
+	}
+	if !(got["undefeated"] > got["middle"] && got["middle"] > got["winless"]) {
+		t.Errorf("strengths are %v, want undefeated > middle > winless", got)
+	}
+	// one prior win and loss against an average item each keeps the extremes within a few units of the middle
+	if got["undefeated"] > 5 || got["winless"] < -5 {
+		t.Errorf("strengths are %v, want them to stay within 5 of 0", got)
+	}
+}
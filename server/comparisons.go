@@ -2,30 +2,36 @@ package server
 
 import (
 	"fmt"
-	"math"
 	"math/rand"
+	"time"
 
 	. "github.com/quevivasbien/ranker-backend/database"
 )
 
-const DEFAULT_ELO = 1000
-const ELO_K = 64
+// error type for votes that don't make sense, like ones between an item and itself
+type InvalidComparisonError struct {
+	Reason string
+}
+
+func (e InvalidComparisonError) Error() string {
+	return "invalid comparison: " + e.Reason
+}
 
-func containsItem(userScores []UserScore, itemName string) bool {
+func containsItem(userScores []UserScore, itemID string) bool {
 	for _, userScore := range userScores {
-		if userScore.ItemName == itemName {
+		if userScore.ItemID == itemID {
 			return true
 		}
 	}
 	return false
 }
 
-// returns names of unranked items
+// returns IDs of unranked items
 func getUnrankedItems(allItems []Item, userScores []UserScore) []string {
 	var unrankedItems []string
 	for _, item := range allItems {
-		if !containsItem(userScores, item.Name) {
-			unrankedItems = append(unrankedItems, item.Name)
+		if !containsItem(userScores, item.ID) {
+			unrankedItems = append(unrankedItems, item.ID)
 		}
 	}
 	return unrankedItems
@@ -35,7 +41,7 @@ func itemsWithFewestVotes(userScores []UserScore, excludeItem string) []string {
 	items := []string{}
 	minVotes := -1
 	for _, userScore := range userScores {
-		if userScore.ItemName == excludeItem {
+		if userScore.ItemID == excludeItem {
 			continue
 		}
 		if minVotes < 0 || userScore.NumVotes < minVotes {
@@ -43,7 +49,7 @@ func itemsWithFewestVotes(userScores []UserScore, excludeItem string) []string {
 			items = []string{}
 		}
 		if userScore.NumVotes == minVotes {
-			items = append(items, userScore.ItemName)
+			items = append(items, userScore.ItemID)
 		}
 	}
 	return items
@@ -72,19 +78,45 @@ func select2ItemsForComparison(userScores []UserScore) (string, string, error) {
 	}
 }
 
-// returns names of two items for user to compare with each other
-func GetItemsForComparison(db Database, user string) (string, string, error) {
-	allItems, err := db.Items.AllItems()
+// returns names of two items in a poll for user to compare with each other
+func GetItemsForComparison(db Database, poll string, user string) (string, string, error) {
+	allItems, err := db.Items.AllItems(poll)
 	if err != nil {
 		return "", "", fmt.Errorf("error getting list of items from db: %v", err)
 	}
 	if len(allItems) < 2 {
-		return "", "", fmt.Errorf("not enough items in db to compare")
+		return "", "", fmt.Errorf("not enough items in poll %s to compare", poll)
 	}
-	userScores, err := db.UserScores.GetUserScores(user)
+	userScores, err := db.UserScores.GetUserScores(poll, user)
 	if err != nil {
 		return "", "", fmt.Errorf("error getting user scores from db: %v", err)
 	}
+	names := itemNames(allItems)
+	// leave out scores of items that have since been deleted, which have no name to send
+	current := []UserScore{}
+	for _, userScore := range userScores {
+		if _, ok := names[userScore.ItemID]; ok {
+			current = append(current, userScore)
+		}
+	}
+	item1, item2, err := selectItemsForComparison(allItems, current)
+	if err != nil {
+		return "", "", err
+	}
+	return names[item1], names[item2], nil
+}
+
+// maps the IDs of items to their names
+func itemNames(items []Item) map[string]string {
+	names := map[string]string{}
+	for _, item := range items {
+		names[item.ID] = item.Name
+	}
+	return names
+}
+
+// returns IDs of two items for a user to compare, preferring items they haven't ranked yet
+func selectItemsForComparison(allItems []Item, userScores []UserScore) (string, string, error) {
 	var item1, item2 string
 	unrankedItems := getUnrankedItems(allItems, userScores)
 	if len(unrankedItems) >= 1 {
@@ -100,99 +132,77 @@ func GetItemsForComparison(db Database, user string) (string, string, error) {
 	}
 }
 
-func computeScoreChanges(score1 int, score2 int, winner1 bool) (int, int) {
-	expected1 := 1 / (1 + math.Pow(10, float64(score2-score1)/400))
-	expected2 := 1 / (1 + math.Pow(10, float64(score1-score2)/400))
-	if winner1 {
-		newScore1 := score1 + int(ELO_K*(1-expected1))
-		newScore2 := score2 + int(ELO_K*(0-expected2))
-		return newScore1, newScore2
-	} else {
-		newScore1 := score1 + int(ELO_K*(0-expected1))
-		newScore2 := score2 + int(ELO_K*(1-expected2))
-		return newScore1, newScore2
-	}
-}
-
-func getOrCreateUserScore(db Database, item, user string) (UserScore, error) {
-	userScore, err := db.UserScores.GetUserScore(item, user)
-	if err == nil {
-		return userScore, nil
-	}
-	if _, ok := err.(NotFoundError); ok {
-		userScore = UserScore{ItemName: item, UserName: user, Rating: DEFAULT_ELO, NumVotes: 0}
-		err = db.UserScores.PutUserScore(userScore)
-		if err != nil {
-			return userScore, fmt.Errorf("error creating user score in db: %v", err)
+// the changes one vote makes to the user and global scores of the two items compared
+// this is the only place votes change ratings, so rebuilding scores from the vote log can use it too
+func applyVote(system RatingSystem, winner1 bool) VoteUpdate {
+	return func(userScore1, userScore2 *UserScore, globalScore1, globalScore2 *GlobalScore) {
+		for _, standings := range [][2]*Standing{
+			{&userScore1.Standing, &userScore2.Standing},
+			{&globalScore1.Standing, &globalScore2.Standing},
+		} {
+			system.Vote(standings[0], standings[1], winner1)
+			standings[0].NumVotes++
+			standings[1].NumVotes++
 		}
-		return userScore, nil
 	}
-	return userScore, fmt.Errorf("error getting user score from db: %v", err)
 }
 
-func getOrCreateGlobalScore(db Database, item string) (GlobalScore, error) {
-	globalScore, err := db.GlobalScores.GetGlobalScore(item)
-	if err == nil {
-		return globalScore, nil
+// records the user's choice between two items in a poll, given by name, along with an event in the vote log
+// that keeps the given details of the request it came in
+func ProcessUserChoice(db Database, poll string, user string, item1 string, item2 string, choice string, metadata map[string]string) error {
+	if item1 == item2 {
+		return InvalidComparisonError{Reason: fmt.Sprintf("cannot compare item %s with itself", item1)}
 	}
-	if _, ok := err.(NotFoundError); ok {
-		globalScore = GlobalScore{ItemName: item, Rating: DEFAULT_ELO, NumVotes: 0}
-		err = db.GlobalScores.PutGlobalScore(globalScore)
-		if err != nil {
-			return globalScore, fmt.Errorf("error creating global score in db: %v", err)
-		}
-		return globalScore, nil
-	}
-	return globalScore, fmt.Errorf("error getting global score from db: %v", err)
-}
-
-func ProcessUserChoice(db Database, user string, item1 string, item2 string, choice string) error {
 	if choice != item1 && choice != item2 {
-		return fmt.Errorf("invalid choice: %s", choice)
+		return InvalidComparisonError{Reason: fmt.Sprintf("the winner %s is neither of the items compared", choice)}
 	}
-
-	// compute user score updates
-	userScore1, err := getOrCreateUserScore(db, item1, user)
+	winner1 := choice == item1
+	system, err := ratingSystemFromEnv()
 	if err != nil {
 		return err
 	}
-	userScore2, err := getOrCreateUserScore(db, item2, user)
+
+	// scores are kept by item ID
+	items := make([]Item, 2)
+	ids := make([]string, 2)
+	for i, name := range []string{item1, item2} {
+		item, err := db.Items.GetItem(poll, name)
+		if _, ok := err.(NotFoundError); ok {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("error getting item from db: %v", err)
+		}
+		items[i] = item
+		ids[i] = item.ID
+	}
+
+	now := time.Now()
+	eventID, err := NewVoteEventID(now)
 	if err != nil {
 		return err
 	}
-	userScore1.NumVotes++
-	userScore2.NumVotes++
-	winner1 := choice == item1
-	userScore1.Rating, userScore2.Rating = computeScoreChanges(userScore1.Rating, userScore2.Rating, winner1)
-	err = db.UserScores.UpdateUserScore(userScore1)
-	if err != nil {
-		return fmt.Errorf("error updating user score in db: %v", err)
+	winner := ids[1]
+	if winner1 {
+		winner = ids[0]
 	}
-	db.UserScores.UpdateUserScore(userScore2)
-	if err != nil {
-		return fmt.Errorf("error updating user score in db: %v", err)
+	event := VoteEvent{
+		ID:        eventID,
+		Poll:      poll,
+		UserName:  user,
+		Item1:     ids[0],
+		Item2:     ids[1],
+		Winner:    winner,
+		Timestamp: now.Truncate(time.Second),
+		Metadata:  metadata,
 	}
 
-	// compute global score updates
-	globalScore1, err := getOrCreateGlobalScore(db, item1)
-	if err != nil {
-		return fmt.Errorf("error getting global score from db: %v", err)
-	}
-	globalScore2, err := getOrCreateGlobalScore(db, item2)
-	if err != nil {
-		return fmt.Errorf("error getting global score from db: %v", err)
-	}
-	globalScore1.NumVotes++
-	globalScore2.NumVotes++
-	globalScore1.Rating, globalScore2.Rating = computeScoreChanges(globalScore1.Rating, globalScore2.Rating, winner1)
-	db.GlobalScores.UpdateGlobalScore(globalScore1)
-	if err != nil {
-		return fmt.Errorf("error updating global score in db: %v", err)
+	err = db.Votes.RecordVote(event, items[0], items[1], applyVote(system, winner1))
+	if _, ok := err.(NotFoundError); ok {
+		return err
 	}
-	db.GlobalScores.UpdateGlobalScore(globalScore2)
 	if err != nil {
-		return fmt.Errorf("error updating global score in db: %v", err)
+		return fmt.Errorf("error recording vote in db: %v", err)
 	}
-
 	return nil
 }
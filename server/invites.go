@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/quevivasbien/ranker-backend/database"
+)
+
+type InvalidInviteError struct {
+	Reason string
+}
+
+func (e InvalidInviteError) Error() string {
+	return "invalid invite code: " + e.Reason
+}
+
+// invite codes can be used by any number of people until they expire or are revoked
+const INVITE_LIFETIME = 7 * 24 * time.Hour
+
+// invite codes are JWTs signed with the same secret as access tokens;
+// the audience keeps one from being accepted as the other
+const inviteAudience = "poll-invite"
+
+// codes carry the poll's invite generation when they were created, and stop working once it has gone up
+type inviteClaims struct {
+	jwt.RegisteredClaims
+	Generation int `json:"gen"`
+}
+
+// an invite code for a poll, and when it stops working
+type Invite struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// CreateInvite returns a code that lets whoever has it join the poll
+func CreateInvite(poll database.Poll) (Invite, error) {
+	secret := os.Getenv("RANKER_JWT_SECRET")
+	now := time.Now()
+	expiresAt := now.Add(INVITE_LIFETIME)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, inviteClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   poll.Name,
+			Audience:  jwt.ClaimStrings{inviteAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		Generation: poll.InviteGeneration,
+	})
+	code, err := token.SignedString([]byte(secret))
+	if err != nil {
+		return Invite{}, err
+	}
+	return Invite{Code: code, ExpiresAt: expiresAt.Truncate(time.Second)}, nil
+}
+
+// JoinPoll makes the user a member of the poll, if the invite code is for that poll and hasn't expired or been revoked
+func JoinPoll(db database.Database, poll database.Poll, name string, code string) error {
+	secret := os.Getenv("RANKER_JWT_SECRET")
+	var claims inviteClaims
+	_, err := jwt.ParseWithClaims(code, &claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(inviteAudience))
+	if err != nil {
+		return InvalidInviteError{Reason: err.Error()}
+	}
+	if claims.ExpiresAt == nil {
+		return InvalidInviteError{Reason: "code has no expiry"}
+	}
+	if claims.Subject != poll.Name {
+		return InvalidInviteError{Reason: "code is for a different poll"}
+	}
+	if claims.Generation != poll.InviteGeneration {
+		return InvalidInviteError{Reason: "code has been revoked"}
+	}
+	err = db.PollMembers.AddPollMember(poll.Name, name)
+	if err != nil {
+		return fmt.Errorf("error adding poll member in db: %v", err)
+	}
+	return nil
+}
+
+// RevokeInvites stops every invite code created for the poll so far from working
+func RevokeInvites(db database.Database, poll database.Poll) error {
+	err := db.Polls.RevokeInvites(poll.Name)
+	if err != nil {
+		return fmt.Errorf("error revoking invites in db: %v", err)
+	}
+	return nil
+}
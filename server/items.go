@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/quevivasbien/ranker-backend/database"
+)
+
+type InvalidItemError struct {
+	Reason string
+}
+
+func (e InvalidItemError) Error() string {
+	return "invalid item: " + e.Reason
+}
+
+// the fields of a new item that are taken from the request; the rest are set by the server
+type itemCreation struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// CreateItem adds a new item to a poll with a new ID, starting at version 1
+func CreateItem(db database.Database, poll string, creation itemCreation) (database.Item, error) {
+	item := database.Item{Poll: poll, Name: creation.Name, Description: creation.Description, Metadata: creation.Metadata}
+	if item.Name == "" {
+		return item, InvalidItemError{Reason: "name can't be empty"}
+	}
+	id, err := randomString(16)
+	if err != nil {
+		return item, err
+	}
+	item.ID = id
+	if item.Metadata == nil {
+		item.Metadata = map[string]string{}
+	}
+	item.Version = 1
+	err = db.Items.CreateItem(item)
+	if _, ok := err.(database.AlreadyExistsError); ok {
+		// the name might belong to an item in the trash, which would otherwise be confusing
+		if _, trashErr := db.Items.GetTrashedItem(item.Poll, item.Name); trashErr == nil {
+			return item, database.MakeAlreadyExistsError(fmt.Sprintf("an item named %s is in the trash of poll %s; restore or purge it first", item.Name, item.Poll))
+		}
+	}
+	return item, err
+}
+
+// the fields of an item that PUT replaces
+type itemReplacement struct {
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// the fields of an item that PATCH changes; missing fields are left as they are,
+// and metadata keys set to null are removed
+// changing the name renames the item, which keeps its ID and scores
+type itemPatch struct {
+	Name        *string            `json:"name"`
+	Description *string            `json:"description"`
+	Metadata    map[string]*string `json:"metadata"`
+}
+
+// reads the item an edit is based on, which must still be at the given version
+func getItemVersion(db database.Database, poll string, name string, version int) (database.Item, error) {
+	item, err := db.Items.GetItem(poll, name)
+	if err != nil {
+		return item, err
+	}
+	if item.Version != version {
+		return item, database.MakeVersionMismatchError(fmt.Sprintf("item %s has changed since version %d", name, version))
+	}
+	return item, nil
+}
+
+// saves an edited item that was named name, which must still be at the version the edit was based on,
+// and returns it with its new version
+func updateItem(db database.Database, name string, item database.Item) (database.Item, error) {
+	err := db.Items.UpdateItem(name, item)
+	if err != nil {
+		return item, err
+	}
+	item.Version++
+	return item, nil
+}
+
+// ReplaceItem sets an item's description and metadata, if it's still at the given version
+func ReplaceItem(db database.Database, poll string, name string, version int, replacement itemReplacement) (database.Item, error) {
+	item, err := getItemVersion(db, poll, name, version)
+	if err != nil {
+		return item, err
+	}
+	item.Description = replacement.Description
+	item.Metadata = replacement.Metadata
+	if item.Metadata == nil {
+		item.Metadata = map[string]string{}
+	}
+	return updateItem(db, name, item)
+}
+
+// PatchItem changes some of an item's fields, if it's still at the given version
+func PatchItem(db database.Database, poll string, name string, version int, patch itemPatch) (database.Item, error) {
+	item, err := getItemVersion(db, poll, name, version)
+	if err != nil {
+		return item, err
+	}
+	if patch.Name != nil {
+		if *patch.Name == "" {
+			return item, InvalidItemError{Reason: "name can't be empty"}
+		}
+		item.Name = *patch.Name
+	}
+	if patch.Description != nil {
+		item.Description = *patch.Description
+	}
+	for key, value := range patch.Metadata {
+		if value == nil {
+			delete(item.Metadata, key)
+		} else {
+			item.Metadata[key] = *value
+		}
+	}
+	return updateItem(db, name, item)
+}
+
+// MergeItems folds the item named from into the item named into, for duplicates of the same thing:
+// every user's votes for from count towards into from then on, and from is deleted
+// into keeps from's ID in its MergedFrom, so that rebuilding scores counts the logged votes for from towards it too
+func MergeItems(db database.Database, poll string, from string, into string) (database.Item, error) {
+	if from == into {
+		return database.Item{}, InvalidItemError{Reason: "can't merge an item into itself"}
+	}
+	fromItem, err := db.Items.GetItem(poll, from)
+	if err != nil {
+		return fromItem, err
+	}
+	intoItem, err := db.Items.GetItem(poll, into)
+	if err != nil {
+		return intoItem, err
+	}
+	system, err := ratingSystemFromEnv()
+	if err != nil {
+		return intoItem, err
+	}
+	err = db.Votes.MergeItems(fromItem, intoItem, system.Merge)
+	if err != nil {
+		return intoItem, fmt.Errorf("error merging items in db: %v", err)
+	}
+	// the merge is recorded on into, which changes its version
+	return db.Items.GetItem(poll, into)
+}
+
+// the ETag header for an item is its version
+func itemETag(item database.Item) string {
+	return strconv.Quote(strconv.Itoa(item.Version))
+}
+
+// reads the version out of an If-Match header holding an item's ETag
+func parseItemETag(header string) (int, error) {
+	tag, err := strconv.Unquote(strings.TrimSpace(header))
+	if err == nil {
+		version, err := strconv.Atoi(tag)
+		if err == nil {
+			return version, nil
+		}
+	}
+	return 0, fmt.Errorf("If-Match must be an ETag returned for the item")
+}
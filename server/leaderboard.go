@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	. "github.com/quevivasbien/ranker-backend/database"
+)
+
+// an item's place in the global ranking, with how sure the rating system is of its rating
+type leaderboardEntry struct {
+	Rank        int    `json:"rank"`
+	ItemID      string `json:"itemId"`
+	ItemName    string `json:"itemName"`
+	Description string `json:"description"`
+	Standing
+	Confidence
+}
+
+// what the leaderboard can be ordered by
+const SORT_BY_RATING = "rating"
+const SORT_BY_CONSERVATIVE_SCORE = "conservativeScore"
+
+type InvalidSortError struct {
+	Sort string
+}
+
+func (e InvalidSortError) Error() string {
+	return fmt.Sprintf("can't sort by %s; sort must be %s or %s", e.Sort, SORT_BY_RATING, SORT_BY_CONSERVATIVE_SCORE)
+}
+
+// returns a page of a poll's global ranking, with item names and descriptions, and the cursor for the next page
+// the ranking is by rating, or by conservative score, which keeps items with a few lucky votes from coming out on top
+func GetLeaderboard(db Database, poll string, options LeaderboardOptions, sortBy string) ([]leaderboardEntry, string, error) {
+	if sortBy == SORT_BY_CONSERVATIVE_SCORE {
+		return conservativeLeaderboard(db, poll, options)
+	}
+	if sortBy != SORT_BY_RATING {
+		return nil, "", InvalidSortError{Sort: sortBy}
+	}
+	scores, next, err := db.GlobalScores.Leaderboard(poll, options)
+	if err != nil {
+		return nil, "", err
+	}
+	entries, err := leaderboardEntries(db, poll, scores)
+	return entries, next, err
+}
+
+// the stores only keep scores in order of rating, so ranking by conservative score reads the whole leaderboard
+// and sorts it for every page; the cursor is the number of entries on the pages before
+func conservativeLeaderboard(db Database, poll string, options LeaderboardOptions) ([]leaderboardEntry, string, error) {
+	start := 0
+	if options.Cursor != "" {
+		var err error
+		start, err = strconv.Atoi(options.Cursor)
+		if err != nil || start < 0 {
+			return nil, "", InvalidCursorError{}
+		}
+	}
+	scores, _, err := db.GlobalScores.Leaderboard(poll, LeaderboardOptions{MinVotes: options.MinVotes})
+	if err != nil {
+		return nil, "", err
+	}
+	entries, err := leaderboardEntries(db, poll, scores)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ConservativeScore > entries[j].ConservativeScore
+	})
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	if start > len(entries) {
+		start = len(entries)
+	}
+	entries = entries[start:]
+	next := ""
+	if options.Limit > 0 && len(entries) > options.Limit {
+		entries = entries[:options.Limit]
+		next = strconv.Itoa(start + options.Limit)
+	}
+	return entries, next, nil
+}
+
+// adds the item names and descriptions and the rating system's confidence to scores
+func leaderboardEntries(db Database, poll string, scores []RankedScore) ([]leaderboardEntry, error) {
+	system, err := ratingSystemFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	// scores only know their item's ID
+	allItems, err := db.Items.AllItems(poll)
+	if err != nil {
+		return nil, fmt.Errorf("error getting list of items from db: %v", err)
+	}
+	items := map[string]Item{}
+	for _, item := range allItems {
+		items[item.ID] = item
+	}
+	entries := make([]leaderboardEntry, len(scores))
+	for i, score := range scores {
+		item := items[score.ItemID]
+		entries[i] = leaderboardEntry{
+			Rank:        score.Rank,
+			ItemID:      score.ItemID,
+			ItemName:    item.Name,
+			Description: item.Description,
+			Standing:    score.Standing,
+			Confidence:  system.Confidence(score.Standing),
+		}
+	}
+	return entries, nil
+}
+
+// an item's global score, along with the item's name and how sure the rating system is of it
+type globalScoreEntry struct {
+	GlobalScore
+	Confidence
+	ItemName string `json:"itemName"`
+}
+
+// returns the global score of the item with the given name
+func GetGlobalScore(db Database, poll string, itemName string) (globalScoreEntry, error) {
+	item, err := db.Items.GetItem(poll, itemName)
+	if err != nil {
+		return globalScoreEntry{}, err
+	}
+	globalScore, err := db.GlobalScores.GetGlobalScore(poll, item.ID)
+	if err != nil {
+		return globalScoreEntry{}, err
+	}
+	system, err := ratingSystemFromEnv()
+	if err != nil {
+		return globalScoreEntry{}, err
+	}
+	return globalScoreEntry{GlobalScore: globalScore, Confidence: system.Confidence(globalScore.Standing), ItemName: item.Name}, nil
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/quevivasbien/ranker-backend/database"
+)
+
+// what a user is allowed to do
+// every new user is a voter; curators manage the items; admins can do everything
+const ROLE_VOTER = "voter"
+const ROLE_CURATOR = "curator"
+const ROLE_ADMIN = "admin"
+
+var allRoles = []string{ROLE_VOTER, ROLE_CURATOR, ROLE_ADMIN}
+
+type InvalidRoleError struct {
+	Role string
+}
+
+func (e InvalidRoleError) Error() string {
+	return fmt.Sprintf("no such role: %s", e.Role)
+}
+
+// the authenticated user making a request
+type principal struct {
+	Name      string
+	Roles     []string
+	SessionID string
+}
+
+func (p principal) hasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role || r == ROLE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+// a rule for who may make a request
+type permission func(p principal, r *http.Request) bool
+
+func anyUser(p principal, r *http.Request) bool {
+	return true
+}
+
+func hasRole(role string) permission {
+	return func(p principal, r *http.Request) bool {
+		return p.hasRole(role)
+	}
+}
+
+// allows only the user named by the route variable
+func isSelf(routeVar string) permission {
+	return func(p principal, r *http.Request) bool {
+		return mux.Vars(r)[routeVar] == p.Name
+	}
+}
+
+// allows the user named by the route variable, and anyone with the role
+func selfOrRole(routeVar string, role string) permission {
+	return func(p principal, r *http.Request) bool {
+		return mux.Vars(r)[routeVar] == p.Name || p.hasRole(role)
+	}
+}
+
+// allows the owner of the poll the request is about, and anyone with the role
+// only for routes wrapped in requirePoll
+func pollOwnerOrRole(role string) permission {
+	return func(p principal, r *http.Request) bool {
+		owner := currentPoll(r).Owner
+		return (owner != "" && owner == p.Name) || p.hasRole(role)
+	}
+}
+
+// allows the user named by the route variable, the owner of the poll the request is about, and admins
+// only for routes wrapped in requirePoll
+func selfOrPollOwner(routeVar string) permission {
+	ownerOrAdmin := pollOwnerOrRole(ROLE_ADMIN)
+	return func(p principal, r *http.Request) bool {
+		return mux.Vars(r)[routeVar] == p.Name || ownerOrAdmin(p, r)
+	}
+}
+
+type contextKey int
+
+const principalKey contextKey = 0
+
+// returns the user making a request, checking their token unless an earlier wrapper already has
+func authenticate(db database.Database, r *http.Request) (principal, error) {
+	if p, ok := r.Context().Value(principalKey).(principal); ok {
+		return p, nil
+	}
+	claims, err := verifyRequest(db, r)
+	if err != nil {
+		return principal{}, err
+	}
+	return principal{Name: claims.Subject, Roles: claims.Roles, SessionID: claims.SessionID}, nil
+}
+
+// requirePermission wraps a handler so that it only runs for requests with a valid token that passes check
+// the handler can get the user making the request with currentUser
+func requirePermission(db database.Database, check permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(db, r)
+		if err != nil {
+			setHTTPError(w, err)
+			return
+		}
+		if !check(p, r) {
+			setHTTPError(w, InsufficientPermissionsError{})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	}
+}
+
+// the user making a request that went through requirePermission
+func currentUser(r *http.Request) principal {
+	p, _ := r.Context().Value(principalKey).(principal)
+	return p
+}
+
+func validRole(role string) bool {
+	for _, r := range allRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// saves a user's roles, leaving the rest of the user alone
+// the user may have been deleted since it was read, in which case the NotFoundError is passed on
+func setRoles(db database.Database, user database.User) error {
+	err := db.Users.SetUserRoles(user.Name, user.Roles)
+	if _, ok := err.(database.NotFoundError); ok {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error updating user in db: %v", err)
+	}
+	return nil
+}
+
+// GrantRole gives a user a role, if they don't have it already
+func GrantRole(db database.Database, name string, role string) (database.User, error) {
+	if !validRole(role) {
+		return database.User{}, InvalidRoleError{Role: role}
+	}
+	user, err := db.Users.GetUser(name)
+	if err != nil {
+		return user, err
+	}
+	for _, r := range user.Roles {
+		if r == role {
+			return user, nil
+		}
+	}
+	user.Roles = append(user.Roles, role)
+	return user, setRoles(db, user)
+}
+
+// RevokeRole takes a role away from a user
+// their tokens still carry the role, so their sessions are ended too, and they have to log in again
+func RevokeRole(db database.Database, name string, role string) (database.User, error) {
+	if !validRole(role) {
+		return database.User{}, InvalidRoleError{Role: role}
+	}
+	user, err := db.Users.GetUser(name)
+	if err != nil {
+		return user, err
+	}
+	roles := []string{}
+	for _, r := range user.Roles {
+		if r != role {
+			roles = append(roles, r)
+		}
+	}
+	if len(roles) == len(user.Roles) {
+		return user, nil
+	}
+	user.Roles = roles
+	err = setRoles(db, user)
+	if err != nil {
+		return user, err
+	}
+	err = db.Sessions.DeleteUserSessions(name, "")
+	if err != nil {
+		return user, fmt.Errorf("error ending sessions: %v", err)
+	}
+	return user, nil
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"github.com/quevivasbien/ranker-backend/database"
+)
+
+type InvalidVisibilityError struct {
+	Visibility string
+}
+
+func (e InvalidVisibilityError) Error() string {
+	return fmt.Sprintf("no such visibility: %s", e.Visibility)
+}
+
+type InvalidPollNameError struct {
+	Reason string
+}
+
+func (e InvalidPollNameError) Error() string {
+	return "invalid poll name: " + e.Reason
+}
+
+// who can see and vote in a poll
+// public polls are listed and open to everyone; unlisted polls are open to anyone who knows the name;
+// private polls are only open to their owner, their members and admins
+const VISIBILITY_PUBLIC = "public"
+const VISIBILITY_UNLISTED = "unlisted"
+const VISIBILITY_PRIVATE = "private"
+
+func validateVisibility(visibility string) error {
+	switch visibility {
+	case VISIBILITY_PUBLIC, VISIBILITY_UNLISTED, VISIBILITY_PRIVATE:
+		return nil
+	}
+	return InvalidVisibilityError{Visibility: visibility}
+}
+
+const MAX_POLL_NAME_LENGTH = 64
+
+// poll names appear in URLs, so they're kept to lowercase slugs
+// this also keeps # out of them, which the DynamoDB user score keys rely on
+var pollNamePattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+func validatePollName(name string) error {
+	if len(name) == 0 || len(name) > MAX_POLL_NAME_LENGTH {
+		return InvalidPollNameError{Reason: fmt.Sprintf("must be 1 to %d characters long", MAX_POLL_NAME_LENGTH)}
+	}
+	if !pollNamePattern.MatchString(name) {
+		return InvalidPollNameError{Reason: "may only contain lowercase letters and digits, separated by single '-'s"}
+	}
+	return nil
+}
+
+// CreatePoll adds a new, empty poll owned by owner
+// polls are public unless they say otherwise
+func CreatePoll(db database.Database, poll database.Poll, owner string) (database.Poll, error) {
+	err := validatePollName(poll.Name)
+	if err != nil {
+		return poll, err
+	}
+	if poll.Visibility == "" {
+		poll.Visibility = VISIBILITY_PUBLIC
+	}
+	err = validateVisibility(poll.Visibility)
+	if err != nil {
+		return poll, err
+	}
+	poll.Owner = owner
+	return poll, db.Polls.CreatePoll(poll)
+}
+
+// the fields of a poll its owner can change; missing fields are left as they are
+type pollUpdate struct {
+	Description *string `json:"description"`
+	Visibility  *string `json:"visibility"`
+}
+
+// UpdatePoll changes a poll's description or visibility
+func UpdatePoll(db database.Database, poll database.Poll, update pollUpdate) (database.Poll, error) {
+	if update.Visibility != nil {
+		err := validateVisibility(*update.Visibility)
+		if err != nil {
+			return poll, err
+		}
+		poll.Visibility = *update.Visibility
+	}
+	if update.Description != nil {
+		poll.Description = *update.Description
+	}
+	err := db.Polls.PutPoll(poll)
+	if err != nil {
+		return poll, fmt.Errorf("error updating poll in db: %v", err)
+	}
+	return poll, nil
+}
+
+// AllPolls returns the names of every poll, whatever its visibility, for jobs that go through all of them
+func AllPolls(db database.Database) ([]string, error) {
+	var names []string
+	for _, visibility := range []string{VISIBILITY_PUBLIC, VISIBILITY_UNLISTED, VISIBILITY_PRIVATE} {
+		options := database.PageOptions{Limit: MAX_PAGE_SIZE}
+		for {
+			polls, next, err := db.Polls.PollsPage(visibility, options)
+			if err != nil {
+				return nil, fmt.Errorf("error getting list of polls from db: %v", err)
+			}
+			for _, poll := range polls {
+				names = append(names, poll.Name)
+			}
+			if next == "" {
+				break
+			}
+			options.Cursor = next
+		}
+	}
+	return names, nil
+}
+
+// whether the user can see and vote in the poll
+func canAccessPoll(db database.Database, poll database.Poll, p principal) (bool, error) {
+	if poll.Visibility != VISIBILITY_PRIVATE || poll.Owner == p.Name || p.hasRole(ROLE_ADMIN) {
+		return true, nil
+	}
+	member, err := db.PollMembers.IsPollMember(poll.Name, p.Name)
+	if err != nil {
+		return false, fmt.Errorf("error checking poll membership in db: %v", err)
+	}
+	return member, nil
+}
+
+// AddPollMember lets a user into a poll
+func AddPollMember(db database.Database, poll database.Poll, name string) error {
+	_, err := db.Users.GetUser(name)
+	if err != nil {
+		return err
+	}
+	err = db.PollMembers.AddPollMember(poll.Name, name)
+	if err != nil {
+		return fmt.Errorf("error adding poll member in db: %v", err)
+	}
+	return nil
+}
+
+// RemovePollMember takes a user out of a poll
+// when someone else removes them, the poll's invite codes are revoked too, since the user may still have one
+func RemovePollMember(db database.Database, poll database.Poll, name string, removedBy string) error {
+	err := db.PollMembers.RemovePollMember(poll.Name, name)
+	if err != nil {
+		return fmt.Errorf("error removing poll member in db: %v", err)
+	}
+	if removedBy != name {
+		return RevokeInvites(db, poll)
+	}
+	return nil
+}
+
+const pollKey contextKey = 1
+
+// loadPoll wraps a handler for a route under /polls/{poll} so that it only runs if the poll exists
+// routes without a poll in them use the default poll
+// the handler can get the poll with currentPoll
+func loadPoll(db database.Database, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, ok := mux.Vars(r)["poll"]
+		if !ok {
+			name = database.DEFAULT_POLL
+		}
+		poll, err := db.Polls.GetPoll(name)
+		if err != nil {
+			setHTTPError(w, err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), pollKey, poll)))
+	}
+}
+
+// requirePoll is like loadPoll, but for private polls it also makes sure the request comes from someone
+// who can access the poll
+func requirePoll(db database.Database, next http.HandlerFunc) http.HandlerFunc {
+	return loadPoll(db, func(w http.ResponseWriter, r *http.Request) {
+		poll := currentPoll(r)
+		if poll.Visibility != VISIBILITY_PRIVATE {
+			next(w, r)
+			return
+		}
+		p, err := authenticate(db, r)
+		if err != nil {
+			setHTTPError(w, err)
+			return
+		}
+		allowed, err := canAccessPoll(db, poll, p)
+		if err != nil {
+			setHTTPError(w, err)
+			return
+		}
+		if !allowed {
+			setHTTPError(w, InsufficientPermissionsError{})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
+
+// the poll a request that went through requirePoll is about
+func currentPoll(r *http.Request) database.Poll {
+	poll, _ := r.Context().Value(pollKey).(database.Poll)
+	return poll
+}
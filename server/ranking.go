@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	. "github.com/quevivasbien/ranker-backend/database"
+)
+
+// an item's place in a user's personal ranking
+// items the user hasn't voted on yet are included at the end, with Ranked set to false and no rank
+type rankingEntry struct {
+	Rank        int    `json:"rank,omitempty"`
+	ItemID      string `json:"itemId"`
+	ItemName    string `json:"itemName"`
+	Description string `json:"description"`
+	Standing
+	Ranked bool `json:"ranked"`
+}
+
+// returns all of a poll's items, ordered by the user's personal rating
+func GetUserRanking(db Database, poll string, user string) ([]rankingEntry, error) {
+	allItems, err := db.Items.AllItems(poll)
+	if err != nil {
+		return nil, fmt.Errorf("error getting list of items from db: %v", err)
+	}
+	userScores, err := db.UserScores.GetUserScores(poll, user)
+	if err != nil {
+		return nil, fmt.Errorf("error getting user scores from db: %v", err)
+	}
+	scores := map[string]UserScore{}
+	for _, userScore := range userScores {
+		scores[userScore.ItemID] = userScore
+	}
+
+	ranked := []rankingEntry{}
+	unranked := []rankingEntry{}
+	for _, item := range allItems {
+		userScore, ok := scores[item.ID]
+		if !ok || userScore.NumVotes == 0 {
+			unranked = append(unranked, rankingEntry{ItemID: item.ID, ItemName: item.Name, Description: item.Description})
+			continue
+		}
+		ranked = append(ranked, rankingEntry{
+			ItemID:      item.ID,
+			ItemName:    item.Name,
+			Description: item.Description,
+			Standing:    userScore.Standing,
+			Ranked:      true,
+		})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Rating != ranked[j].Rating {
+			return ranked[i].Rating > ranked[j].Rating
+		}
+		return ranked[i].ItemName < ranked[j].ItemName
+	})
+	sort.Slice(unranked, func(i, j int) bool { return unranked[i].ItemName < unranked[j].ItemName })
+	for i := range ranked {
+		ranked[i].Rank = i + 1
+	}
+	return append(ranked, unranked...), nil
+}
+
+// a user's score for an item, along with the item's name
+type userScoreEntry struct {
+	UserScore
+	ItemName string `json:"itemName"`
+}
+
+// returns a user's score for the item with the given name
+func GetUserScore(db Database, poll string, itemName string, user string) (userScoreEntry, error) {
+	item, err := db.Items.GetItem(poll, itemName)
+	if err != nil {
+		return userScoreEntry{}, err
+	}
+	userScore, err := db.UserScores.GetUserScore(poll, item.ID, user)
+	if err != nil {
+		return userScoreEntry{}, err
+	}
+	return userScoreEntry{UserScore: userScore, ItemName: item.Name}, nil
+}
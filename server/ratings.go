@@ -0,0 +1,372 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	. "github.com/quevivasbien/ranker-backend/database"
+)
+
+// the math that turns votes into ratings
+// every score in a deployment is rated with the same system, chosen with RANKER_RATING_SYSTEM
+// standings that haven't been voted on yet are passed in as a zero Standing
+type RatingSystem interface {
+	// adjusts the standings of two items for a vote between them, in place; the vote counts are left to the caller
+	Vote(standing1, standing2 *Standing, winner1 bool)
+	// combines the standing of an item that is being merged away with that of the item it's merged into
+	Merge(from, into Standing) Standing
+	// takes a deleted user's votes out of an item's global standing, in place, given their own standing for the item
+	BackOut(user Standing, global *Standing)
+	// how sure the system is of a standing's rating
+	Confidence(s Standing) Confidence
+}
+
+// how sure a rating system is of a rating, treating the rating as an estimate with a standard deviation
+// ConservativeScore is the rating less three deviations, which the item's true rating is very likely to be above,
+// and Interval95 is the range its true rating is in with 95% probability
+type Confidence struct {
+	ConservativeScore float64    `json:"conservativeScore"`
+	Interval95        [2]float64 `json:"interval95"`
+}
+
+func normalConfidence(rating int, deviation float64) Confidence {
+	mean := float64(rating)
+	return Confidence{
+		ConservativeScore: mean - 3*deviation,
+		Interval95:        [2]float64{mean - 1.96*deviation, mean + 1.96*deviation},
+	}
+}
+
+// combines two standings as independent estimates of the same rating: the ratings are averaged, weighted by
+// how certain each is, which makes the result more certain than either, and the vote counts add up
+// both need to have deviations
+func combineEstimates(from, into Standing) Standing {
+	fromWeight := 1 / (from.Deviation * from.Deviation)
+	intoWeight := 1 / (into.Deviation * into.Deviation)
+	return Standing{
+		Rating:    int(math.Round((float64(from.Rating)*fromWeight + float64(into.Rating)*intoWeight) / (fromWeight + intoWeight))),
+		NumVotes:  from.NumVotes + into.NumVotes,
+		Deviation: math.Sqrt(1 / (fromWeight + intoWeight)),
+	}
+}
+
+// the rating systems RANKER_RATING_SYSTEM can name
+var ratingSystems = map[string]RatingSystem{
+	"elo":       elo{},
+	"glicko2":   glicko2{},
+	"trueskill": trueSkill{},
+}
+
+// reads the rating system from RANKER_RATING_SYSTEM, which is elo unless set
+func ratingSystemFromEnv() (RatingSystem, error) {
+	name := os.Getenv("RANKER_RATING_SYSTEM")
+	if name == "" {
+		name = "elo"
+	}
+	system, ok := ratingSystems[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid RANKER_RATING_SYSTEM: %s", name)
+	}
+	return system, nil
+}
+
+// the global rating can't be rewound exactly without the individual votes, so the user's effect on it is taken
+// to be how far their votes moved their own rating of the item away from the initial rating
+func backOutRating(user Standing, global *Standing, initial int) {
+	global.NumVotes -= user.NumVotes
+	global.Rating -= user.Rating - initial
+}
+
+const DEFAULT_ELO = 1000
+const ELO_K = 64
+
+// the standard error of an Elo rating after a single vote, from how much a vote between evenly matched items
+// tells the logistic model behind Elo about a rating: (ln 10 / 400)² / 4
+const ELO_DEVIATION = 2 * 400 / math.Ln10
+
+// plain Elo, which only keeps a rating
+type elo struct{}
+
+func computeScoreChanges(score1 int, score2 int, winner1 bool) (int, int) {
+	expected1 := 1 / (1 + math.Pow(10, float64(score2-score1)/400))
+	expected2 := 1 / (1 + math.Pow(10, float64(score1-score2)/400))
+	if winner1 {
+		newScore1 := score1 + int(ELO_K*(1-expected1))
+		newScore2 := score2 + int(ELO_K*(0-expected2))
+		return newScore1, newScore2
+	} else {
+		newScore1 := score1 + int(ELO_K*(0-expected1))
+		newScore2 := score2 + int(ELO_K*(1-expected2))
+		return newScore1, newScore2
+	}
+}
+
+// gives standings that haven't been voted on yet the default rating
+// deviation and volatility left over from another rating system don't mean anything to Elo, so they're dropped
+func initElo(s *Standing) {
+	if s.NumVotes == 0 {
+		s.Rating = DEFAULT_ELO
+	}
+	s.Deviation, s.Volatility = 0, 0
+}
+
+func (elo) Vote(standing1, standing2 *Standing, winner1 bool) {
+	initElo(standing1)
+	initElo(standing2)
+	standing1.Rating, standing2.Rating = computeScoreChanges(standing1.Rating, standing2.Rating, winner1)
+}
+
+// the scores of merged items are combined as if all their votes had been for one item:
+// the vote counts add up, and the ratings are averaged, weighted by how many votes each has
+func (elo) Merge(from, into Standing) Standing {
+	numVotes := from.NumVotes + into.NumVotes
+	if numVotes == 0 {
+		return into
+	}
+	return Standing{Rating: (from.Rating*from.NumVotes + into.Rating*into.NumVotes) / numVotes, NumVotes: numVotes}
+}
+
+func (elo) BackOut(user Standing, global *Standing) {
+	backOutRating(user, global, DEFAULT_ELO)
+}
+
+// Elo doesn't keep track of how sure it is of a rating, so the deviation is approximated from the vote count
+// as ELO_DEVIATION / √n; this ignores how far apart the items voted on were, so it's only a rough guide
+func (elo) Confidence(s Standing) Confidence {
+	deviation := ELO_DEVIATION / math.Sqrt(math.Max(float64(s.NumVotes), 1))
+	return normalConfidence(s.Rating, deviation)
+}
+
+const GLICKO2_DEFAULT_RATING = 1500
+const GLICKO2_DEFAULT_DEVIATION = 350
+const GLICKO2_DEFAULT_VOLATILITY = 0.06
+
+// how much the volatility can change; smaller values keep it steadier
+const GLICKO2_TAU = 0.5
+
+// ratings and deviations are divided by this to put them on the Glicko-2 scale
+const GLICKO2_SCALE = 173.7178
+
+// how closely the new volatility is solved for
+const GLICKO2_EPSILON = 0.000001
+
+// Glicko-2, which also keeps how uncertain a rating is (its deviation) and how erratic it has been (its volatility),
+// so that items with few votes move quickly and settled items move slowly
+// every vote is treated as a rating period of its own with a single game in it
+// ratings are rounded to whole numbers when they're stored, like Elo ratings
+type glicko2 struct{}
+
+// gives standings that haven't been voted on yet the default rating, and standings that were rated with
+// a system without deviations the default deviation and volatility, which keeps their rating but makes it uncertain
+func initGlicko2(s *Standing) {
+	if s.NumVotes == 0 {
+		s.Rating = GLICKO2_DEFAULT_RATING
+	}
+	if s.NumVotes == 0 || s.Deviation == 0 {
+		s.Deviation = GLICKO2_DEFAULT_DEVIATION
+		s.Volatility = GLICKO2_DEFAULT_VOLATILITY
+	}
+}
+
+func (glicko2) Vote(standing1, standing2 *Standing, winner1 bool) {
+	initGlicko2(standing1)
+	initGlicko2(standing2)
+	score1 := 0.0
+	if winner1 {
+		score1 = 1
+	}
+	// both items are updated from their standings before the vote
+	*standing1, *standing2 = glicko2Update(*standing1, glicko2Game{*standing2, score1}), glicko2Update(*standing2, glicko2Game{*standing1, 1 - score1})
+}
+
+// a game in a rating period, where score is 1 for a win and 0 for a loss
+type glicko2Game struct {
+	opponent Standing
+	score    float64
+}
+
+// the standing s moves to after a rating period with the given games
+// this follows the steps in Glickman's description of Glicko-2
+func glicko2Update(s Standing, games ...glicko2Game) Standing {
+	mu := float64(s.Rating-GLICKO2_DEFAULT_RATING) / GLICKO2_SCALE
+	phi := s.Deviation / GLICKO2_SCALE
+
+	// v is the estimated variance of the rating from the games alone, and improvement is how much better
+	// the results were than expected, each game weighted by how sure its opponent's rating is
+	var information, improvement float64
+	for _, game := range games {
+		opponentMu := float64(game.opponent.Rating-GLICKO2_DEFAULT_RATING) / GLICKO2_SCALE
+		opponentPhi := game.opponent.Deviation / GLICKO2_SCALE
+		g := 1 / math.Sqrt(1+3*opponentPhi*opponentPhi/(math.Pi*math.Pi))
+		expected := 1 / (1 + math.Exp(-g*(mu-opponentMu)))
+		information += g * g * expected * (1 - expected)
+		improvement += g * (game.score - expected)
+	}
+	v := 1 / information
+	delta := v * improvement
+
+	volatility := glicko2Volatility(phi, s.Volatility, v, delta)
+	phiStar := math.Sqrt(phi*phi + volatility*volatility)
+	phi = 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	mu += phi * phi * improvement
+
+	s.Rating = int(math.Round(mu*GLICKO2_SCALE)) + GLICKO2_DEFAULT_RATING
+	s.Deviation = phi * GLICKO2_SCALE
+	s.Volatility = volatility
+	return s
+}
+
+// solves for the new volatility with the Illinois algorithm; A, B and C are named as in Glickman's description
+func glicko2Volatility(phi, volatility, v, delta float64) float64 {
+	a := math.Log(volatility * volatility)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(GLICKO2_TAU*GLICKO2_TAU)
+	}
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*GLICKO2_TAU) < 0 {
+			k++
+		}
+		B = a - k*GLICKO2_TAU
+	}
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > GLICKO2_EPSILON {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	return math.Exp(A / 2)
+}
+
+// the standings of merged items are combined as two independent estimates of the same rating,
+// and the volatilities are averaged, weighted by how many votes each has
+func (glicko2) Merge(from, into Standing) Standing {
+	if from.NumVotes == 0 {
+		return into
+	}
+	if into.NumVotes == 0 {
+		return from
+	}
+	initGlicko2(&from)
+	initGlicko2(&into)
+	merged := combineEstimates(from, into)
+	merged.Volatility = (from.Volatility*float64(from.NumVotes) + into.Volatility*float64(into.NumVotes)) / float64(merged.NumVotes)
+	return merged
+}
+
+// the deviation is left as it was, since how much of its certainty came from the user's votes isn't known
+func (glicko2) BackOut(user Standing, global *Standing) {
+	backOutRating(user, global, GLICKO2_DEFAULT_RATING)
+}
+
+// standings carried over from Elo are as uncertain as they'd be at their next vote
+func (glicko2) Confidence(s Standing) Confidence {
+	initGlicko2(&s)
+	return normalConfidence(s.Rating, s.Deviation)
+}
+
+// TrueSkill's defaults, scaled up so that means can be stored as whole numbers like other ratings
+const TRUESKILL_DEFAULT_MEAN = 1500
+const TRUESKILL_DEFAULT_SIGMA = TRUESKILL_DEFAULT_MEAN / 3.0
+
+// how far apart two items' performances can be from vote to vote
+const TRUESKILL_BETA = TRUESKILL_DEFAULT_SIGMA / 2
+
+// how much uncertainty is added before each vote, so that ratings can keep changing
+const TRUESKILL_TAU = TRUESKILL_DEFAULT_SIGMA / 100
+
+// TrueSkill for two items and no draws, which treats each rating as a normal distribution of where the item's
+// true rating might be, with the mean as Rating and the standard deviation, sigma, as Deviation
+// means are rounded to whole numbers when they're stored, like Elo ratings
+type trueSkill struct{}
+
+// gives standings that haven't been voted on yet the default mean, and standings that were rated with
+// a system without deviations the default sigma, which keeps their rating but makes it uncertain
+func initTrueSkill(s *Standing) {
+	if s.NumVotes == 0 {
+		s.Rating = TRUESKILL_DEFAULT_MEAN
+	}
+	if s.NumVotes == 0 || s.Deviation == 0 {
+		s.Deviation = TRUESKILL_DEFAULT_SIGMA
+	}
+	s.Volatility = 0
+}
+
+func (trueSkill) Vote(standing1, standing2 *Standing, winner1 bool) {
+	initTrueSkill(standing1)
+	initTrueSkill(standing2)
+	winner, loser := standing1, standing2
+	if !winner1 {
+		winner, loser = standing2, standing1
+	}
+	winnerVariance := winner.Deviation*winner.Deviation + TRUESKILL_TAU*TRUESKILL_TAU
+	loserVariance := loser.Deviation*loser.Deviation + TRUESKILL_TAU*TRUESKILL_TAU
+	c := math.Sqrt(2*TRUESKILL_BETA*TRUESKILL_BETA + winnerVariance + loserVariance)
+	t := float64(winner.Rating-loser.Rating) / c
+	// how much the means move and the variances shrink, which is more the more surprising the result
+	v := trueSkillV(t)
+	w := v * (v + t)
+
+	winnerMean := float64(winner.Rating) + winnerVariance/c*v
+	loserMean := float64(loser.Rating) - loserVariance/c*v
+	winner.Rating = int(math.Round(winnerMean))
+	loser.Rating = int(math.Round(loserMean))
+	winner.Deviation = math.Sqrt(winnerVariance * (1 - winnerVariance/(c*c)*w))
+	loser.Deviation = math.Sqrt(loserVariance * (1 - loserVariance/(c*c)*w))
+}
+
+// below this, the normal PDF and CDF both underflow towards 0, so their ratio is taken from its asymptotic expansion
+const TRUESKILL_ASYMPTOTIC_T = -30
+
+// the ratio of the normal PDF to the CDF at t, which is how far the winner's performance is likely to have
+// beaten expectations by, in units of c
+func trueSkillV(t float64) float64 {
+	if t < TRUESKILL_ASYMPTOTIC_T {
+		return -t - 1/t
+	}
+	return normalPDF(t) / normalCDF(t)
+}
+
+func normalPDF(x float64) float64 {
+	return math.Exp(-x*x/2) / math.Sqrt(2*math.Pi)
+}
+
+func normalCDF(x float64) float64 {
+	return math.Erfc(-x/math.Sqrt2) / 2
+}
+
+// the standings of merged items are combined as two independent estimates of the same rating
+func (trueSkill) Merge(from, into Standing) Standing {
+	if from.NumVotes == 0 {
+		return into
+	}
+	if into.NumVotes == 0 {
+		return from
+	}
+	initTrueSkill(&from)
+	initTrueSkill(&into)
+	return combineEstimates(from, into)
+}
+
+// sigma is left as it was, since how much of its certainty came from the user's votes isn't known
+func (trueSkill) BackOut(user Standing, global *Standing) {
+	backOutRating(user, global, TRUESKILL_DEFAULT_MEAN)
+}
+
+// standings carried over from Elo are as uncertain as they'd be at their next vote
+func (trueSkill) Confidence(s Standing) Confidence {
+	initTrueSkill(&s)
+	return normalConfidence(s.Rating, s.Deviation)
+}
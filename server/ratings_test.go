@@ -0,0 +1,84 @@
+package server
+
+import (
+	"math"
+	"testing"
+
+	"github.com/quevivasbien/ranker-backend/database"
+)
+
+func closeTo(got, want, tolerance float64) bool {
+	return math.Abs(got-want) <= tolerance
+}
+
+// the example worked through in Glickman's "Example of the Glicko-2 system"
+func TestGlicko2PaperExample(t *testing.T) {
+	player := database.Standing{Rating: 1500, NumVotes: 1, Deviation: 200, Volatility: 0.06}
+	games := []glicko2Game{
+		{opponent: database.Standing{Rating: 1400, Deviation: 30}, score: 1},
+		{opponent: database.Standing{Rating: 1550, Deviation: 100}, score: 0},
+		{opponent: database.Standing{Rating: 1700, Deviation: 300}, score: 0},
+	}
+	got := glicko2Update(player, games...)
+
+	// the paper's rating of 1464.06 is stored rounded
+	if got.Rating != 1464 {
+		t.Errorf("rating is %d, want 1464", got.Rating)
+	}
+	if !closeTo(got.Deviation, 151.52, 0.01) {
+		t.Errorf("deviation is %f, want 151.52", got.Deviation)
+	}
+	if !closeTo(got.Volatility, 0.05999, 0.00001) {
+		t.Errorf("volatility is %f, want 0.05999", got.Volatility)
+	}
+}
+
+func TestTrueSkillEvenMatch(t *testing.T) {
+	winner := database.Standing{}
+	loser := database.Standing{}
+	trueSkill{}.Vote(&winner, &loser, true)
+
+	// the two move apart by the same amount from the default mean, and become equally more certain
+	if winner.Rating != 1752 || loser.Rating != 1248 {
+		t.Errorf("ratings are %d and %d, want 1752 and 1248", winner.Rating, loser.Rating)
+	}
+	if !closeTo(winner.Deviation, 431.689, 0.001) || !closeTo(loser.Deviation, 431.689, 0.001) {
+		t.Errorf("deviations are %f and %f, want 431.689", winner.Deviation, loser.Deviation)
+	}
+}
+
+func TestTrueSkillUpset(t *testing.T) {
+	underdog := database.Standing{Rating: 1200, NumVotes: 10, Deviation: 100}
+	favorite := database.Standing{Rating: 1800, NumVotes: 10, Deviation: 100}
+	trueSkill{}.Vote(&underdog, &favorite, true)
+
+	if underdog.Rating != 1253 || favorite.Rating != 1747 {
+		t.Errorf("ratings are %d and %d, want 1253 and 1747", underdog.Rating, favorite.Rating)
+	}
+	if !closeTo(underdog.Deviation, 97.116, 0.001) || !closeTo(favorite.Deviation, 97.116, 0.001) {
+		t.Errorf("deviations are %f and %f, want 97.116", underdog.Deviation, favorite.Deviation)
+	}
+
+	// the favorite winning instead is no surprise, so it moves the ratings much less
+	underdog = database.Standing{Rating: 1200, NumVotes: 10, Deviation: 100}
+	favorite = database.Standing{Rating: 1800, NumVotes: 10, Deviation: 100}
+	trueSkill{}.Vote(&underdog, &favorite, false)
+
+	if underdog.Rating != 1197 || favorite.Rating != 1803 {
+		t.Errorf("ratings are %d and %d, want 1197 and 1803", underdog.Rating, favorite.Rating)
+	}
+}
+
+func TestTrueSkillExtremeUpset(t *testing.T) {
+	underdog := database.Standing{Rating: -50000, NumVotes: 10, Deviation: 10}
+	favorite := database.Standing{Rating: 50000, NumVotes: 10, Deviation: 10}
+	trueSkill{}.Vote(&underdog, &favorite, true)
+
+	// the normal PDF and CDF both underflow to 0 this far out, which would give NaN without the asymptotic form
+	if math.IsNaN(underdog.Deviation) || math.IsNaN(favorite.Deviation) {
+		t.Fatalf("deviations are %f and %f", underdog.Deviation, favorite.Deviation)
+	}
+	if underdog.Rating <= -50000 || favorite.Rating >= 50000 {
+		t.Errorf("ratings are %d and %d, want them to move towards each other", underdog.Rating, favorite.Rating)
+	}
+}
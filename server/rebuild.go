@@ -0,0 +1,335 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/quevivasbien/ranker-backend/database"
+)
+
+// how many scores are written to the shadow set at a time
+const REBUILD_BATCH_SIZE = 500
+
+// how many times a rebuild catches up with votes cast while it was running before giving up
+const MAX_REBUILD_SWAPS = 5
+
+// where a rebuild of a poll's scores is up to
+const REBUILD_RUNNING = "running"
+const REBUILD_DONE = "done"
+const REBUILD_FAILED = "failed"
+
+type RebuildProgress struct {
+	Poll  string `json:"poll"`
+	State string `json:"state"`
+	// votes replayed into the new scores, and votes left out because their items or users are gone
+	EventsReplayed int `json:"eventsReplayed"`
+	EventsSkipped  int `json:"eventsSkipped"`
+	// scores written to the shadow set so far
+	ScoresStaged int        `json:"scoresStaged"`
+	StartedAt    time.Time  `json:"startedAt"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// error type for rebuilds that would leave the scores with fewer votes than they have now,
+// which means some of the votes they count can't be replayed: ones cast before there was a vote log,
+// ones by users who were deleted without retracting them, or ones between items that have since been merged
+type RebuildLosesVotesError struct {
+	Current int
+	Rebuilt int
+}
+
+func (e RebuildLosesVotesError) Error() string {
+	return fmt.Sprintf(
+		"the rebuilt scores would count %d votes, but the current scores count %d; "+
+			"votes that aren't in the vote log, like those cast before it existed, would be dropped, so rebuild with force to go ahead anyway",
+		e.Rebuilt, e.Current,
+	)
+}
+
+type RebuildRunningError struct {
+	Poll string
+}
+
+func (e RebuildRunningError) Error() string {
+	return fmt.Sprintf("the scores of poll %s are already being rebuilt", e.Poll)
+}
+
+type userItem struct {
+	user   string
+	itemID string
+}
+
+// the scores of a poll as they are rebuilt from its vote log
+type scoreReplay struct {
+	db     database.Database
+	poll   string
+	system RatingSystem
+	// the items votes are counted for, by the IDs they have in the log
+	items        map[string]database.Item
+	voters       voters
+	userScores   map[userItem]*database.UserScore
+	globalScores map[string]*database.GlobalScore
+	// the scores that have changed since they were last staged
+	changedUserScores   map[userItem]bool
+	changedGlobalScores map[string]bool
+	// the cursor of the last page of events read, and the ID of the last event replayed
+	cursor    string
+	lastEvent string
+	progress  *RebuildProgress
+	report    func(RebuildProgress)
+}
+
+func newScoreReplay(db database.Database, poll string, progress *RebuildProgress, report func(RebuildProgress)) (*scoreReplay, error) {
+	system, err := ratingSystemFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	items, err := loggedItems(db, poll)
+	if err != nil {
+		return nil, err
+	}
+	replay := &scoreReplay{
+		db:                  db,
+		poll:                poll,
+		system:              system,
+		items:               items,
+		voters:              newVoters(db),
+		userScores:          map[userItem]*database.UserScore{},
+		globalScores:        map[string]*database.GlobalScore{},
+		changedUserScores:   map[userItem]bool{},
+		changedGlobalScores: map[string]bool{},
+		progress:            progress,
+		report:              report,
+	}
+	return replay, nil
+}
+
+func (replay *scoreReplay) userScore(user, itemID string) *database.UserScore {
+	key := userItem{user, itemID}
+	replay.changedUserScores[key] = true
+	u, ok := replay.userScores[key]
+	if !ok {
+		u = &database.UserScore{Poll: replay.poll, ItemID: itemID, UserName: user}
+		replay.userScores[key] = u
+	}
+	return u
+}
+
+func (replay *scoreReplay) globalScore(itemID string) *database.GlobalScore {
+	replay.changedGlobalScores[itemID] = true
+	g, ok := replay.globalScores[itemID]
+	if !ok {
+		g = &database.GlobalScore{Poll: replay.poll, ItemID: itemID}
+		replay.globalScores[itemID] = g
+	}
+	return g
+}
+
+// applies one logged vote to the scores, with the same math as when it was cast
+func (replay *scoreReplay) apply(event database.VoteEvent) error {
+	item1, ok1 := replay.items[event.Item1]
+	item2, ok2 := replay.items[event.Item2]
+	// votes between two items that have since been merged into one don't say anything about it
+	if !ok1 || !ok2 || item1.ID == item2.ID {
+		replay.progress.EventsSkipped++
+		return nil
+	}
+	cast, err := replay.voters.cast(event)
+	if err != nil {
+		return err
+	}
+	if !cast {
+		replay.progress.EventsSkipped++
+		return nil
+	}
+	applyVote(replay.system, event.Winner == event.Item1)(
+		replay.userScore(event.UserName, item1.ID), replay.userScore(event.UserName, item2.ID),
+		replay.globalScore(item1.ID), replay.globalScore(item2.ID),
+	)
+	replay.progress.EventsReplayed++
+	return nil
+}
+
+// replays the events logged since the last ones replayed
+// the last page is read again each time, since there's no cursor for the events after it until there are some
+func (replay *scoreReplay) catchUp() error {
+	for {
+		events, next, err := replay.db.VoteEvents.VoteEventsPage(replay.poll, database.PageOptions{Limit: VOTE_LOG_PAGE_SIZE, Cursor: replay.cursor})
+		if err != nil {
+			return fmt.Errorf("error getting vote events from db: %v", err)
+		}
+		for _, event := range events {
+			if event.ID <= replay.lastEvent {
+				continue
+			}
+			err = replay.apply(event)
+			if err != nil {
+				return err
+			}
+			replay.lastEvent = event.ID
+		}
+		replay.report(*replay.progress)
+		if next == "" {
+			return nil
+		}
+		replay.cursor = next
+	}
+}
+
+// how many votes the global scores of the items that aren't in the trash count between them,
+// counting each vote once for each of the two items
+func (replay *scoreReplay) countVotes() int {
+	count := 0
+	for itemID, g := range replay.globalScores {
+		if replay.items[itemID].DeletedAt == nil {
+			count += g.NumVotes
+		}
+	}
+	return count
+}
+
+// writes the scores that have changed since they were last staged into the rebuild's shadow set
+func (replay *scoreReplay) stage(rebuild string) error {
+	userScores := make([]database.UserScore, 0, len(replay.changedUserScores))
+	for key := range replay.changedUserScores {
+		userScores = append(userScores, *replay.userScores[key])
+	}
+	globalScores := make([]database.GlobalScore, 0, len(replay.changedGlobalScores))
+	for itemID := range replay.changedGlobalScores {
+		globalScores = append(globalScores, *replay.globalScores[itemID])
+	}
+	for len(userScores) > 0 || len(globalScores) > 0 {
+		// user scores go first, and global scores fill up whatever room is left in the batch
+		userBatch := userScores
+		if len(userBatch) > REBUILD_BATCH_SIZE {
+			userBatch = userBatch[:REBUILD_BATCH_SIZE]
+		}
+		userScores = userScores[len(userBatch):]
+		globalBatch := globalScores
+		if len(globalBatch) > REBUILD_BATCH_SIZE-len(userBatch) {
+			globalBatch = globalBatch[:REBUILD_BATCH_SIZE-len(userBatch)]
+		}
+		globalScores = globalScores[len(globalBatch):]
+		err := replay.db.ScoreRebuilds.StageScores(replay.poll, rebuild, userBatch, globalBatch)
+		if err != nil {
+			return err
+		}
+		replay.progress.ScoresStaged += len(userBatch) + len(globalBatch)
+		replay.report(*replay.progress)
+	}
+	replay.changedUserScores = map[userItem]bool{}
+	replay.changedGlobalScores = map[string]bool{}
+	return nil
+}
+
+// RebuildScores replays a poll's vote log in order to work out every user and global score again from scratch,
+// with the current rating math, and replaces the poll's scores with the results all at once
+// votes cast while it runs are caught up with before the swap
+// unless force is set, it refuses to replace scores that count more votes than the log has,
+// since those were cast before there was a vote log
+// report is called with the progress so far as the rebuild goes
+func RebuildScores(db database.Database, poll string, force bool, report func(RebuildProgress)) (RebuildProgress, error) {
+	progress := RebuildProgress{Poll: poll, State: REBUILD_RUNNING, StartedAt: time.Now().Truncate(time.Second)}
+	rebuild, err := randomString(16)
+	if err == nil {
+		var replay *scoreReplay
+		replay, err = newScoreReplay(db, poll, &progress, report)
+		if err == nil {
+			err = replay.rebuild(rebuild, force)
+		}
+		if err != nil {
+			discardErr := db.ScoreRebuilds.DiscardScores(rebuild)
+			if discardErr != nil {
+				log.Printf("error discarding scores of rebuild %s: %v", rebuild, discardErr)
+			}
+		}
+	}
+	now := time.Now().Truncate(time.Second)
+	progress.FinishedAt = &now
+	if err != nil {
+		progress.State = REBUILD_FAILED
+		progress.Error = err.Error()
+	} else {
+		progress.State = REBUILD_DONE
+	}
+	report(progress)
+	return progress, err
+}
+
+func (replay *scoreReplay) rebuild(rebuild string, force bool) error {
+	err := replay.catchUp()
+	if err != nil {
+		return err
+	}
+	if !force {
+		scores, _, err := replay.db.GlobalScores.Leaderboard(replay.poll, database.LeaderboardOptions{})
+		if err != nil {
+			return fmt.Errorf("error getting global scores from db: %v", err)
+		}
+		current := 0
+		for _, score := range scores {
+			current += score.NumVotes
+		}
+		// each vote counts for both of its items
+		if rebuilt := replay.countVotes(); rebuilt < current {
+			return RebuildLosesVotesError{Current: current / 2, Rebuilt: rebuilt / 2}
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		err = replay.stage(rebuild)
+		if err != nil {
+			return err
+		}
+		err = replay.db.ScoreRebuilds.SwapScores(replay.poll, rebuild, replay.lastEvent)
+		if _, ok := err.(database.VersionMismatchError); !ok || attempt == MAX_REBUILD_SWAPS {
+			return err
+		}
+		err = replay.catchUp()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// the latest rebuild of each poll's scores that the server has started, so that its progress can be checked
+// only one rebuild of a poll runs at a time
+type rebuildTracker struct {
+	mu       sync.Mutex
+	progress map[string]RebuildProgress
+}
+
+func newRebuildTracker() *rebuildTracker {
+	return &rebuildTracker{progress: map[string]RebuildProgress{}}
+}
+
+// starts rebuilding a poll's scores in the background, and returns its progress so far
+func (t *rebuildTracker) start(db database.Database, poll string, force bool) (RebuildProgress, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.progress[poll].State == REBUILD_RUNNING {
+		return RebuildProgress{}, RebuildRunningError{Poll: poll}
+	}
+	progress := RebuildProgress{Poll: poll, State: REBUILD_RUNNING, StartedAt: time.Now().Truncate(time.Second)}
+	t.progress[poll] = progress
+	go func() {
+		_, err := RebuildScores(db, poll, force, func(progress RebuildProgress) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.progress[poll] = progress
+		})
+		if err != nil {
+			log.Printf("error rebuilding scores of poll %s: %v", poll, err)
+		}
+	}()
+	return progress, nil
+}
+
+func (t *rebuildTracker) get(poll string) (RebuildProgress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	progress, ok := t.progress[poll]
+	return progress, ok
+}
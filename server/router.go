@@ -2,8 +2,11 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
@@ -20,8 +23,40 @@ func setHTTPError(w http.ResponseWriter, err error) {
 		statusCode = http.StatusUnauthorized
 	} else if _, ok := err.(TokenMissingError); ok {
 		statusCode = http.StatusUnauthorized
+	} else if _, ok := err.(InvalidTokenError); ok {
+		statusCode = http.StatusUnauthorized
 	} else if _, ok := err.(InsufficientPermissionsError); ok {
 		statusCode = http.StatusForbidden
+	} else if _, ok := err.(database.InvalidCursorError); ok {
+		statusCode = http.StatusBadRequest
+	} else if _, ok := err.(InvalidSortError); ok {
+		statusCode = http.StatusBadRequest
+	} else if _, ok := err.(InvalidRoleError); ok {
+		statusCode = http.StatusBadRequest
+	} else if _, ok := err.(InvalidUsernameError); ok {
+		statusCode = http.StatusBadRequest
+	} else if _, ok := err.(InvalidPasswordError); ok {
+		statusCode = http.StatusBadRequest
+	} else if _, ok := err.(InvalidPollNameError); ok {
+		statusCode = http.StatusBadRequest
+	} else if _, ok := err.(InvalidVisibilityError); ok {
+		statusCode = http.StatusBadRequest
+	} else if _, ok := err.(InvalidInviteError); ok {
+		statusCode = http.StatusForbidden
+	} else if _, ok := err.(InvalidItemError); ok {
+		statusCode = http.StatusBadRequest
+	} else if _, ok := err.(InvalidComparisonError); ok {
+		statusCode = http.StatusBadRequest
+	} else if _, ok := err.(database.VersionMismatchError); ok {
+		statusCode = http.StatusPreconditionFailed
+	} else if _, ok := err.(database.AlreadyExistsError); ok {
+		statusCode = http.StatusConflict
+	} else if _, ok := err.(RebuildLosesVotesError); ok {
+		statusCode = http.StatusConflict
+	} else if _, ok := err.(RebuildRunningError); ok {
+		statusCode = http.StatusConflict
+	} else if _, ok := err.(database.NotSupportedError); ok {
+		statusCode = http.StatusNotImplemented
 	} else {
 		statusCode = http.StatusInternalServerError
 	}
@@ -30,117 +65,629 @@ func setHTTPError(w http.ResponseWriter, err error) {
 	w.Write([]byte(err.Error()))
 }
 
+const DEFAULT_PAGE_SIZE = 100
+const MAX_PAGE_SIZE = 1000
+
+// one page of a listing, with the cursor to pass back to get the next one
+type pageResponse[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// reads the limit, cursor and prefix query parameters of a listing request
+func getPageOptions(r *http.Request) (database.PageOptions, error) {
+	query := r.URL.Query()
+	options := database.PageOptions{
+		Limit:  DEFAULT_PAGE_SIZE,
+		Cursor: query.Get("cursor"),
+		Prefix: query.Get("prefix"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MAX_PAGE_SIZE {
+			return options, fmt.Errorf("limit must be a number from 1 to %d", MAX_PAGE_SIZE)
+		}
+		options.Limit = n
+	}
+	return options, nil
+}
+
+// create handler for /polls endpoint
+func handlePolls(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// get a page of polls
+		if r.Method == "GET" {
+			options, err := getPageOptions(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			// unlisted and private polls are only reachable by name
+			polls, next, err := db.Polls.PollsPage(VISIBILITY_PUBLIC, options)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			bytes, err := json.Marshal(pageResponse[database.Poll]{Items: polls, NextCursor: next})
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
+			return
+		}
+
+		// create a new poll
+		if r.Method == "POST" {
+			var poll database.Poll
+			err := json.NewDecoder(r.Body).Decode(&poll)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			poll, err = CreatePoll(db, poll, currentUser(r).Name)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			bytes, err := json.Marshal(poll)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
+			return
+		}
+	}
+}
+
+// create handler for /polls/{poll} endpoint
+func handlePoll(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		poll := currentPoll(r)
+
+		// change the poll's description or visibility
+		if r.Method == "PATCH" {
+			var update pollUpdate
+			err := json.NewDecoder(r.Body).Decode(&update)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			poll, err = UpdatePoll(db, poll, update)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+		}
+
+		bytes, err := json.Marshal(poll)
+		if err != nil {
+			setHTTPError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(bytes)
+	}
+}
+
+// create handler for /polls/{poll}/invites endpoint
+func handlePollInvites(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// revoke every invite code created so far
+		if r.Method == "DELETE" {
+			err := RevokeInvites(db, currentPoll(r))
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// create an invite code
+		if r.Method == "POST" {
+			invite, err := CreateInvite(currentPoll(r))
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			bytes, err := json.Marshal(invite)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
+			return
+		}
+	}
+}
+
+type joinRequest struct {
+	Code string `json:"code"`
+}
+
+// create handler for /polls/{poll}/join endpoint
+func handlePollJoin(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// become a member using an invite code
+		if r.Method == "POST" {
+			var request joinRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			err = JoinPoll(db, currentPoll(r), currentUser(r).Name, request.Code)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+}
+
+// create handler for /polls/{poll}/members endpoint
+func handlePollMembers(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// get a page of member names
+		if r.Method == "GET" {
+			options, err := getPageOptions(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			members, next, err := db.PollMembers.PollMembers(currentPoll(r).Name, options)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			bytes, err := json.Marshal(pageResponse[string]{Items: members, NextCursor: next})
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
+			return
+		}
+	}
+}
+
+// create handler for /polls/{poll}/members/{name} endpoint
+func handlePollMember(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		poll := currentPoll(r)
+
+		// add a member
+		if r.Method == "PUT" {
+			err := AddPollMember(db, poll, name)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// remove a member, or leave the poll
+		if r.Method == "DELETE" {
+			err := RemovePollMember(db, poll, name, currentUser(r).Name)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+}
+
+// writes an item along with its ETag
+func writeItem(w http.ResponseWriter, item database.Item) {
+	bytes, err := json.Marshal(item)
+	if err != nil {
+		setHTTPError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", itemETag(item))
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
 // create handler for /items endpoint
 func handleItems(db database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// get list of all items
+		// get a page of items
 		if r.Method == "GET" {
-			items, err := db.Items.AllItems()
+			options, err := getPageOptions(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			items, next, err := db.Items.ItemsPage(currentPoll(r).Name, options)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			bytes, err := json.Marshal(pageResponse[database.Item]{Items: items, NextCursor: next})
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
+			return
+		}
+
+		// create a new item
+		if r.Method == "POST" {
+			var creation itemCreation
+			err := json.NewDecoder(r.Body).Decode(&creation)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			item, err := CreateItem(db, currentPoll(r).Name, creation)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			writeItem(w, item)
+			return
+		}
+	}
+}
+
+// create handler for /items/{item} endpoint
+func handleItem(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["item"]
+		poll := currentPoll(r).Name
+
+		// get a single item
+		if r.Method == "GET" {
+			item, err := db.Items.GetItem(poll, name)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			writeItem(w, item)
+			return
+		}
+
+		// edit an item; the request must say which version it's editing, so that edits based on
+		// an old copy of the item are refused instead of overwriting newer changes
+		if r.Method == "PUT" || r.Method == "PATCH" {
+			ifMatch := r.Header.Get("If-Match")
+			if ifMatch == "" {
+				w.WriteHeader(http.StatusPreconditionRequired)
+				w.Write([]byte("If-Match header with the item's ETag is required"))
+				return
+			}
+			version, err := parseItemETag(ifMatch)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			var item database.Item
+			if r.Method == "PUT" {
+				var replacement itemReplacement
+				err = json.NewDecoder(r.Body).Decode(&replacement)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(err.Error()))
+					return
+				}
+				item, err = ReplaceItem(db, poll, name, version, replacement)
+			} else {
+				var patch itemPatch
+				err = json.NewDecoder(r.Body).Decode(&patch)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(err.Error()))
+					return
+				}
+				item, err = PatchItem(db, poll, name, version, patch)
+			}
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			writeItem(w, item)
+			return
+		}
+
+		// move an item to the trash
+		if r.Method == "DELETE" {
+			err := TrashItem(db, poll, name)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+}
+
+type mergeRequest struct {
+	Into string `json:"into"`
+}
+
+// create handler for /items/{item}/merge endpoint
+func handleItemMerge(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["item"]
+
+		// fold the item's votes into another item and delete it
+		if r.Method == "POST" {
+			var request mergeRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			item, err := MergeItems(db, currentPoll(r).Name, name, request.Into)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			writeItem(w, item)
+			return
+		}
+	}
+}
+
+// create handler for /trash endpoint
+func handleTrash(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// get a page of the items in the trash
+		if r.Method == "GET" {
+			options, err := getPageOptions(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			items, next, err := db.Items.TrashedItemsPage(currentPoll(r).Name, options)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			bytes, err := json.Marshal(pageResponse[database.Item]{Items: items, NextCursor: next})
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
+			return
+		}
+	}
+}
+
+// create handler for /trash/{item} endpoint
+func handleTrashedItem(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["item"]
+
+		// permanently delete an item in the trash and its scores
+		if r.Method == "DELETE" {
+			err := PurgeItem(db, currentPoll(r).Name, name)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+}
+
+// create handler for /trash/{item}/restore endpoint
+func handleItemRestore(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["item"]
+
+		// take an item out of the trash
+		if r.Method == "POST" {
+			item, err := RestoreItem(db, currentPoll(r).Name, name)
 			if err != nil {
 				setHTTPError(w, err)
 				return
 			}
 
-			bytes, err := json.Marshal(items)
-
-			w.WriteHeader(http.StatusOK)
-			w.Write(bytes)
+			writeItem(w, item)
 			return
 		}
+	}
+}
 
-		// create a new item
-		if r.Method == "POST" {
-			// require jwt token
-			_, err := VerifyUser(r)
+// the details of the requests votes came in are only shown to admins, since they identify the voters' devices
+// events logged before session IDs were left out of the log still have them, so they're never shown
+func redactVoteEvents(events []database.VoteEvent, p principal) {
+	for i := range events {
+		if p.hasRole(ROLE_ADMIN) {
+			delete(events[i].Metadata, "sessionId")
+		} else {
+			events[i].Metadata = map[string]string{}
+		}
+	}
+}
+
+// create handler for /votes endpoint
+func handleVoteEvents(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// get a page of the poll's vote log
+		if r.Method == "GET" {
+			options, err := getPageOptions(r)
 			if err != nil {
-				setHTTPError(w, err)
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
 				return
 			}
 
-			var item database.Item
-			err = json.NewDecoder(r.Body).Decode(&item)
+			events, next, err := db.VoteEvents.VoteEventsPage(currentPoll(r).Name, options)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(err.Error()))
+				setHTTPError(w, err)
 				return
 			}
+			redactVoteEvents(events, currentUser(r))
 
-			err = db.Items.PutItem(item)
+			bytes, err := json.Marshal(pageResponse[database.VoteEvent]{Items: events, NextCursor: next})
 			if err != nil {
 				setHTTPError(w, err)
 				return
 			}
 
 			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
 			return
 		}
 	}
 }
 
-// create handler for /items/{name} endpoint
-func handleItem(db database.Database) http.HandlerFunc {
+// create handler for /rebuild endpoint
+func handleRebuild(db database.Database, rebuilds *rebuildTracker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		name := vars["item"]
+		poll := currentPoll(r).Name
 
-		// get a single item
+		// get the progress of the latest rebuild of the poll's scores
 		if r.Method == "GET" {
-			item, err := db.Items.GetItem(name)
+			progress, ok := rebuilds.get(poll)
+			if !ok {
+				setHTTPError(w, database.MakeNotFoundError(fmt.Sprintf("the scores of poll %s haven't been rebuilt since the server started", poll)))
+				return
+			}
+
+			bytes, err := json.Marshal(progress)
 			if err != nil {
 				setHTTPError(w, err)
 				return
 			}
 
-			bytes, err := json.Marshal(item)
-
 			w.WriteHeader(http.StatusOK)
 			w.Write(bytes)
 			return
 		}
 
-		// delete an item
-		if r.Method == "DELETE" {
-			// require jwt token and admin status
-			_, err := VerifyAdmin(r)
+		// start rebuilding the poll's scores from its vote log
+		if r.Method == "POST" {
+			force := false
+			if value := r.URL.Query().Get("force"); value != "" {
+				var err error
+				force, err = strconv.ParseBool(value)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("force must be true or false"))
+					return
+				}
+			}
+
+			progress, err := rebuilds.start(db, poll, force)
 			if err != nil {
 				setHTTPError(w, err)
 				return
 			}
 
-			err = db.Items.DeleteItem(name)
+			bytes, err := json.Marshal(progress)
 			if err != nil {
 				setHTTPError(w, err)
 				return
 			}
 
-			w.WriteHeader(http.StatusOK)
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(bytes)
 			return
 		}
 	}
 }
 
+type newUserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
 // create handler for /users endpoint
 func handleUsers(db database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		// get list of all users
+		// get a page of users
 		if r.Method == "GET" {
+			options, err := getPageOptions(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
 
-			// require jwt token and admin status
-			_, err := VerifyAdmin(r)
+			users, next, err := db.Users.UsersPage(options)
 			if err != nil {
 				setHTTPError(w, err)
 				return
 			}
 
-			users, err := db.Users.AllUsers()
+			bytes, err := json.Marshal(pageResponse[database.User]{Items: users, NextCursor: next})
 			if err != nil {
 				setHTTPError(w, err)
 				return
 			}
 
-			bytes, err := json.Marshal(users)
-
 			w.WriteHeader(http.StatusOK)
 			w.Write(bytes)
 			return
@@ -148,15 +695,15 @@ func handleUsers(db database.Database) http.HandlerFunc {
 
 		// add a new user
 		if r.Method == "POST" {
-			var user database.User
-			err := json.NewDecoder(r.Body).Decode(&user)
+			var request newUserRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				w.Write([]byte(err.Error()))
 				return
 			}
 
-			err = db.Users.PutUser(user)
+			err = RegisterUser(db, request.Name, request.Password)
 			if err != nil {
 				setHTTPError(w, err)
 				return
@@ -168,23 +715,17 @@ func handleUsers(db database.Database) http.HandlerFunc {
 	}
 }
 
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	Password        string `json:"password"`
+}
+
 // create handler for /users/{name} endpoint
 func handleUser(db database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		name := vars["name"]
 
-		// require jwt token and admin status or matching username
-		username, err := VerifyUser(r)
-		if err != nil {
-			setHTTPError(w, err)
-			return
-		}
-		if username != name && username != "admin" {
-			setHTTPError(w, InsufficientPermissionsError{})
-			return
-		}
-
 		// get a single user
 		if r.Method == "GET" {
 			user, err := db.Users.GetUser(name)
@@ -200,9 +741,40 @@ func handleUser(db database.Database) http.HandlerFunc {
 			return
 		}
 
-		// delete a user
+		// change the user's password
+		if r.Method == "PATCH" {
+			var request changePasswordRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+
+			err = ChangePassword(db, name, request.CurrentPassword, request.Password, currentUser(r).SessionID)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// delete a user and their scores, optionally taking their votes out of the global scores
 		if r.Method == "DELETE" {
-			err = db.Users.DeleteUser(name)
+			retractVotes := false
+			if retract := r.URL.Query().Get("retractVotes"); retract != "" {
+				var err error
+				retractVotes, err = strconv.ParseBool(retract)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("retractVotes must be true or false"))
+					return
+				}
+			}
+
+			err := DeleteUser(db, name, retractVotes)
 			if err != nil {
 				setHTTPError(w, err)
 				return
@@ -214,26 +786,101 @@ func handleUser(db database.Database) http.HandlerFunc {
 	}
 }
 
+// create handler for /users/{name}/ranking endpoint
+func handleUserRanking(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+
+		// get the user's items in order of their personal rating
+		if r.Method == "GET" {
+			ranking, err := GetUserRanking(db, currentPoll(r).Name, name)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			bytes, err := json.Marshal(ranking)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
+			return
+		}
+	}
+}
+
+// create handler for /users/{name}/roles/{role} endpoint
+func handleUserRole(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		role := vars["role"]
+
+		var user database.User
+		var err error
+
+		// grant the role
+		if r.Method == "PUT" {
+			user, err = GrantRole(db, name, role)
+		}
+
+		// revoke the role
+		if r.Method == "DELETE" {
+			// make sure there's always someone left who can grant it back
+			if name == currentUser(r).Name && role == ROLE_ADMIN {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("admins can't revoke their own admin role"))
+				return
+			}
+			user, err = RevokeRole(db, name, role)
+		}
+
+		if err != nil {
+			setHTTPError(w, err)
+			return
+		}
+		bytes, err := json.Marshal(user)
+		if err != nil {
+			setHTTPError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bytes)
+	}
+}
+
 type comparisonResponse struct {
 	Item1  string `json:"item1"`
 	Item2  string `json:"item2"`
 	Winner string `json:"winner"`
 }
 
+// the details of a vote's request that are kept in the vote log
+func voteMetadata(r *http.Request) map[string]string {
+	metadata := map[string]string{
+		"remoteAddr": r.RemoteAddr,
+	}
+	if userAgent := r.UserAgent(); userAgent != "" {
+		metadata["userAgent"] = userAgent
+	}
+	// the address of the client when the server is behind a proxy
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		metadata["forwardedFor"] = forwardedFor
+	}
+	return metadata
+}
+
 // create handler for /compare endpoint
 func handleCompare(db database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		// require jwt token
-		username, err := VerifyUser(r)
-		if err != nil {
-			setHTTPError(w, err)
-			return
-		}
+		username := currentUser(r).Name
+		poll := currentPoll(r).Name
 
 		// get items for comparison
 		if r.Method == "GET" {
-			item1, item2, err := GetItemsForComparison(db, username)
+			item1, item2, err := GetItemsForComparison(db, poll, username)
 			if err != nil {
 				log.Println(err)
 				w.WriteHeader(http.StatusInternalServerError)
@@ -260,10 +907,9 @@ func handleCompare(db database.Database) http.HandlerFunc {
 				w.Write([]byte(err.Error()))
 				return
 			}
-			err = ProcessUserChoice(db, username, response.Item1, response.Item2, response.Winner)
+			err = ProcessUserChoice(db, poll, username, response.Item1, response.Item2, response.Winner, voteMetadata(r))
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte(err.Error()))
+				setHTTPError(w, err)
 			}
 			return
 		}
@@ -278,7 +924,7 @@ func handleGlobalScore(db database.Database) http.HandlerFunc {
 
 		// get the score for a single item
 		if r.Method == "GET" {
-			globalScore, err := db.GlobalScores.GetGlobalScore(itemName)
+			globalScore, err := GetGlobalScore(db, currentPoll(r).Name, itemName)
 			if err != nil {
 				setHTTPError(w, err)
 				return
@@ -296,27 +942,119 @@ func handleGlobalScore(db database.Database) http.HandlerFunc {
 	}
 }
 
-// create handler for /scores/{item}/{user} endpoint
-func handleUserScore(db database.Database) http.HandlerFunc {
+// create handler for /leaderboard endpoint
+func handleLeaderboard(db database.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		itemName := vars["item"]
-		name := vars["user"]
 
-		// require jwt token and admin status or matching username
-		username, err := VerifyUser(r)
-		if err != nil {
-			setHTTPError(w, err)
+		// get a page of the global ranking
+		if r.Method == "GET" {
+			page, err := getPageOptions(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			options := database.LeaderboardOptions{Limit: page.Limit, Cursor: page.Cursor}
+			if minVotes := r.URL.Query().Get("minVotes"); minVotes != "" {
+				options.MinVotes, err = strconv.Atoi(minVotes)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("minVotes must be a number"))
+					return
+				}
+			}
+
+			sortBy := r.URL.Query().Get("sort")
+			if sortBy == "" {
+				sortBy = SORT_BY_RATING
+			}
+
+			entries, next, err := GetLeaderboard(db, currentPoll(r).Name, options, sortBy)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			bytes, err := json.Marshal(pageResponse[leaderboardEntry]{Items: entries, NextCursor: next})
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
+			return
+		}
+	}
+}
+
+// create handler for /leaderboard/bradley-terry and /users/{name}/ranking/bradley-terry endpoints
+func handleFittedRanking(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		poll := currentPoll(r).Name
+		// empty for the global ranking
+		name := mux.Vars(r)["name"]
+
+		// get the latest fitted ranking
+		if r.Method == "GET" {
+			minVotes := 0
+			if value := r.URL.Query().Get("minVotes"); value != "" {
+				var err error
+				minVotes, err = strconv.Atoi(value)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte("minVotes must be a number"))
+					return
+				}
+			}
+
+			ranking, err := GetFittedRanking(db, poll, name, minVotes)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			bytes, err := json.Marshal(ranking)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
 			return
 		}
-		if username != name && username != "admin" {
-			setHTTPError(w, InsufficientPermissionsError{})
+
+		// fit the poll's rankings again now
+		if r.Method == "POST" {
+			_, err := FitRankings(db, poll)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			ranking, err := GetFittedRanking(db, poll, "", 0)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			bytes, err := json.Marshal(ranking)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
 			return
 		}
+	}
+}
+
+// create handler for /scores/{item}/{user} endpoint
+func handleUserScore(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		itemName := vars["item"]
+		name := vars["user"]
 
 		// get the score for a single item
 		if r.Method == "GET" {
-			userScore, err := db.UserScores.GetUserScore(itemName, name)
+			userScore, err := GetUserScore(db, currentPoll(r).Name, itemName, name)
 			if err != nil {
 				setHTTPError(w, err)
 				return
@@ -349,12 +1087,12 @@ func handleLogin(db database.Database) http.HandlerFunc {
 				w.Write([]byte(err.Error()))
 				return
 			}
-			token, err := Login(db, request.Username, request.Password)
+			tokens, err := Login(db, request.Username, request.Password)
 			if err != nil {
 				setHTTPError(w, err)
 				return
 			}
-			bytes, err := json.Marshal(token)
+			bytes, err := json.Marshal(tokens)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte(err.Error()))
@@ -367,37 +1105,148 @@ func handleLogin(db database.Database) http.HandlerFunc {
 
 }
 
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// create handler for /token/refresh endpoint
+func handleRefresh(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			var request refreshRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			tokens, err := Refresh(db, request.RefreshToken)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			bytes, err := json.Marshal(tokens)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
+		}
+	}
+}
+
+// create handler for /logout endpoint
+func handleLogout(db database.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			err := Logout(db, currentUser(r).SessionID)
+			if err != nil {
+				setHTTPError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+// CreateRouter opens the storage backend selected by the environment, creates the bootstrap admin if configured,
+// starts purging old items from the trash and fitting rankings if configured, and creates the HTTP handler
 func CreateRouter() (http.Handler, error) {
-	r := mux.NewRouter()
-	client, err := database.GetClient("us-east-1")
+	retention, err := trashRetentionFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	// the rating system is read again whenever it's needed, but a bad setting should stop the server from starting
+	_, err = ratingSystemFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	fitInterval, err := fitIntervalFromEnv()
 	if err != nil {
 		return nil, err
 	}
-	db, err := database.GetDatabase(client)
+	db, err := database.OpenFromEnv()
 	if err != nil {
 		return nil, err
 	}
+	if name := os.Getenv("RANKER_ADMIN_USER"); name != "" {
+		err = BootstrapAdmin(db, name, os.Getenv("RANKER_ADMIN_PASSWORD"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	startTrashPurger(db, retention)
+	if fitInterval > 0 {
+		startRankingFitter(db, fitInterval)
+	}
+	return NewRouter(db), nil
+}
+
+// NewRouter creates the HTTP handler for the API, backed by the given database
+func NewRouter(db database.Database) http.Handler {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/polls", handlePolls(db)).Methods("GET")
+	r.HandleFunc("/polls", requirePermission(db, hasRole(ROLE_VOTER), handlePolls(db))).Methods("POST")
+	r.HandleFunc("/polls/{poll}", requirePoll(db, handlePoll(db))).Methods("GET")
+	r.HandleFunc("/polls/{poll}", requirePoll(db, requirePermission(db, pollOwnerOrRole(ROLE_ADMIN), handlePoll(db)))).Methods("PATCH")
+	r.HandleFunc("/polls/{poll}/invites", requirePoll(db, requirePermission(db, pollOwnerOrRole(ROLE_ADMIN), handlePollInvites(db)))).Methods("POST", "DELETE")
+	// joining is how users get access to a private poll, so it can't require access already
+	r.HandleFunc("/polls/{poll}/join", loadPoll(db, requirePermission(db, anyUser, handlePollJoin(db)))).Methods("POST")
+	r.HandleFunc("/polls/{poll}/members", requirePoll(db, requirePermission(db, pollOwnerOrRole(ROLE_ADMIN), handlePollMembers(db)))).Methods("GET")
+	r.HandleFunc("/polls/{poll}/members/{name}", requirePoll(db, requirePermission(db, pollOwnerOrRole(ROLE_ADMIN), handlePollMember(db)))).Methods("PUT")
+	r.HandleFunc("/polls/{poll}/members/{name}", requirePoll(db, requirePermission(db, selfOrPollOwner("name"), handlePollMember(db)))).Methods("DELETE")
+
+	// routes about a poll's items and scores are served under /polls/{poll},
+	// and without the prefix for the default poll
+	pollRoute := func(path string, handler http.HandlerFunc, methods ...string) {
+		r.HandleFunc(path, requirePoll(db, handler)).Methods(methods...)
+		r.HandleFunc("/polls/{poll}"+path, requirePoll(db, handler)).Methods(methods...)
+	}
+
+	pollRoute("/items", handleItems(db), "GET")
+	pollRoute("/items", requirePermission(db, pollOwnerOrRole(ROLE_CURATOR), handleItems(db)), "POST")
+	pollRoute("/items/{item}", handleItem(db), "GET")
+	pollRoute("/items/{item}", requirePermission(db, pollOwnerOrRole(ROLE_CURATOR), handleItem(db)), "PUT", "PATCH", "DELETE")
+	pollRoute("/items/{item}/merge", requirePermission(db, pollOwnerOrRole(ROLE_ADMIN), handleItemMerge(db)), "POST")
+	pollRoute("/trash", requirePermission(db, pollOwnerOrRole(ROLE_ADMIN), handleTrash(db)), "GET")
+	pollRoute("/trash/{item}", requirePermission(db, pollOwnerOrRole(ROLE_ADMIN), handleTrashedItem(db)), "DELETE")
+	pollRoute("/trash/{item}/restore", requirePermission(db, pollOwnerOrRole(ROLE_ADMIN), handleItemRestore(db)), "POST")
+
+	r.HandleFunc("/users", requirePermission(db, hasRole(ROLE_ADMIN), handleUsers(db))).Methods("GET")
+	r.HandleFunc("/users", handleUsers(db)).Methods("POST")
+	r.HandleFunc("/users/{name}", requirePermission(db, selfOrRole("name", ROLE_ADMIN), handleUser(db))).Methods("GET", "DELETE")
+	r.HandleFunc("/users/{name}", requirePermission(db, isSelf("name"), handleUser(db))).Methods("PATCH")
+	pollRoute("/users/{name}/ranking", requirePermission(db, selfOrRole("name", ROLE_ADMIN), handleUserRanking(db)), "GET")
+	pollRoute("/users/{name}/ranking/bradley-terry", requirePermission(db, selfOrRole("name", ROLE_ADMIN), handleFittedRanking(db)), "GET")
+	r.HandleFunc("/users/{name}/roles/{role}", requirePermission(db, hasRole(ROLE_ADMIN), handleUserRole(db))).Methods("PUT", "DELETE")
 
-	r.HandleFunc("/items", handleItems(db)).Methods("GET", "POST")
-	r.HandleFunc("/items/{item}", handleItem(db)).Methods("GET", "DELETE")
+	pollRoute("/compare", requirePermission(db, hasRole(ROLE_VOTER), handleCompare(db)), "GET", "POST")
 
-	r.HandleFunc("/users", handleUsers(db)).Methods("GET", "POST")
-	r.HandleFunc("/users/{name}", handleUser(db)).Methods("GET", "DELETE")
+	pollRoute("/votes", requirePermission(db, pollOwnerOrRole(ROLE_ADMIN), handleVoteEvents(db)), "GET")
+	pollRoute("/rebuild", requirePermission(db, hasRole(ROLE_ADMIN), handleRebuild(db, newRebuildTracker())), "GET", "POST")
 
-	r.HandleFunc("/compare", handleCompare(db)).Methods("GET", "POST")
+	pollRoute("/leaderboard", handleLeaderboard(db), "GET")
+	pollRoute("/leaderboard/bradley-terry", handleFittedRanking(db), "GET")
+	pollRoute("/leaderboard/bradley-terry", requirePermission(db, pollOwnerOrRole(ROLE_ADMIN), handleFittedRanking(db)), "POST")
 
-	r.HandleFunc("/scores/{item}", handleGlobalScore(db)).Methods("GET")
-	r.HandleFunc("/scores/{item}/{user}", handleUserScore(db)).Methods("GET")
+	pollRoute("/scores/{item}", handleGlobalScore(db), "GET")
+	pollRoute("/scores/{item}/{user}", requirePermission(db, selfOrRole("user", ROLE_ADMIN), handleUserScore(db)), "GET")
 
 	r.HandleFunc("/login", handleLogin(db)).Methods("POST")
+	r.HandleFunc("/token/refresh", handleRefresh(db)).Methods("POST")
+	r.HandleFunc("/logout", requirePermission(db, anyUser, handleLogout(db))).Methods("POST")
 
 	handler := cors.New(
 		cors.Options{
 			AllowedOrigins:   []string{"*"},
 			AllowCredentials: true,
-			AllowedHeaders:   []string{"Authorization", "Content-Type"},
+			AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders:   []string{"Authorization", "Content-Type", "If-Match"},
+			ExposedHeaders:   []string{"ETag"},
 		},
 	).Handler(r)
 
-	return handler, nil
+	return handler
 }
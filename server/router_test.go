@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/quevivasbien/ranker-backend/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// an API backed by a fresh in-memory database, with an admin called admin1
+type testAPI struct {
+	t       *testing.T
+	handler http.Handler
+}
+
+func newTestAPI(t *testing.T) testAPI {
+	t.Setenv("RANKER_JWT_SECRET", "test-secret")
+	t.Setenv("RANKER_RATING_SYSTEM", "")
+	db := database.NewMemoryDatabase()
+	err := BootstrapAdmin(db, "admin1", "adminpassword1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testAPI{t: t, handler: NewRouter(db)}
+}
+
+// sends a request with body encoded as JSON, if there is one, and the given headers
+func (api testAPI) do(method, path, token string, body any, headers map[string]string) *httptest.ResponseRecorder {
+	api.t.Helper()
+	var reader bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&reader).Encode(body)
+		if err != nil {
+			api.t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, &reader)
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, r)
+	return w
+}
+
+// sends a request and fails the test unless it gets the wanted status
+func (api testAPI) expect(status int, method, path, token string, body any) *httptest.ResponseRecorder {
+	api.t.Helper()
+	w := api.do(method, path, token, body, nil)
+	if w.Code != status {
+		api.t.Fatalf("%s %s gave %d %q, want %d", method, path, w.Code, w.Body.String(), status)
+	}
+	return w
+}
+
+func decodeResponse[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var value T
+	err := json.Unmarshal(w.Body.Bytes(), &value)
+	if err != nil {
+		t.Fatalf("can't decode %q: %v", w.Body.String(), err)
+	}
+	return value
+}
+
+func (api testAPI) login(name, password string) Tokens {
+	api.t.Helper()
+	w := api.expect(http.StatusOK, "POST", "/login", "", loginRequest{Username: name, Password: password})
+	return decodeResponse[Tokens](api.t, w)
+}
+
+func (api testAPI) register(name, password string) string {
+	api.t.Helper()
+	api.expect(http.StatusOK, "POST", "/users", "", newUserRequest{Name: name, Password: password})
+	return api.login(name, password).AccessToken
+}
+
+func (api testAPI) addItems(token string, names ...string) {
+	api.t.Helper()
+	for _, name := range names {
+		api.expect(http.StatusOK, "POST", "/items", token, itemCreation{Name: name})
+	}
+}
+
+func TestLoginRefreshAndLogout(t *testing.T) {
+	api := newTestAPI(t)
+	api.expect(http.StatusOK, "POST", "/users", "", newUserRequest{Name: "alice1", Password: "password1"})
+
+	api.expect(http.StatusUnauthorized, "POST", "/login", "", loginRequest{Username: "alice1", Password: "wrongpassword1"})
+	// logging in as someone who doesn't exist looks the same as getting the password wrong
+	wrongPassword := api.do("POST", "/login", "", loginRequest{Username: "alice1", Password: "wrongpassword1"}, nil)
+	noUser := api.do("POST", "/login", "", loginRequest{Username: "nobody1", Password: "wrongpassword1"}, nil)
+	if noUser.Code != wrongPassword.Code || noUser.Body.String() != wrongPassword.Body.String() {
+		t.Errorf("logging in as an unknown user gave %d %q, want %d %q like a wrong password",
+			noUser.Code, noUser.Body.String(), wrongPassword.Code, wrongPassword.Body.String())
+	}
+	tokens := api.login("alice1", "password1")
+	api.expect(http.StatusOK, "GET", "/users/alice1", tokens.AccessToken, nil)
+
+	w := api.expect(http.StatusOK, "POST", "/token/refresh", "", refreshRequest{RefreshToken: tokens.RefreshToken})
+	refreshed := decodeResponse[Tokens](t, w)
+	if refreshed.RefreshToken == tokens.RefreshToken {
+		t.Errorf("refresh token wasn't rotated")
+	}
+	api.expect(http.StatusOK, "GET", "/users/alice1", refreshed.AccessToken, nil)
+
+	// a refresh token that's already been used ends the session
+	api.expect(http.StatusUnauthorized, "POST", "/token/refresh", "", refreshRequest{RefreshToken: tokens.RefreshToken})
+	api.expect(http.StatusUnauthorized, "GET", "/users/alice1", refreshed.AccessToken, nil)
+	api.expect(http.StatusUnauthorized, "POST", "/token/refresh", "", refreshRequest{RefreshToken: refreshed.RefreshToken})
+
+	tokens = api.login("alice1", "password1")
+	api.expect(http.StatusOK, "POST", "/logout", tokens.AccessToken, nil)
+	api.expect(http.StatusUnauthorized, "GET", "/users/alice1", tokens.AccessToken, nil)
+	api.expect(http.StatusUnauthorized, "POST", "/token/refresh", "", refreshRequest{RefreshToken: tokens.RefreshToken})
+}
+
+// an unknown user's login only takes as long as a wrong password if the dummy hash is as costly as real ones
+func TestDummyPasswordHashCost(t *testing.T) {
+	cost, err := bcrypt.Cost([]byte(DUMMY_PASSWORD_HASH))
+	if err != nil || cost != BCRYPT_COST {
+		t.Errorf("the dummy password hash has cost %d (%v), want %d", cost, err, BCRYPT_COST)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	api := newTestAPI(t)
+	admin := api.login("admin1", "adminpassword1").AccessToken
+	alice := api.register("alice1", "password1")
+	api.register("bobby1", "password1")
+
+	api.expect(http.StatusUnauthorized, "GET", "/users/alice1", "", nil)
+	api.expect(http.StatusUnauthorized, "GET", "/users/alice1", "not-a-token", nil)
+	api.expect(http.StatusForbidden, "GET", "/users/bobby1", alice, nil)
+	api.expect(http.StatusForbidden, "GET", "/users", alice, nil)
+	api.expect(http.StatusForbidden, "POST", "/items", alice, itemCreation{Name: "item1"})
+	api.expect(http.StatusOK, "GET", "/users/bobby1", admin, nil)
+	api.expect(http.StatusOK, "POST", "/items", admin, itemCreation{Name: "item1"})
+
+	// a granted role comes with the next token, and a revoked one goes with the current one
+	api.expect(http.StatusOK, "PUT", "/users/alice1/roles/curator", admin, nil)
+	alice = api.login("alice1", "password1").AccessToken
+	api.expect(http.StatusOK, "POST", "/items", alice, itemCreation{Name: "item2"})
+	api.expect(http.StatusOK, "DELETE", "/users/alice1/roles/curator", admin, nil)
+	api.expect(http.StatusUnauthorized, "POST", "/items", alice, itemCreation{Name: "item3"})
+	alice = api.login("alice1", "password1").AccessToken
+	api.expect(http.StatusForbidden, "POST", "/items", alice, itemCreation{Name: "item3"})
+}
+
+func TestCompare(t *testing.T) {
+	api := newTestAPI(t)
+	admin := api.login("admin1", "adminpassword1").AccessToken
+	alice := api.register("alice1", "password1")
+	api.addItems(admin, "item1", "item2")
+
+	api.expect(http.StatusUnauthorized, "GET", "/compare", "", nil)
+	w := api.expect(http.StatusOK, "GET", "/compare", alice, nil)
+	pair := decodeResponse[[]string](t, w)
+	if len(pair) != 2 || pair[0] == pair[1] {
+		t.Fatalf("got %v to compare, want two different items", pair)
+	}
+	api.expect(http.StatusOK, "POST", "/compare", alice, comparisonResponse{Item1: pair[0], Item2: pair[1], Winner: pair[0]})
+
+	// mistakes in the vote are the client's, and don't count
+	api.expect(http.StatusBadRequest, "POST", "/compare", alice, comparisonResponse{Item1: "item1", Item2: "item1", Winner: "item1"})
+	api.expect(http.StatusBadRequest, "POST", "/compare", alice, comparisonResponse{Item1: "item1", Item2: "item2", Winner: "item3"})
+	api.expect(http.StatusNotFound, "POST", "/compare", alice, comparisonResponse{Item1: "item1", Item2: "item3", Winner: "item1"})
+
+	w = api.expect(http.StatusOK, "GET", "/leaderboard", "", nil)
+	leaderboard := decodeResponse[pageResponse[leaderboardEntry]](t, w)
+	if len(leaderboard.Items) != 2 {
+		t.Fatalf("leaderboard has %d entries, want 2", len(leaderboard.Items))
+	}
+	first, second := leaderboard.Items[0], leaderboard.Items[1]
+	if first.ItemName != pair[0] || first.Rank != 1 || first.NumVotes != 1 || first.Rating <= second.Rating {
+		t.Errorf("leaderboard is %+v, want %s first with 1 vote and the higher rating", leaderboard.Items, pair[0])
+	}
+
+	w = api.expect(http.StatusOK, "GET", "/scores/"+pair[0]+"/alice1", alice, nil)
+	score := decodeResponse[database.UserScore](t, w)
+	if score.NumVotes != 1 {
+		t.Errorf("alice1's score for %s has %d votes, want 1", pair[0], score.NumVotes)
+	}
+}
+
+func TestItemPagination(t *testing.T) {
+	api := newTestAPI(t)
+	admin := api.login("admin1", "adminpassword1").AccessToken
+	api.addItems(admin, "item1", "item2", "item3", "item4", "item5")
+
+	seen := map[string]bool{}
+	cursor := ""
+	pages := 0
+	for {
+		path := "/items?limit=2"
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		w := api.expect(http.StatusOK, "GET", path, "", nil)
+		page := decodeResponse[pageResponse[database.Item]](t, w)
+		pages++
+		if len(page.Items) > 2 {
+			t.Fatalf("page has %d items, want at most 2", len(page.Items))
+		}
+		for _, item := range page.Items {
+			if seen[item.Name] {
+				t.Fatalf("%s came up twice", item.Name)
+			}
+			seen[item.Name] = true
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(seen) != 5 || pages != 3 {
+		t.Errorf("got %d items over %d pages, want 5 over 3", len(seen), pages)
+	}
+
+	api.expect(http.StatusBadRequest, "GET", "/items?limit=2&cursor=not-a-cursor", "", nil)
+	api.expect(http.StatusBadRequest, "GET", "/items?limit=-1", "", nil)
+}
+
+func TestItemIfMatch(t *testing.T) {
+	api := newTestAPI(t)
+	admin := api.login("admin1", "adminpassword1").AccessToken
+	api.addItems(admin, "item1")
+
+	w := api.expect(http.StatusOK, "GET", "/items/item1", "", nil)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET /items/item1 has no ETag")
+	}
+	description := "edited"
+	patch := itemPatch{Description: &description}
+
+	w = api.do("PATCH", "/items/item1", admin, patch, nil)
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("PATCH without If-Match gave %d, want %d", w.Code, http.StatusPreconditionRequired)
+	}
+
+	w = api.do("PATCH", "/items/item1", admin, patch, map[string]string{"If-Match": etag})
+	if w.Code != http.StatusOK {
+		t.Fatalf("PATCH with the current ETag gave %d %q, want 200", w.Code, w.Body.String())
+	}
+	newETag := w.Header().Get("ETag")
+	if newETag == "" || newETag == etag {
+		t.Errorf("PATCH gave ETag %q, want one different from %q", newETag, etag)
+	}
+	if item := decodeResponse[database.Item](t, w); item.Description != description {
+		t.Errorf("description is %q, want %q", item.Description, description)
+	}
+
+	// an edit based on the old copy is refused instead of overwriting the newer one
+	w = api.do("PATCH", "/items/item1", admin, patch, map[string]string{"If-Match": etag})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with a stale ETag gave %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+
+	w = api.do("PUT", "/items/item1", admin, itemReplacement{Description: "replaced"}, map[string]string{"If-Match": newETag})
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT with the current ETag gave %d %q, want 200", w.Code, w.Body.String())
+	}
+}
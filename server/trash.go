@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/quevivasbien/ranker-backend/database"
+)
+
+// how long deleted items stay in the trash before they're purged, unless RANKER_TRASH_RETENTION says otherwise
+const DEFAULT_TRASH_RETENTION = 30 * 24 * time.Hour
+
+// how often the trash is checked for items that have been there longer than the retention period
+const TRASH_PURGE_INTERVAL = time.Hour
+
+// reads the retention period from RANKER_TRASH_RETENTION, which is a Go duration like 720h
+func trashRetentionFromEnv() (time.Duration, error) {
+	value := os.Getenv("RANKER_TRASH_RETENTION")
+	if value == "" {
+		return DEFAULT_TRASH_RETENTION, nil
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid RANKER_TRASH_RETENTION: %v", err)
+	}
+	if retention <= 0 {
+		return 0, fmt.Errorf("invalid RANKER_TRASH_RETENTION: must be positive")
+	}
+	return retention, nil
+}
+
+// TrashItem deletes an item from a poll, keeping it and its scores in the trash so that it can be restored
+// items in the trash aren't compared or ranked, and their names stay taken until they're purged
+func TrashItem(db database.Database, poll string, name string) error {
+	item, err := db.Items.GetItem(poll, name)
+	if err != nil {
+		return err
+	}
+	// this fails with NotFoundError if someone else deleted the item first
+	return db.Votes.TrashItem(item, time.Now().Truncate(time.Second))
+}
+
+// RestoreItem takes an item out of the trash, with its scores as they were when it was deleted
+func RestoreItem(db database.Database, poll string, name string) (database.Item, error) {
+	item, err := db.Items.GetTrashedItem(poll, name)
+	if err != nil {
+		return item, err
+	}
+	// this fails with NotFoundError if someone else restored or purged the item first
+	err = db.Votes.RestoreItem(item)
+	if err != nil {
+		return item, err
+	}
+	item.DeletedAt = nil
+	return item, nil
+}
+
+// PurgeItem permanently deletes an item in the trash along with everyone's scores for it
+func PurgeItem(db database.Database, poll string, name string) error {
+	item, err := db.Items.GetTrashedItem(poll, name)
+	if err != nil {
+		return err
+	}
+	return purgeItem(db, item)
+}
+
+func purgeItem(db database.Database, item database.Item) error {
+	// the item goes first, so that its scores are never left around without it being in the trash
+	err := db.Items.DeleteItem(item.Poll, item.Name)
+	if err != nil {
+		return fmt.Errorf("error deleting item from db: %v", err)
+	}
+	err = db.Votes.DeleteItemScores(item.Poll, item.ID)
+	if err != nil {
+		return fmt.Errorf("error deleting item scores from db: %v", err)
+	}
+	return nil
+}
+
+// PurgeTrash permanently deletes every item that was put in the trash before the given time,
+// and returns how many it deleted
+func PurgeTrash(db database.Database, before time.Time) (int, error) {
+	items, err := db.Items.TrashedBefore(before)
+	if err != nil {
+		return 0, fmt.Errorf("error listing trashed items in db: %v", err)
+	}
+	for i, item := range items {
+		err = purgeItem(db, item)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(items), nil
+}
+
+// purges items that have been in the trash for longer than retention every TRASH_PURGE_INTERVAL,
+// for as long as the server runs
+func startTrashPurger(db database.Database, retention time.Duration) {
+	go func() {
+		for ; ; time.Sleep(TRASH_PURGE_INTERVAL) {
+			purged, err := PurgeTrash(db, time.Now().Add(-retention))
+			if err != nil {
+				log.Printf("error purging trash: %v", err)
+			} else if purged > 0 {
+				log.Printf("purged %d items from the trash", purged)
+			}
+		}
+	}()
+}
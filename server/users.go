@@ -0,0 +1,179 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/quevivasbien/ranker-backend/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type InvalidUsernameError struct {
+	Reason string
+}
+
+func (e InvalidUsernameError) Error() string {
+	return "invalid username: " + e.Reason
+}
+
+type InvalidPasswordError struct {
+	Reason string
+}
+
+func (e InvalidPasswordError) Error() string {
+	return "invalid password: " + e.Reason
+}
+
+const MIN_USERNAME_LENGTH = 3
+const MAX_USERNAME_LENGTH = 32
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// names that could be mistaken for the site itself or its staff, which nobody can register for themselves
+// they are compared case-insensitively
+var reservedUsernames = []string{
+	"admin", "administrator", "root", "system", "superuser",
+	"moderator", "mod", "support", "staff", "ranker", "me",
+}
+
+func validateUsername(name string) error {
+	if len(name) < MIN_USERNAME_LENGTH || len(name) > MAX_USERNAME_LENGTH {
+		return InvalidUsernameError{Reason: fmt.Sprintf("must be %d to %d characters long", MIN_USERNAME_LENGTH, MAX_USERNAME_LENGTH)}
+	}
+	if !usernamePattern.MatchString(name) {
+		return InvalidUsernameError{Reason: "may only contain letters, digits, '_', '.' and '-'"}
+	}
+	return nil
+}
+
+func isReservedUsername(name string) bool {
+	for _, reserved := range reservedUsernames {
+		if strings.EqualFold(name, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashes a new password, checking that it's usable
+func hashNewPassword(password string) (string, error) {
+	if password == "" {
+		return "", InvalidPasswordError{Reason: "must not be empty"}
+	}
+	hash, err := HashPassword(password)
+	if err == bcrypt.ErrPasswordTooLong {
+		return "", InvalidPasswordError{Reason: err.Error()}
+	}
+	return hash, err
+}
+
+// creates a user with a hashed password, failing if the name is taken
+func createUser(db database.Database, name string, password string, roles []string) error {
+	if err := validateUsername(name); err != nil {
+		return err
+	}
+	hash, err := hashNewPassword(password)
+	if err != nil {
+		return err
+	}
+	return db.Users.CreateUser(database.User{Name: name, PasswordHash: hash, Roles: roles, CreatedAt: time.Now()})
+}
+
+// RegisterUser signs up a new voter
+func RegisterUser(db database.Database, name string, password string) error {
+	if isReservedUsername(name) {
+		return InvalidUsernameError{Reason: fmt.Sprintf("%s is reserved", name)}
+	}
+	return createUser(db, name, password, []string{ROLE_VOTER})
+}
+
+// BootstrapAdmin creates an administrator account on first boot, so that there's someone to grant roles
+// it leaves an existing user with the same name alone, including their password
+func BootstrapAdmin(db database.Database, name string, password string) error {
+	err := createUser(db, name, password, []string{ROLE_VOTER, ROLE_ADMIN})
+	if _, ok := err.(database.AlreadyExistsError); ok {
+		user, err := db.Users.GetUser(name)
+		if err != nil {
+			return err
+		}
+		if !(principal{Name: user.Name, Roles: user.Roles}).hasRole(ROLE_ADMIN) {
+			log.Printf("Warning: bootstrap admin %s already exists but isn't an admin; not changing it", name)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error creating bootstrap admin: %v", err)
+	}
+	log.Printf("Created bootstrap admin %s", name)
+	return nil
+}
+
+// ChangePassword replaces a user's password if they know the current one
+// all of the user's other sessions are ended, in case someone else had gotten into the account
+func ChangePassword(db database.Database, name string, currentPassword string, newPassword string, sessionID string) error {
+	user, err := db.Users.GetUser(name)
+	if err != nil {
+		return err
+	}
+	if match, _ := checkPassword(user, currentPassword); !match {
+		return PasswordMismatchError{}
+	}
+	user.PasswordHash, err = hashNewPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	// the user may have been deleted since it was read
+	err = db.Users.SetUserPassword(name, user.PasswordHash)
+	if _, ok := err.(database.NotFoundError); ok {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error updating user in db: %v", err)
+	}
+	err = db.Sessions.DeleteUserSessions(name, sessionID)
+	if err != nil {
+		return fmt.Errorf("error ending other sessions: %v", err)
+	}
+	return nil
+}
+
+// DeleteUser deletes a user along with their sessions, scores and fitted rankings
+// their votes stay in the vote log, but aren't counted for anyone who later signs up with the same name
+// if retractVotes is set, their votes are also taken back out of the global scores; otherwise those keep counting them
+func DeleteUser(db database.Database, name string, retractVotes bool) error {
+	_, err := db.Users.GetUser(name)
+	if err != nil {
+		return err
+	}
+	// ending their sessions first means they can't vote again while their scores are being deleted
+	err = db.Sessions.DeleteUserSessions(name, "")
+	if err != nil {
+		return fmt.Errorf("error ending sessions: %v", err)
+	}
+	var backOut database.ScoreBackOut
+	if retractVotes {
+		system, err := ratingSystemFromEnv()
+		if err != nil {
+			return err
+		}
+		backOut = func(userScore database.UserScore, globalScore *database.GlobalScore) {
+			system.BackOut(userScore.Standing, &globalScore.Standing)
+		}
+	}
+	err = db.Votes.DeleteUserScores(name, backOut)
+	if err != nil {
+		return fmt.Errorf("error deleting user scores from db: %v", err)
+	}
+	err = db.FittedRankings.DeleteUserFittedRankings(name)
+	if err != nil {
+		return fmt.Errorf("error deleting user's fitted rankings from db: %v", err)
+	}
+	err = db.Users.DeleteUser(name)
+	if err != nil {
+		return fmt.Errorf("error deleting user from db: %v", err)
+	}
+	return nil
+}
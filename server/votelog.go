@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/quevivasbien/ranker-backend/database"
+)
+
+// how many vote events are read at a time when going through a poll's whole vote log
+const VOTE_LOG_PAGE_SIZE = 1000
+
+// the items of a poll by the IDs that votes for them have in the vote log, which include the IDs of items merged into them
+// items in the trash keep their scores, so they're included too; votes for items that have been purged are left out
+func loggedItems(db database.Database, poll string) (map[string]database.Item, error) {
+	items, err := db.Items.AllItems(poll)
+	if err != nil {
+		return nil, fmt.Errorf("error getting list of items from db: %v", err)
+	}
+	trashed, _, err := db.Items.TrashedItemsPage(poll, database.PageOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting list of trashed items from db: %v", err)
+	}
+	byID := map[string]database.Item{}
+	for _, item := range append(items, trashed...) {
+		byID[item.ID] = item
+		for _, id := range item.MergedFrom {
+			byID[id] = item
+		}
+	}
+	return byID, nil
+}
+
+// remembers when the account of each user who voted was created, or that it no longer exists
+// the votes of deleted users are left out of anything worked out from the vote log, since the log doesn't say
+// whether they asked for their votes to be retracted; so are votes logged under a user's name before their account was created,
+// which were cast by an earlier account with the same name
+type voters struct {
+	db      database.Database
+	created map[string]*time.Time
+}
+
+func newVoters(db database.Database) voters {
+	return voters{db: db, created: map[string]*time.Time{}}
+}
+
+// whether a logged vote was cast by a user who still exists
+func (v voters) cast(event database.VoteEvent) (bool, error) {
+	created, ok := v.created[event.UserName]
+	if !ok {
+		user, err := v.db.Users.GetUser(event.UserName)
+		if _, ok := err.(database.NotFoundError); ok {
+			created = nil
+		} else if err != nil {
+			return false, fmt.Errorf("error getting user from db: %v", err)
+		} else {
+			created = &user.CreatedAt
+		}
+		v.created[event.UserName] = created
+	}
+	if created == nil {
+		return false, nil
+	}
+	// event IDs start with the time the vote was cast in Unix nanoseconds, padded so that they sort in order
+	return created.IsZero() || event.ID >= fmt.Sprintf("%019d", created.UnixNano()), nil
+}